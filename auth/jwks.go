@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/snikch/api/ctx"
+)
+
+// JWK is a single JSON Web Key, as described by RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+	// RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC keys.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+	// Symmetric keys.
+	K string `json:"k,omitempty"`
+}
+
+// PublicKey returns the key in the form used to verify tokens.
+func (jwk JWK) PublicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %s", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", jwk.KeyType)
+}
+
+// decodeBigInt decodes a base64url encoded big endian integer.
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// JWKS is a set of JSON Web Keys, and implements KeySource by finding the key
+// matching a token's kid.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+	// keys holds each decoded key, keyed by kid.
+	keys map[string]interface{}
+}
+
+// ErrKeyNotFound is returned by a KeySource when no key can verify a token,
+// such as when no key matches its kid.
+var ErrKeyNotFound = errors.New("No key found for token")
+
+// ParseJWKS parses and decodes a JSON Web Key Set.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	set := &JWKS{}
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	set.keys = map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		// Keys for encryption aren't used to verify signatures.
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %s: %s", jwk.KeyID, err)
+		}
+		set.keys[jwk.KeyID] = key
+	}
+	return set, nil
+}
+
+// LoadJWKSFile reads and parses a JSON Web Key Set from a file.
+func LoadJWKSFile(file string) (*JWKS, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %s", err.Error())
+	}
+	return ParseJWKS(contents)
+}
+
+// Key implements the KeySource interface. Tokens without a kid can only be
+// verified by a set with a single key.
+func (set *JWKS) Key(context *ctx.Context, header Header) (interface{}, error) {
+	if header.KeyID == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key, nil
+		}
+	}
+	key, ok := set.keys[header.KeyID]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	for _, jwk := range set.Keys {
+		if jwk.KeyID == header.KeyID && jwk.Algorithm != "" && jwk.Algorithm != header.Algorithm {
+			return nil, fmt.Errorf("%w: key %s can't be used with %s", ErrKeyNotFound, header.KeyID, header.Algorithm)
+		}
+	}
+	return key, nil
+}
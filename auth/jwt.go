@@ -0,0 +1,374 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/vc"
+)
+
+// The signing algorithms that tokens can be verified with.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// The codes used for authentication errors, which are registered in the fail
+// error code catalog. They are in the range reserved by fail.ReservedCodeMin.
+const (
+	ErrorCodeMissingToken = 1001
+	ErrorCodeInvalidToken = 1002
+	ErrorCodeExpiredToken = 1003
+)
+
+func init() {
+	description := "The request couldn’t be authenticated. Supply a valid bearer token in the Authorization header."
+	for code, name := range map[int]string{
+		ErrorCodeMissingToken: "missing_token",
+		ErrorCodeInvalidToken: "invalid_token",
+		ErrorCodeExpiredToken: "expired_token",
+	} {
+		fail.RegisterCode(fail.ErrorCode{
+			Code:        code,
+			Name:        name,
+			Status:      http.StatusUnauthorized,
+			Description: description,
+		})
+	}
+}
+
+// Header is the decoded header of a JWT.
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Claims are the registered claims of a JWT, along with every claim in Raw.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	// Scope is a space separated list of scopes granted to the token.
+	Scope string                 `json:"scope,omitempty"`
+	Raw   map[string]interface{} `json:"-"`
+}
+
+// Scopes returns the scopes granted to the token.
+func (claims Claims) Scopes() []string {
+	return strings.Fields(claims.Scope)
+}
+
+// Audience is the aud claim, which may be a single string or an array.
+type Audience []string
+
+// UnmarshalJSON accepts either a string or an array of strings.
+func (audience *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*audience = Audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*audience = multiple
+	return nil
+}
+
+// Contains returns true if the audience includes the value.
+func (audience Audience) Contains(value string) bool {
+	for _, aud := range audience {
+		if aud == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Actor is the vc.Actor for an authenticated token.
+type Actor struct {
+	Claims Claims
+	Type   string
+}
+
+// ActorInfo implements the vc.Actor interface, identifying the actor by the
+// token's subject.
+func (actor Actor) ActorInfo() (string, string) {
+	return actor.Claims.Subject, actor.Type
+}
+
+// Scopes implements the vc.ScopedActor interface, returning the scopes in the
+// token's scope claim.
+func (actor Actor) Scopes() []string {
+	return actor.Claims.Scopes()
+}
+
+// Roles implements the vc.RoleActor interface, returning the roles in the
+// token's roles claim.
+func (actor Actor) Roles() []string {
+	roles := []string{}
+	switch value := actor.Claims.Raw["roles"].(type) {
+	case string:
+		roles = strings.Fields(value)
+	case []interface{}:
+		for _, role := range value {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// KeySource returns the key to verify a token with. Keys are a []byte secret
+// for HS256, an *rsa.PublicKey for RS256, and an *ecdsa.PublicKey for ES256.
+// ErrKeyNotFound, or an error wrapping it, should be returned when the token
+// doesn't identify a usable key. Any other error, such as failing to fetch a
+// key set, is a server error rather than an invalid token.
+type KeySource interface {
+	Key(context *ctx.Context, header Header) (interface{}, error)
+}
+
+// KeySourceFunc wraps a function with the Key signature to a KeySource.
+type KeySourceFunc func(*ctx.Context, Header) (interface{}, error)
+
+// Key implements the KeySource interface and simply calls the function.
+func (fn KeySourceFunc) Key(context *ctx.Context, header Header) (interface{}, error) {
+	return fn(context, header)
+}
+
+// StaticKey returns a KeySource that verifies every token with the same key.
+func StaticKey(key interface{}) KeySource {
+	return KeySourceFunc(func(*ctx.Context, Header) (interface{}, error) {
+		return key, nil
+	})
+}
+
+// JWTAuthenticator implements vc.Authenticator, authenticating requests with a
+// JWT bearer token in the Authorization header.
+type JWTAuthenticator struct {
+	Keys KeySource
+	// Algorithms are the signing algorithms accepted. Tokens using any other
+	// algorithm, including "none", are rejected.
+	Algorithms []string
+	// Issuer and Audience are checked against the iss and aud claims if set.
+	Issuer   string
+	Audience string
+	// Leeway allows for clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+	// AllowMissingExpiry accepts tokens without an exp claim, which never
+	// expire. They are rejected by default.
+	AllowMissingExpiry bool
+	// Realm is included in the WWW-Authenticate challenge.
+	Realm string
+	// Optional allows requests without a token, which are anonymous.
+	Optional bool
+	// ActorType is the type of actor tokens represent, which defaults to
+	// "user".
+	ActorType string
+	// Now returns the current time, and defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewJWTAuthenticator returns a JWTAuthenticator accepting tokens signed with
+// the supplied algorithms, using keys from the key source.
+func NewJWTAuthenticator(keys KeySource, algorithms ...string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Keys:       keys,
+		Algorithms: algorithms,
+		ActorType:  "user",
+	}
+}
+
+// Authenticate implements the vc.Authenticator interface.
+func (authenticator *JWTAuthenticator) Authenticate(context *ctx.Context) (vc.Actor, error) {
+	authorization := context.Request.Header.Get("Authorization")
+	if authorization == "" {
+		if authenticator.Optional {
+			return nil, nil
+		}
+		return nil, authenticator.error(ErrorCodeMissingToken, "", "Missing bearer token")
+	}
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return nil, authenticator.error(ErrorCodeInvalidToken, "invalid_request", "Authorization must be a bearer token")
+	}
+
+	claims, err := authenticator.Verify(context, strings.TrimSpace(authorization[7:]))
+	if err != nil {
+		return nil, err
+	}
+	actorType := authenticator.ActorType
+	if actorType == "" {
+		actorType = "user"
+	}
+	return Actor{Claims: claims, Type: actorType}, nil
+}
+
+// Verify checks the token's signature and claims, returning the claims if it
+// is valid. Invalid tokens are returned as a fail.AuthenticationError, while
+// errors from the key source, other than ErrKeyNotFound, are returned as a
+// fail.Private error.
+func (authenticator *JWTAuthenticator) Verify(context *ctx.Context, token string) (Claims, error) {
+	claims := Claims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, authenticator.invalid("Malformed token")
+	}
+
+	header := Header{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, authenticator.invalid("Malformed token header")
+	}
+	if !authenticator.allows(header.Algorithm) {
+		return claims, authenticator.invalid("Unsupported signing algorithm " + header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, authenticator.invalid("Malformed token signature")
+	}
+	key, err := authenticator.Keys.Key(context, header)
+	if errors.Is(err, ErrKeyNotFound) {
+		return claims, authenticator.invalid("Unknown signing key")
+	}
+	if err != nil {
+		return claims, fail.NewPrivate(err)
+	}
+	if err := verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return claims, authenticator.invalid(err.Error())
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, authenticator.invalid("Malformed token claims")
+	}
+	if err := decodeSegment(parts[1], &claims.Raw); err != nil {
+		return claims, authenticator.invalid("Malformed token claims")
+	}
+
+	now := time.Now()
+	if authenticator.Now != nil {
+		now = authenticator.Now()
+	}
+	if claims.Subject == "" {
+		return claims, authenticator.invalid("Token has no subject")
+	}
+	if claims.ExpiresAt == 0 && !authenticator.AllowMissingExpiry {
+		return claims, authenticator.invalid("Token has no expiry")
+	}
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(authenticator.Leeway)) {
+		return claims, authenticator.error(ErrorCodeExpiredToken, "invalid_token", "Token has expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-authenticator.Leeway)) {
+		return claims, authenticator.invalid("Token is not valid yet")
+	}
+	if authenticator.Issuer != "" && claims.Issuer != authenticator.Issuer {
+		return claims, authenticator.invalid("Token has an invalid issuer")
+	}
+	if authenticator.Audience != "" && !claims.Audience.Contains(authenticator.Audience) {
+		return claims, authenticator.invalid("Token has an invalid audience")
+	}
+	return claims, nil
+}
+
+// allows returns true if the algorithm is accepted.
+func (authenticator *JWTAuthenticator) allows(algorithm string) bool {
+	for _, allowed := range authenticator.Algorithms {
+		if allowed == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// invalid returns an error for a token that can't be accepted.
+func (authenticator *JWTAuthenticator) invalid(message string) fail.AuthenticationError {
+	return authenticator.error(ErrorCodeInvalidToken, "invalid_token", message)
+}
+
+// error returns an AuthenticationError with a bearer challenge, as described
+// by RFC 6750. Requests without any token don't include an error code.
+func (authenticator *JWTAuthenticator) error(code int, errorCode, message string) fail.AuthenticationError {
+	err := fail.NewAuthError(code, message)
+	params := []string{}
+	if authenticator.Realm != "" {
+		params = append(params, fmt.Sprintf("realm=%q", authenticator.Realm))
+	}
+	if errorCode != "" {
+		params = append(params, fmt.Sprintf("error=%q", errorCode), fmt.Sprintf("error_description=%q", message))
+	}
+	err.Challenge = strings.TrimSpace("Bearer " + strings.Join(params, ", "))
+	return err
+}
+
+// decodeSegment decodes a base64url encoded json segment of a token.
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// verifySignature checks the signature of the signing input with the key. The
+// key's type must match the algorithm, so an RSA public key can never be
+// used as an HMAC secret.
+func verifySignature(algorithm string, key interface{}, input string, signature []byte) error {
+	hash := sha256.Sum256([]byte(input))
+	switch algorithm {
+	case HS256:
+		// An empty secret would let anyone sign tokens.
+		secret, ok := key.([]byte)
+		if !ok || len(secret) == 0 {
+			return errors.New("Key is not an HMAC secret")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(input))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("Invalid token signature")
+		}
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("Key is not an RSA public key")
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature); err != nil {
+			return errors.New("Invalid token signature")
+		}
+	case ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() {
+			return errors.New("Key is not a P-256 public key")
+		}
+		if len(signature) != 64 {
+			return errors.New("Invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, hash[:], r, s) {
+			return errors.New("Invalid token signature")
+		}
+	default:
+		return errors.New("Unsupported signing algorithm " + algorithm)
+	}
+	return nil
+}
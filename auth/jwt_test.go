@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// sign creates a token for the claims, signed with the key.
+func sign(t *testing.T, algorithm, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(Header{Algorithm: algorithm, KeyID: kid, Type: "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case RS256:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authenticate runs the authenticator against a request with the token.
+func authenticate(authenticator *JWTAuthenticator, token string) (Actor, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	context := ctx.NewContext()
+	context.Request = r
+	actor, err := authenticator.Authenticate(context)
+	if actor == nil {
+		return Actor{}, err
+	}
+	return actor.(Actor), err
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, err := ParseJWKS([]byte(fmt.Sprintf(`{"keys":[
+		{"kty":"oct","kid":"hs","alg":"HS256","k":%q},
+		{"kty":"RSA","kid":"rs","alg":"RS256","n":%q,"e":%q},
+		{"kty":"EC","kid":"es","alg":"ES256","crv":"P-256","x":%q,"y":%q}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(secret),
+		encode(rsaKey.N), encode(big.NewInt(int64(rsaKey.E))),
+		encode(ecKey.X), encode(ecKey.Y),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := NewJWTAuthenticator(jwks, HS256, RS256, ES256)
+	claims := map[string]interface{}{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	for _, test := range []struct {
+		algorithm, kid string
+		key            interface{}
+	}{
+		{HS256, "hs", secret},
+		{RS256, "rs", rsaKey},
+		{ES256, "es", ecKey},
+	} {
+		actor, err := authenticate(authenticator, sign(t, test.algorithm, test.kid, test.key, claims))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.algorithm, err)
+			continue
+		}
+		if id, typ := actor.ActorInfo(); id != "u1" || typ != "user" {
+			t.Errorf("%s: unexpected actor %s %s", test.algorithm, id, typ)
+		}
+	}
+
+	// A token signed with the wrong key for its kid is rejected.
+	if _, err := authenticate(authenticator, sign(t, HS256, "rs", secret, claims)); err == nil {
+		t.Errorf("Expected a token using the wrong key to be rejected")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("secret")
+	authenticator := NewJWTAuthenticator(StaticKey(secret), HS256)
+	authenticator.Issuer = "issuer"
+	authenticator.Audience = "api"
+	authenticator.Realm = "api"
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+
+	for name, test := range map[string]struct {
+		claims map[string]interface{}
+		code   int
+	}{
+		"valid":      {map[string]interface{}{"sub": "u1", "exp": exp, "iss": "issuer", "aud": []string{"other", "api"}}, 0},
+		"expired":    {map[string]interface{}{"sub": "u1", "iss": "issuer", "aud": "api", "exp": now.Add(-time.Minute).Unix()}, ErrorCodeExpiredToken},
+		"not before": {map[string]interface{}{"sub": "u1", "exp": exp, "iss": "issuer", "aud": "api", "nbf": now.Add(time.Minute).Unix()}, ErrorCodeInvalidToken},
+		"issuer":     {map[string]interface{}{"sub": "u1", "exp": exp, "iss": "other", "aud": "api"}, ErrorCodeInvalidToken},
+		"audience":   {map[string]interface{}{"sub": "u1", "exp": exp, "iss": "issuer", "aud": "other"}, ErrorCodeInvalidToken},
+		"no subject": {map[string]interface{}{"exp": exp, "iss": "issuer", "aud": "api"}, ErrorCodeInvalidToken},
+		"no expiry":  {map[string]interface{}{"sub": "u1", "iss": "issuer", "aud": "api"}, ErrorCodeInvalidToken},
+	} {
+		_, err := authenticate(authenticator, sign(t, HS256, "", secret, test.claims))
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", name, err)
+			}
+			continue
+		}
+		authErr, ok := err.(fail.AuthenticationError)
+		if !ok || authErr.Code != test.code {
+			t.Errorf("%s: expected error code %d, got %v", name, test.code, err)
+			continue
+		}
+		if !strings.HasPrefix(authErr.ErrorHeaders()["WWW-Authenticate"], `Bearer realm="api", error="invalid_token"`) {
+			t.Errorf("%s: unexpected challenge %q", name, authErr.Challenge)
+		}
+	}
+
+	authenticator.AllowMissingExpiry = true
+	if _, err := authenticate(authenticator, sign(t, HS256, "", secret, map[string]interface{}{"sub": "u1", "iss": "issuer", "aud": "api"})); err != nil {
+		t.Errorf("Expected a token without an expiry to be allowed, got %s", err)
+	}
+
+	if _, err := authenticate(authenticator, ""); err == nil {
+		t.Errorf("Expected a missing token to be rejected")
+	}
+	authenticator.Optional = true
+	if _, err := authenticate(authenticator, ""); err != nil {
+		t.Errorf("Expected a missing token to be allowed, got %s", err)
+	}
+	if _, err := authenticate(authenticator, sign(t, "none", "", secret, nil)); err == nil {
+		t.Errorf("Expected an unsigned token to be rejected")
+	}
+}
+
+func TestJWTKeyErrors(t *testing.T) {
+	secret := []byte("secret")
+	claims := map[string]interface{}{"sub": "u1", "exp": time.Now().Add(time.Hour).Unix()}
+	token := sign(t, HS256, "hs", secret, claims)
+
+	// Tokens without a usable key are invalid, without exposing why.
+	unknown := NewJWTAuthenticator(KeySourceFunc(func(*ctx.Context, Header) (interface{}, error) {
+		return nil, fmt.Errorf("%w: kid hs not in https://keys.internal/jwks", ErrKeyNotFound)
+	}), HS256)
+	_, err := authenticate(unknown, token)
+	authErr, ok := err.(fail.AuthenticationError)
+	if !ok || authErr.Code != ErrorCodeInvalidToken || strings.Contains(authErr.ErrorHeaders()["WWW-Authenticate"], "internal") {
+		t.Errorf("Expected an invalid token error without the key source's message, got %v", err)
+	}
+
+	// Failures of the key source itself are server errors.
+	broken := NewJWTAuthenticator(KeySourceFunc(func(*ctx.Context, Header) (interface{}, error) {
+		return nil, errors.New("jwks: dial tcp 10.0.0.1:443: connection refused")
+	}), HS256)
+	if _, err := authenticate(broken, token); !errors.Is(err, fail.ErrPrivate) {
+		t.Errorf("Expected a private error for a failing key source, got %v", err)
+	}
+
+	empty := NewJWTAuthenticator(StaticKey([]byte{}), HS256)
+	if _, err := authenticate(empty, sign(t, HS256, "", []byte{}, claims)); err == nil {
+		t.Errorf("Expected an empty HMAC secret to be rejected")
+	}
+}
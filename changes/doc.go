@@ -20,5 +20,12 @@ struct with the Old and New values as the value.
   //	"FieldB": {"Bar", "Baz"},
   // }
 
+A Patcher applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+documents to a struct, addressing fields by the same names as its KeyMapper,
+and returns the changeset of what was patched.
+
+  patcher := changes.NewPatcher(changes.NewTagMapper("json"))
+  diff, err := patcher.Patch(&entity, r.Header.Get("Content-Type"), body)
+
 */
 package changes
@@ -16,8 +16,9 @@ type KeyMapper interface {
 // TagMapper is a KeyMapper implements that looks up tags in a sorted order for
 // key names, then falls back to the field name.
 type TagMapper struct {
-	tags  []string
-	types map[reflect.Type]KeyIndexes
+	tags     []string
+	nameOnly bool
+	types    map[reflect.Type]KeyIndexes
 	sync.RWMutex
 }
 
@@ -43,6 +44,15 @@ func NewTagMapper(tags ...string) *TagMapper {
 	}
 }
 
+// NewTagNameMapper returns a new TagMapper instance that uses only the name
+// part of a tag, so `json:"name,omitempty"` is keyed as name. NewTagMapper
+// keeps the whole tag, which is what existing Diff keys are made of.
+func NewTagNameMapper(tags ...string) *TagMapper {
+	mapper := NewTagMapper(tags...)
+	mapper.nameOnly = true
+	return mapper
+}
+
 // KeyIndexes implements the KeyMapper interface and returns the keys and their
 // locations in the value's type.
 func (mapper *TagMapper) KeyIndexes(value reflect.Value) (KeyIndexes, error) {
@@ -108,6 +118,9 @@ func (mapper *TagMapper) registerPart(prefix string, indexes KeyIndexes, val ref
 		var tagName string
 		for _, tag := range mapper.tags {
 			tagName = field.Tag.Get(tag)
+			if mapper.nameOnly {
+				tagName = strings.Split(tagName, ",")[0]
+			}
 			if tagName != "" {
 				break
 			}
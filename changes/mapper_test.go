@@ -33,6 +33,7 @@ type TestMappingStruct struct {
 	IncludedStructSingleField struct {
 		IncludedField string
 	} `diff:"include"`
+	OptionsTag string `json:"options_tag,omitempty"`
 }
 
 func TestTagMapping(t *testing.T) {
@@ -57,6 +58,7 @@ func TestTagMapping(t *testing.T) {
 		"IncludedStruct.IncludedField": {15, 0},
 		"IncludedStruct.NoTag":         {15, 1},
 		"IncludedStructSingleField":    {16, 0},
+		"options_tag,omitempty":        {17},
 	}
 	result, err := mapper.KeyIndexes(val)
 	if err != nil {
@@ -67,3 +69,17 @@ func TestTagMapping(t *testing.T) {
 
 	}
 }
+
+func TestTagNameMapping(t *testing.T) {
+	mapper := NewTagNameMapper("db", "json")
+	result, err := mapper.KeyIndexes(reflect.ValueOf(TestMappingStruct{}))
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if index, ok := result.Indexes["options_tag"]; !ok || !reflect.DeepEqual(index, []int{17}) {
+		t.Errorf("Expected options_tag at [17], got %v in %v", index, result.Keys)
+	}
+	if _, ok := result.Indexes["options_tag,omitempty"]; ok {
+		t.Errorf("Expected tag options to be dropped from the name")
+	}
+}
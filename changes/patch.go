@@ -0,0 +1,593 @@
+package changes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/snikch/api/fail"
+	schema "github.com/xeipuuv/gojsonschema"
+)
+
+// The media types of the patch formats a Patcher can apply.
+const (
+	MergePatchMediaType = "application/merge-patch+json"
+	JSONPatchMediaType  = "application/json-patch+json"
+)
+
+// ErrNotStructPointer is returned when a patch is applied to anything other
+// than a pointer to a struct.
+var ErrNotStructPointer = errors.New("a pointer to a struct must be supplied")
+
+// Patcher applies JSON Merge Patches (RFC 7396) and JSON Patches (RFC 6902) to
+// structs. Patches address fields by the same names as its KeyMapper, so a
+// TagMapper for the json tag lets clients patch the fields they are shown,
+// and fields excluded from diffs can't be patched. Nested structs included
+// with `diff:"include"` are patched as nested objects.
+type Patcher struct {
+	KeyMapper KeyMapper
+	// Schema, if set, validates the json representation of a patched struct
+	// before it is applied.
+	Schema *schema.Schema
+}
+
+// NewPatcher returns a Patcher using the supplied mapper.
+func NewPatcher(mapper KeyMapper) *Patcher {
+	return &Patcher{
+		KeyMapper: mapper,
+	}
+}
+
+// Patch applies the body as a merge patch or json patch, depending on the
+// content type of the request it was sent with.
+func (patcher *Patcher) Patch(entity interface{}, contentType string, body []byte) (DiffSet, error) {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	switch mediaType {
+	case JSONPatchMediaType:
+		return patcher.JSONPatch(entity, body)
+	case MergePatchMediaType, "application/json", "":
+		return patcher.MergePatch(entity, body)
+	}
+	return nil, fail.NewBadRequestError(fmt.Errorf("Unsupported patch content type %s", mediaType))
+}
+
+// MergePatch applies a JSON Merge Patch to the entity, which must be a pointer
+// to a struct. The entity is only modified if the patch applies, and the
+// patched entity is valid. The changes made are returned.
+func (patcher *Patcher) MergePatch(entity interface{}, patch []byte) (DiffSet, error) {
+	var patchDocument interface{}
+	if err := decodeJSON(patch, &patchDocument); err != nil {
+		return nil, fail.NewBadRequestError(err)
+	}
+	return patcher.apply(entity, func(document interface{}) (interface{}, error) {
+		return mergePatch(document, patchDocument), nil
+	})
+}
+
+// JSONPatch applies a JSON Patch to the entity, which must be a pointer to a
+// struct. The entity is only modified if every operation applies, and the
+// patched entity is valid. The changes made are returned.
+func (patcher *Patcher) JSONPatch(entity interface{}, patch []byte) (DiffSet, error) {
+	operations := []patchOperation{}
+	if err := decodeJSON(patch, &operations); err != nil {
+		return nil, fail.NewBadRequestError(err)
+	}
+	return patcher.apply(entity, func(document interface{}) (interface{}, error) {
+		for i, operation := range operations {
+			var err error
+			document, err = operation.apply(document)
+			if err != nil {
+				return nil, operationError(i, operation, err)
+			}
+		}
+		return document, nil
+	})
+}
+
+// apply converts the entity to a document keyed by the mapper's names, patches
+// it, then sets any fields that changed on the entity.
+func (patcher *Patcher) apply(entity interface{}, patch func(interface{}) (interface{}, error)) (DiffSet, error) {
+	value := reflect.ValueOf(entity)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return nil, ErrNotStructPointer
+	}
+	original := value.Elem()
+	indexes, err := patcher.KeyMapper.KeyIndexes(original)
+	if err != nil {
+		return nil, err
+	}
+	indexes = visibleIndexes(indexes)
+
+	originalDocument, err := structDocument(original, indexes)
+	if err != nil {
+		return nil, err
+	}
+	document, err := structDocument(original, indexes)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := patch(document)
+	if err != nil {
+		return nil, err
+	}
+	patchedDocument, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, fail.NewValidationError(errors.New("Patched entity must be an object"))
+	}
+	if unknown := unknownKeys(patchedDocument, indexes, ""); len(unknown) > 0 {
+		err := fail.NewValidationError(errors.New("Unknown fields in patch"))
+		for _, key := range unknown {
+			err.WithField(key, "Unknown field")
+		}
+		return nil, err
+	}
+
+	// Apply the changed fields to a copy, so the entity is untouched if any
+	// field can't be set or the result is invalid.
+	updated := reflect.New(original.Type()).Elem()
+	updated.Set(original)
+	invalid := map[string]string{}
+	for _, key := range indexes.Keys {
+		oldValue, _ := documentValue(originalDocument, key)
+		newValue, _ := documentValue(patchedDocument, key)
+		if jsonEqual(oldValue, newValue) {
+			continue
+		}
+		if err := setField(updated.FieldByIndex(indexes.Indexes[key]), newValue); err != nil {
+			invalid[key] = err.Error()
+		}
+	}
+	if len(invalid) > 0 {
+		err := fail.NewValidationError(errors.New("Invalid values in patch"))
+		err.WithFields(invalid)
+		return nil, err
+	}
+
+	if patcher.Schema != nil {
+		body, err := json.Marshal(updated.Interface())
+		if err != nil {
+			return nil, err
+		}
+		result, err := patcher.Schema.Validate(schema.NewBytesLoader(body))
+		if err != nil {
+			return nil, err
+		}
+		if !result.Valid() {
+			return nil, fail.NewSchemaValidationError(result.Errors())
+		}
+	}
+
+	differ := Differ{KeyMapper: patcher.KeyMapper}
+	diffs, err := differ.Between(original.Interface(), updated.Interface())
+	if err != nil {
+		return nil, err
+	}
+	original.Set(updated)
+	return diffs, nil
+}
+
+// visibleIndexes returns the indexes without fields hidden by a "-" tag, such
+// as json:"-", so they can't be set by a patch. Patches naming them fail as
+// unknown fields.
+func visibleIndexes(indexes KeyIndexes) KeyIndexes {
+	visible := NewKeyIndexes()
+	for _, key := range indexes.Keys {
+		hidden := false
+		for _, part := range strings.Split(key, ".") {
+			if part == "-" {
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			visible.Keys = append(visible.Keys, key)
+			visible.Indexes[key] = indexes.Indexes[key]
+		}
+	}
+	return visible
+}
+
+// decodeJSON decodes json keeping numbers exact, so large integers survive
+// being patched.
+func decodeJSON(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// toDocument converts a value to its generic json representation.
+func toDocument(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	err = decodeJSON(data, &document)
+	return document, err
+}
+
+// structDocument returns a document containing every mapped field of the
+// struct. Nested keys, e.g. "Included.Field", are nested objects.
+func structDocument(value reflect.Value, indexes KeyIndexes) (map[string]interface{}, error) {
+	document := map[string]interface{}{}
+	for _, key := range indexes.Keys {
+		fieldValue, err := toDocument(value.FieldByIndex(indexes.Indexes[key]).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		parts := strings.Split(key, ".")
+		parent := document
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				parent[part] = child
+			}
+			parent = child
+		}
+		parent[parts[len(parts)-1]] = fieldValue
+	}
+	return document, nil
+}
+
+// documentValue returns the value for a mapped key in a document.
+func documentValue(document map[string]interface{}, key string) (interface{}, bool) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := document[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		document = child
+	}
+	value, ok := document[parts[len(parts)-1]]
+	return value, ok
+}
+
+// unknownKeys returns the keys in the document that aren't mapped fields.
+func unknownKeys(document map[string]interface{}, indexes KeyIndexes, prefix string) []string {
+	unknown := []string{}
+	for key, value := range document {
+		name := prefix + key
+		if _, ok := indexes.Indexes[name]; ok {
+			continue
+		}
+		nested := false
+		for _, mapped := range indexes.Keys {
+			if strings.HasPrefix(mapped, name+".") {
+				nested = true
+				break
+			}
+		}
+		child, ok := value.(map[string]interface{})
+		if !nested || (!ok && value != nil) {
+			unknown = append(unknown, name)
+			continue
+		}
+		unknown = append(unknown, unknownKeys(child, indexes, name+".")...)
+	}
+	return unknown
+}
+
+// setField sets a field from its generic json representation. A missing or
+// null value sets the field to its zero value.
+func setField(field reflect.Value, value interface{}) error {
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	updated := reflect.New(field.Type())
+	if err := json.Unmarshal(data, updated.Interface()); err != nil {
+		return fmt.Errorf("Must be a valid %s", field.Type())
+	}
+	field.Set(updated.Elem())
+	return nil
+}
+
+// jsonEqual returns true if two generic json values are equal, comparing
+// numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		aFloat, aErr := a.Float64()
+		bFloat, bErr := b.Float64()
+		return aErr == nil && bErr == nil && aFloat == bFloat
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// mergePatch applies a merge patch to a document, as described by RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// patchOperation is a single JSON Patch operation. The value is a pointer, so
+// a missing value can be distinguished from null.
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// errTestFailed is returned when a test operation doesn't match.
+var errTestFailed = errors.New("Test failed")
+
+// operationError returns the error for a JSON Patch operation that couldn't be
+// applied. Failed tests are a conflict with the entity's current state, while
+// other failures are invalid operations.
+func operationError(index int, operation patchOperation, err error) error {
+	message := fmt.Sprintf("Operation %d (%s %s) could not be applied: %s", index, operation.Op, operation.Path, err)
+	if err == errTestFailed {
+		return fail.NewConflictError(errors.New(message))
+	}
+	validationErr := fail.NewValidationError(errors.New(message))
+	validationErr.WithField(operation.Path, err.Error())
+	return validationErr
+}
+
+// apply applies the operation to the document, returning the new document.
+func (operation patchOperation) apply(document interface{}) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	value := func() (interface{}, error) {
+		if operation.Value == nil {
+			return nil, errors.New("Missing value")
+		}
+		var value interface{}
+		err := decodeJSON(*operation.Value, &value)
+		return value, err
+	}
+
+	switch operation.Op {
+	case "add":
+		newValue, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(document, path, newValue)
+	case "remove":
+		document, _, err := pointerRemove(document, path)
+		return document, err
+	case "replace":
+		newValue, err := value()
+		if err != nil {
+			return nil, err
+		}
+		document, _, err = pointerRemove(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(document, path, newValue)
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		var moved interface{}
+		if operation.Op == "move" {
+			if len(path) > len(from) && strings.HasPrefix(operation.Path, operation.From+"/") {
+				return nil, errors.New("Cannot move a value into itself")
+			}
+			document, moved, err = pointerRemove(document, from)
+		} else {
+			moved, err = pointerGet(document, from)
+			if err == nil {
+				moved, err = toDocument(moved)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(document, path, moved)
+	case "test":
+		expected, err := value()
+		if err != nil {
+			return nil, err
+		}
+		actual, err := pointerGet(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, expected) {
+			return nil, errTestFailed
+		}
+		return document, nil
+	}
+	return nil, fmt.Errorf("Unknown operation %q", operation.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("Invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token. The "-" token refers to the end of
+// the array, and is only valid when adding.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	max := length - 1
+	if adding {
+		max = length
+	}
+	if err != nil || index < 0 || index > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("Invalid array index %q", token)
+	}
+	return index, nil
+}
+
+// pointerGet returns the value at the path.
+func pointerGet(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("Path %q does not exist", token)
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			document = node[index]
+		default:
+			return nil, fmt.Errorf("Path %q does not exist", token)
+		}
+	}
+	return document, nil
+}
+
+// pointerAdd adds the value at the path, returning the new document.
+func pointerAdd(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch node := document.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			node[token] = value
+			return node, nil
+		}
+		child, ok := node[token]
+		if !ok {
+			return nil, fmt.Errorf("Path %q does not exist", token)
+		}
+		child, err := pointerAdd(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), len(path) == 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		child, err := pointerAdd(node[index], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("Path %q does not exist", token)
+}
+
+// pointerRemove removes the value at the path, returning the new document and
+// the removed value.
+func pointerRemove(document interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, document, nil
+	}
+	token := path[0]
+	switch node := document.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("Path %q does not exist", token)
+		}
+		if len(path) == 1 {
+			delete(node, token)
+			return node, child, nil
+		}
+		child, removed, err := pointerRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[token] = child
+		return node, removed, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := node[index]
+			return append(node[:index], node[index+1:]...), removed, nil
+		}
+		child, removed, err := pointerRemove(node[index], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[index] = child
+		return node, removed, nil
+	}
+	return nil, nil, fmt.Errorf("Path %q does not exist", token)
+}
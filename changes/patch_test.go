@@ -0,0 +1,180 @@
+package changes
+
+import (
+	"testing"
+
+	"github.com/snikch/api/fail"
+	schema "github.com/xeipuuv/gojsonschema"
+)
+
+type patchStruct struct {
+	Name     string            `json:"name"`
+	Count    int               `json:"count"`
+	Nickname *string           `json:"nickname"`
+	Tags     []string          `json:"tags"`
+	Meta     map[string]string `json:"meta"`
+	Secret   string            `json:"secret" diff:"exclude"`
+	Hidden   string            `json:"-"`
+	Address  struct {
+		City    string `json:"city"`
+		Country string `json:"country"`
+	} `json:"address" diff:"include"`
+}
+
+var testPatcher = NewPatcher(NewTagMapper("json"))
+
+func newPatchStruct() patchStruct {
+	nickname := "nick"
+	entity := patchStruct{
+		Name:     "name",
+		Count:    1,
+		Nickname: &nickname,
+		Tags:     []string{"a", "b"},
+		Meta:     map[string]string{"key": "value"},
+		Secret:   "secret",
+		Hidden:   "hidden",
+	}
+	entity.Address.City = "Wellington"
+	entity.Address.Country = "NZ"
+	return entity
+}
+
+func TestMergePatch(t *testing.T) {
+	entity := newPatchStruct()
+	diffs, err := testPatcher.MergePatch(&entity, []byte(`{
+		"name": "updated",
+		"nickname": null,
+		"meta": {"key": null, "other": "value"},
+		"address": {"city": "Auckland"}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if entity.Name != "updated" || entity.Nickname != nil || entity.Address.City != "Auckland" || entity.Address.Country != "NZ" {
+		t.Errorf("Unexpected entity %+v", entity)
+	}
+	if len(entity.Meta) != 1 || entity.Meta["other"] != "value" {
+		t.Errorf("Unexpected meta %v", entity.Meta)
+	}
+	for _, key := range []string{"name", "nickname", "address.city"} {
+		if _, ok := diffs[key]; !ok {
+			t.Errorf("Expected a diff for %s, got %v", key, diffs)
+		}
+	}
+	if len(diffs) != 3 {
+		t.Errorf("Expected 3 diffs, got %v", diffs)
+	}
+}
+
+func TestMergePatchErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		patch  string
+		status int
+	}{
+		"malformed":     {`{"name":`, 400},
+		"excluded":      {`{"secret": "changed"}`, 422},
+		"hidden":        {`{"-": "changed"}`, 422},
+		"unknown":       {`{"address": {"street": "Cuba"}}`, 422},
+		"invalid value": {`{"count": "many"}`, 422},
+	} {
+		entity := newPatchStruct()
+		_, err := testPatcher.MergePatch(&entity, []byte(test.patch))
+		statusErr, ok := err.(interface {
+			StatusCode() int
+		})
+		if !ok || statusErr.StatusCode() != test.status {
+			t.Errorf("%s: expected status %d, got %v", name, test.status, err)
+		}
+		if entity.Secret != "secret" || entity.Hidden != "hidden" || entity.Count != 1 || entity.Name != "name" {
+			t.Errorf("%s: expected the entity to be unchanged, got %+v", name, entity)
+		}
+	}
+
+	if _, err := testPatcher.MergePatch(newPatchStruct(), []byte(`{}`)); err != ErrNotStructPointer {
+		t.Errorf("Expected ErrNotStructPointer, got %v", err)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	entity := newPatchStruct()
+	diffs, err := testPatcher.JSONPatch(&entity, []byte(`[
+		{"op": "test", "path": "/name", "value": "name"},
+		{"op": "replace", "path": "/count", "value": 2},
+		{"op": "add", "path": "/tags/-", "value": "c"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "copy", "from": "/address/city", "path": "/meta/city"},
+		{"op": "move", "from": "/address/country", "path": "/name"}
+	]`))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if entity.Count != 2 || entity.Name != "NZ" || entity.Address.Country != "" {
+		t.Errorf("Unexpected entity %+v", entity)
+	}
+	if len(entity.Tags) != 2 || entity.Tags[0] != "b" || entity.Tags[1] != "c" {
+		t.Errorf("Unexpected tags %v", entity.Tags)
+	}
+	if entity.Meta["city"] != "Wellington" {
+		t.Errorf("Unexpected meta %v", entity.Meta)
+	}
+	if diff := diffs["count"]; diff.Old != 1 || diff.New != 2 {
+		t.Errorf("Unexpected count diff %+v", diff)
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		patch  string
+		status int
+	}{
+		"failed test":   {`[{"op": "replace", "path": "/count", "value": 2}, {"op": "test", "path": "/name", "value": "other"}]`, 409},
+		"missing path":  {`[{"op": "remove", "path": "/address/street"}]`, 422},
+		"bad index":     {`[{"op": "add", "path": "/tags/5", "value": "c"}]`, 422},
+		"missing value": {`[{"op": "add", "path": "/name"}]`, 422},
+		"unknown op":    {`[{"op": "frobnicate", "path": "/name"}]`, 422},
+		"malformed":     {`{"op": "add"}`, 400},
+		"hidden":        {`[{"op": "add", "path": "/-", "value": "changed"}]`, 422},
+	} {
+		entity := newPatchStruct()
+		_, err := testPatcher.JSONPatch(&entity, []byte(test.patch))
+		statusErr, ok := err.(interface {
+			StatusCode() int
+		})
+		if !ok || statusErr.StatusCode() != test.status {
+			t.Errorf("%s: expected status %d, got %v", name, test.status, err)
+		}
+		if entity.Count != 1 || len(entity.Tags) != 2 || entity.Hidden != "hidden" {
+			t.Errorf("%s: expected the entity to be unchanged, got %+v", name, entity)
+		}
+	}
+}
+
+func TestPatchSchema(t *testing.T) {
+	patchSchema, err := schema.NewSchema(schema.NewStringLoader(`{
+		"type": "object",
+		"properties": {"count": {"type": "integer", "maximum": 10}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patcher := NewPatcher(NewTagMapper("json"))
+	patcher.Schema = patchSchema
+
+	entity := newPatchStruct()
+	_, err = patcher.Patch(&entity, MergePatchMediaType, []byte(`{"count": 11}`))
+	if _, ok := err.(fail.ValidationError); !ok {
+		t.Errorf("Expected a validation error, got %v", err)
+	}
+	if entity.Count != 1 {
+		t.Errorf("Expected the entity to be unchanged, got %d", entity.Count)
+	}
+	if _, err = patcher.Patch(&entity, JSONPatchMediaType+"; charset=utf-8", []byte(`[{"op": "replace", "path": "/count", "value": 10}]`)); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+	if entity.Count != 10 {
+		t.Errorf("Expected count to be patched, got %d", entity.Count)
+	}
+	if _, err = patcher.Patch(&entity, "text/plain", nil); err == nil {
+		t.Errorf("Expected an unsupported content type to be rejected")
+	}
+}
@@ -1,22 +1,40 @@
 package ctx
 
 import (
+	gocontext "context"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // Context represents a single context whether it be a request or otherwise.
 // Passing around a context allows storage of data against the context.
+// A Context also implements the standard library context.Context interface,
+// so it can be passed directly to anything that honours deadlines and
+// cancellation, such as database/sql or net/http clients.
 type Context struct {
 	Request    *http.Request
 	EntityType string
 	data       map[interface{}]interface{}
+	parent     gocontext.Context
+	parentLock sync.RWMutex
 	sync.RWMutex
 }
 
 func NewContext() *Context {
+	return NewContextWithParent(gocontext.Background())
+}
+
+// NewContextWithParent returns a new Context that derives its deadline,
+// cancellation and values from the supplied parent, usually the context of
+// an incoming *http.Request.
+func NewContextWithParent(parent gocontext.Context) *Context {
+	if parent == nil {
+		parent = gocontext.Background()
+	}
 	return &Context{
-		data: map[interface{}]interface{}{},
+		data:   map[interface{}]interface{}{},
+		parent: parent,
 	}
 }
 
@@ -46,3 +64,60 @@ func (context *Context) GetOkUnsafe(key interface{}) (interface{}, bool) {
 	value, ok := context.data[key]
 	return value, ok
 }
+
+// Parent returns the standard library context this context derives its
+// deadline and cancellation from.
+func (context *Context) Parent() gocontext.Context {
+	context.parentLock.RLock()
+	defer context.parentLock.RUnlock()
+	if context.parent == nil {
+		return gocontext.Background()
+	}
+	return context.parent
+}
+
+// WithTimeout applies a timeout to the context. The returned cancel function
+// should always be called once the work using this context is complete.
+func (context *Context) WithTimeout(timeout time.Duration) gocontext.CancelFunc {
+	parent, cancel := gocontext.WithTimeout(context.Parent(), timeout)
+	context.parentLock.Lock()
+	context.parent = parent
+	context.parentLock.Unlock()
+	return cancel
+}
+
+// WithCancel makes the context cancellable. The returned cancel function
+// should always be called once the work using this context is complete.
+func (context *Context) WithCancel() gocontext.CancelFunc {
+	parent, cancel := gocontext.WithCancel(context.Parent())
+	context.parentLock.Lock()
+	context.parent = parent
+	context.parentLock.Unlock()
+	return cancel
+}
+
+// Deadline implements context.Context and returns the parent's deadline.
+func (context *Context) Deadline() (time.Time, bool) {
+	return context.Parent().Deadline()
+}
+
+// Done implements context.Context and returns a channel that is closed when
+// the context is cancelled or its deadline passes.
+func (context *Context) Done() <-chan struct{} {
+	return context.Parent().Done()
+}
+
+// Err implements context.Context and returns context.Canceled or
+// context.DeadlineExceeded once Done is closed.
+func (context *Context) Err() error {
+	return context.Parent().Err()
+}
+
+// Value implements context.Context. Values set on this context take
+// precedence over values found on the parent.
+func (context *Context) Value(key interface{}) interface{} {
+	if value, ok := context.GetOk(key); ok {
+		return value
+	}
+	return context.Parent().Value(key)
+}
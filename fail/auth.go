@@ -1,6 +1,7 @@
 package fail
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -9,6 +10,9 @@ import (
 // AuthenticationError represents a failure to authenticate.
 type AuthenticationError struct {
 	Err
+	// Challenge is returned in the WWW-Authenticate header, describing how the
+	// client should authenticate, e.g. `Bearer realm="api"`.
+	Challenge string
 }
 
 // NewAuthError returns a new AuthenticationError to wrap the supplied error.
@@ -22,6 +26,11 @@ func NewAuthError(code int, parts ...string) AuthenticationError {
 		description = parts[1]
 	}
 
+	// Fall back to the catalogued description for the code.
+	if description == "" {
+		description = codeDescription(code)
+	}
+
 	// Map our custom auth error code.
 	internalErrCode := map[string]string{
 		"error_code": strconv.Itoa(code),
@@ -42,3 +51,21 @@ func NewAuthError(code int, parts ...string) AuthenticationError {
 func (err AuthenticationError) StatusCode() int {
 	return http.StatusUnauthorized
 }
+
+// ErrAuthentication can be used with errors.Is to check for an
+// AuthenticationError anywhere in an error chain.
+var ErrAuthentication = errors.New("authentication failed")
+
+// Is implements errors.Is, matching ErrAuthentication.
+func (err AuthenticationError) Is(target error) bool {
+	return target == ErrAuthentication
+}
+
+// ErrorHeaders implements the `vc.HeaderError` interface, returning the
+// WWW-Authenticate challenge if there is one.
+func (err AuthenticationError) ErrorHeaders() map[string]string {
+	if err.Challenge == "" {
+		return nil
+	}
+	return map[string]string{"WWW-Authenticate": err.Challenge}
+}
@@ -0,0 +1,178 @@
+package fail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrorCode is an entry in the error code catalog. Codes are stable, so
+// clients can rely on them to identify an error without parsing its message.
+type ErrorCode struct {
+	Code int `json:"code"`
+	// Name is a short, unique identifier for the code, e.g. "missing_token".
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	// Description is the default description of errors with this code.
+	Description string `json:"description,omitempty"`
+	// DocsURL links to documentation about the error and how to resolve it.
+	DocsURL string `json:"docs_url,omitempty"`
+}
+
+// Codes from ReservedCodeMin to ReservedCodeMax are reserved for the packages
+// of this module, such as auth and vc, which register their codes when they
+// are imported. Applications must register codes outside of the range, so
+// they never conflict.
+const (
+	ReservedCodeMin = 1000
+	ReservedCodeMax = 2999
+)
+
+var (
+	catalog     = map[int]ErrorCode{}
+	catalogLock sync.RWMutex
+)
+
+// modulePath is the import path of this module, e.g. github.com/snikch/api/,
+// found from this package's path so it's still correct when vendored.
+var modulePath = strings.TrimSuffix(reflect.TypeOf(ErrorCode{}).PkgPath(), "fail")
+
+// RegisterCode adds an entry to the error code catalog, returning it so it can
+// be assigned to a variable. This should be called during setup, and panics if
+// the code has already been registered differently, as codes must be unique.
+// It also panics if a code from ReservedCodeMin to ReservedCodeMax is
+// registered from outside this module.
+func RegisterCode(entry ErrorCode) ErrorCode {
+	if entry.Code >= ReservedCodeMin && entry.Code <= ReservedCodeMax {
+		pc, _, _, _ := runtime.Caller(1)
+		if caller := runtime.FuncForPC(pc); caller == nil || !inModule(caller.Name()) {
+			panic(fmt.Sprintf("fail: error code %d is reserved, use a code below %d or above %d", entry.Code, ReservedCodeMin, ReservedCodeMax))
+		}
+	}
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	if existing, ok := catalog[entry.Code]; ok && existing != entry {
+		panic(fmt.Sprintf("fail: error code %d is already registered as %s", entry.Code, existing.Name))
+	}
+	catalog[entry.Code] = entry
+	return entry
+}
+
+// inModule returns true if the fully qualified function name belongs to one of
+// this module's packages.
+func inModule(function string) bool {
+	return strings.HasPrefix(function, modulePath)
+}
+
+// LookupCode returns the catalog entry for a code.
+func LookupCode(code int) (ErrorCode, bool) {
+	catalogLock.RLock()
+	defer catalogLock.RUnlock()
+	entry, ok := catalog[code]
+	return entry, ok
+}
+
+// Codes returns every registered catalog entry, sorted by code.
+func Codes() []ErrorCode {
+	catalogLock.RLock()
+	defer catalogLock.RUnlock()
+	entries := make([]ErrorCode, 0, len(catalog))
+	for _, entry := range catalog {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Code < entries[j].Code
+	})
+	return entries
+}
+
+// WriteCodes writes every registered catalog entry as an indented json array,
+// which can be used to generate client SDKs.
+func WriteCodes(w io.Writer) error {
+	body, err := json.MarshalIndent(Codes(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
+// New returns the fail error for the entry's status, wrapping the supplied
+// error, with the entry's code and description.
+func (entry ErrorCode) New(err error) error {
+	base := Err{
+		Code:          entry.Code,
+		OriginalError: err,
+		Description:   entry.Description,
+	}
+	switch entry.Status {
+	case http.StatusBadRequest:
+		return BadRequestError{Err: base}
+	case http.StatusUnauthorized:
+		return AuthenticationError{Err: base}
+	case http.StatusForbidden:
+		return PermissionsError{Err: base}
+	case http.StatusNotFound:
+		return NotFoundError{Err: base}
+	case http.StatusNotAcceptable:
+		return NotAcceptableError{Err: base}
+	case http.StatusConflict:
+		return ConflictError{Err: base}
+	case http.StatusPreconditionFailed:
+		return PreconditionFailedError{Err: base}
+	case http.StatusPreconditionRequired:
+		return PreconditionRequiredError{Err: base}
+	case http.StatusRequestEntityTooLarge:
+		return PayloadTooLargeError{Err: base}
+	case ValidationErrorStatusCode:
+		return ValidationError{Err: base}
+	case http.StatusTooManyRequests:
+		return TooManyRequestsError{Err: base}
+	case http.StatusServiceUnavailable:
+		return ServiceUnavailable{Err: base}
+	case http.StatusGatewayTimeout:
+		return TimeoutError{Err: base}
+	}
+	return CatalogError{Err: base, Status: entry.Status}
+}
+
+// Errorf returns the fail error for the entry, with a formatted message.
+func (entry ErrorCode) Errorf(format string, args ...interface{}) error {
+	return entry.New(fmt.Errorf(format, args...))
+}
+
+// NewCodedError returns the fail error for a registered code, wrapping the
+// supplied error. Unregistered codes are a programming error, and return a
+// private error so they aren't exposed.
+func NewCodedError(code int, err error) error {
+	entry, ok := LookupCode(code)
+	if !ok {
+		return NewPrivate(fmt.Errorf("fail: unregistered error code %d: %s", code, err))
+	}
+	return entry.New(err)
+}
+
+// CatalogError is a catalogued error with a status that has no specific fail
+// error type.
+type CatalogError struct {
+	Err
+	Status int
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err CatalogError) StatusCode() int {
+	return err.Status
+}
+
+// codeDescription returns the description registered for a code, which is used
+// when a constructor isn't given one.
+func codeDescription(code int) string {
+	entry, _ := LookupCode(code)
+	return entry.Description
+}
@@ -0,0 +1,23 @@
+package fail
+
+import "testing"
+
+func TestReservedCodes(t *testing.T) {
+	for function, expected := range map[string]bool{
+		"github.com/snikch/api/auth.init.0":      true,
+		"github.com/snikch/api/vc.init.0":        true,
+		"github.com/example/app.init.0":          false,
+		"github.com/snikch/apiextra/errors.init": false,
+	} {
+		if inModule(function) != expected {
+			t.Errorf("Expected %s being in the module to be %t", function, expected)
+		}
+	}
+
+	defer func() {
+		if recover() != nil {
+			t.Errorf("Expected a module package to register a reserved code")
+		}
+	}()
+	RegisterCode(ErrorCode{Code: ReservedCodeMax, Name: "reserved_test", Status: 400})
+}
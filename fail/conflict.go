@@ -0,0 +1,35 @@
+package fail
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ConflictError represents a request that conflicts with the current state of
+// the server, such as one that is already being processed.
+type ConflictError struct {
+	Err
+}
+
+// NewConflictError returns a new ConflictError to wrap the supplied error.
+func NewConflictError(err error) ConflictError {
+	return ConflictError{
+		Err: Err{
+			OriginalError: err,
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err ConflictError) StatusCode() int {
+	return http.StatusConflict
+}
+
+// ErrConflict can be used with errors.Is to check for a ConflictError anywhere
+// in an error chain.
+var ErrConflict = errors.New("conflict")
+
+// Is implements errors.Is, matching ErrConflict.
+func (err ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
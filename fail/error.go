@@ -14,6 +14,12 @@ func (err Err) Error() string {
 	return err.OriginalError.Error()
 }
 
+// Unwrap returns the original error, so errors it wraps can be found with
+// errors.Is and errors.As.
+func (err Err) Unwrap() error {
+	return err.OriginalError
+}
+
 // ErrorCode implements the `vc.ErrorCode` interface.
 func (err Err) ErrorCode() int {
 	return err.Code
@@ -0,0 +1,194 @@
+package fail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FieldError is a single problem with a field. A field can have several.
+type FieldError struct {
+	// Path is a JSON pointer to the field, e.g. "/items/0/name".
+	Path string `json:"path"`
+	// Code is a machine readable identifier for the problem, e.g. "required".
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is a list of problems with fields, in the order they were found.
+type FieldErrors []FieldError
+
+// Add appends a problem with the field at the path.
+func (fieldErrors *FieldErrors) Add(path, code, message string) {
+	*fieldErrors = append(*fieldErrors, FieldError{Path: path, Code: code, Message: message})
+}
+
+// ForPath returns the problems with the field at the path.
+func (fieldErrors FieldErrors) ForPath(path string) FieldErrors {
+	matching := FieldErrors{}
+	for _, fieldError := range fieldErrors {
+		if fieldError.Path == path {
+			matching = append(matching, fieldError)
+		}
+	}
+	return matching
+}
+
+// Fields flattens the problems to a map of field names to messages, as used
+// by ErrorFields. Paths are written with dots, e.g. "items.0.name", and the
+// messages for a field are joined.
+func (fieldErrors FieldErrors) Fields() map[string]string {
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+	fields := map[string]string{}
+	for _, fieldError := range fieldErrors {
+		name := strings.Join(splitFieldPath(fieldError.Path), ".")
+		if existing, ok := fields[name]; ok {
+			fields[name] = existing + "; " + fieldError.Message
+			continue
+		}
+		fields[name] = fieldError.Message
+	}
+	return fields
+}
+
+// FieldPath builds a JSON pointer from field names and array indexes, e.g.
+// FieldPath("items", 0, "name") returns "/items/0/name".
+func FieldPath(parts ...interface{}) string {
+	path := ""
+	for _, part := range parts {
+		token := fmt.Sprint(part)
+		token = strings.Replace(token, "~", "~0", -1)
+		token = strings.Replace(token, "/", "~1", -1)
+		path += "/" + token
+	}
+	return path
+}
+
+// splitFieldPath splits a JSON pointer into its unescaped tokens. Paths that
+// aren't pointers are treated as a dotted field name, as used by ErrorFields.
+func splitFieldPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return strings.Split(path, ".")
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens
+}
+
+// MultiError is a validation error aggregating every problem found with the
+// fields of a request, which may come from several validators.
+type MultiError struct {
+	Err
+	Errors FieldErrors
+}
+
+// NewMultiError returns a new MultiError to wrap the supplied error, which
+// summarises the problems added to it.
+func NewMultiError(err error) MultiError {
+	return MultiError{
+		Err: Err{
+			OriginalError: err,
+		},
+	}
+}
+
+// Error implements the error interface, returning the message of the wrapped
+// error, or if there isn't one, such as for the zero value, a summary of the
+// problems.
+func (err MultiError) Error() string {
+	if err.OriginalError != nil {
+		return err.OriginalError.Error()
+	}
+	if len(err.Errors) == 0 {
+		return "Invalid data supplied"
+	}
+	problems := make([]string, len(err.Errors))
+	for i, fieldError := range err.Errors {
+		problems[i] = fieldError.Path + ": " + fieldError.Message
+	}
+	return "Invalid data supplied: " + strings.Join(problems, ", ")
+}
+
+// Add adds a problem with the field at the path.
+func (err *MultiError) Add(path, code, message string) {
+	err.Errors.Add(path, code, message)
+}
+
+// Merge adds the problems from another error. A MultiError's problems are
+// added as they are, along with any fields added with WithField, and the
+// fields of any other error implementing ErrorFields are added by name. Other
+// errors are ignored.
+func (err *MultiError) Merge(other error) {
+	var multiErr *MultiError
+	if !errors.As(other, &multiErr) || multiErr == nil {
+		var multiValue MultiError
+		if errors.As(other, &multiValue) {
+			multiErr = &multiValue
+		}
+	}
+	if multiErr != nil {
+		err.Errors = append(err.Errors, multiErr.Errors...)
+		if len(multiErr.AdditionalFields) > 0 {
+			err.WithFields(multiErr.AdditionalFields)
+		}
+		return
+	}
+	var annotated interface {
+		ErrorFields() map[string]string
+	}
+	if !errors.As(other, &annotated) {
+		return
+	}
+	for name, message := range annotated.ErrorFields() {
+		parts := []interface{}{}
+		for _, part := range splitFieldPath(name) {
+			parts = append(parts, part)
+		}
+		err.Add(FieldPath(parts...), "", message)
+	}
+}
+
+// ErrorOrNil returns the error if it has any problems, or nil, so it can be
+// returned directly from a validator.
+func (err MultiError) ErrorOrNil() error {
+	if len(err.Errors) == 0 {
+		return nil
+	}
+	return err
+}
+
+// ErrorFields implements `vc.AnnotatedError`, flattening the problems along
+// with any fields added with WithField, for clients that only read fields.
+func (err MultiError) ErrorFields() map[string]string {
+	fields := err.Errors.Fields()
+	if len(err.AdditionalFields) > 0 && fields == nil {
+		fields = map[string]string{}
+	}
+	for key, value := range err.AdditionalFields {
+		fields[key] = value
+	}
+	return fields
+}
+
+// FieldErrors implements `vc.FieldErrorsError`, returning every problem.
+func (err MultiError) FieldErrors() FieldErrors {
+	return err.Errors
+}
+
+// StatusCode implements the `vc.StatusError` interface, with the same status
+// as a ValidationError.
+func (err MultiError) StatusCode() int {
+	return ValidationErrorStatusCode
+}
+
+// Is implements errors.Is, matching ErrValidation.
+func (err MultiError) Is(target error) bool {
+	return target == ErrValidation
+}
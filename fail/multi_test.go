@@ -0,0 +1,70 @@
+package fail
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMultiErrorMerge(t *testing.T) {
+	// Errors from several validators are merged, including a flat validation
+	// error, and each field can have several problems.
+	schemaErr := NewValidationError(errors.New("Invalid thing"))
+	schemaErr.WithField("owner.name", "Required")
+	other := NewMultiError(errors.New("Invalid items"))
+	other.Add(FieldPath("items", 0, "sku"), "required", "Required")
+	pointer := NewMultiError(errors.New("Invalid tags"))
+	pointer.Add(FieldPath("tags", 1), "unique", "Duplicate")
+	pointer.WithField("tags", "Must be unique")
+
+	multiErr := NewMultiError(errors.New("Invalid thing"))
+	multiErr.Add("/name", "too_short", "Too short")
+	multiErr.Add("/name", "format", "Must be letters")
+	multiErr.Merge(schemaErr)
+	multiErr.Merge(fmt.Errorf("items: %w", other))
+	multiErr.Merge(fmt.Errorf("tags: %w", &pointer))
+
+	expected := FieldErrors{
+		{Path: "/name", Code: "too_short", Message: "Too short"},
+		{Path: "/name", Code: "format", Message: "Must be letters"},
+		{Path: "/owner/name", Message: "Required"},
+		{Path: "/items/0/sku", Code: "required", Message: "Required"},
+		{Path: "/tags/1", Code: "unique", Message: "Duplicate"},
+	}
+	if !reflect.DeepEqual(multiErr.FieldErrors(), expected) {
+		t.Errorf("Unexpected field errors %v", multiErr.FieldErrors())
+	}
+	fields := map[string]string{
+		"name":        "Too short; Must be letters",
+		"owner.name":  "Required",
+		"items.0.sku": "Required",
+		"tags.1":      "Duplicate",
+		"tags":        "Must be unique",
+	}
+	if !reflect.DeepEqual(multiErr.ErrorFields(), fields) {
+		t.Errorf("Unexpected fields %v", multiErr.ErrorFields())
+	}
+	if !errors.Is(multiErr, ErrValidation) || len(multiErr.Errors.ForPath("/name")) != 2 {
+		t.Errorf("Expected a validation error with two problems with the name")
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	if NewMultiError(errors.New("Valid")).ErrorOrNil() != nil {
+		t.Errorf("Expected an empty multi error to be nil")
+	}
+
+	// The zero value can be used without wrapping an error.
+	var zeroErr MultiError
+	zeroErr.Add("/name", "required", "Required")
+	if message := zeroErr.Error(); message != "Invalid data supplied: /name: Required" {
+		t.Errorf("Unexpected message %q", message)
+	}
+	if zeroErr.ErrorOrNil() == nil {
+		t.Errorf("Expected a multi error with a problem not to be nil")
+	}
+	if path := FieldPath("a/b", "c~d"); path != "/a~1b/c~0d" {
+		t.Errorf("Expected the path to be escaped, got %s", path)
+	}
+}
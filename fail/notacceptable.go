@@ -0,0 +1,35 @@
+package fail
+
+import (
+	"errors"
+	"net/http"
+)
+
+// NotAcceptableError represents a request for a representation that the api
+// is unable to produce.
+type NotAcceptableError struct {
+	Err
+}
+
+// NewNotAcceptableError returns a new NotAcceptableError to wrap the supplied error.
+func NewNotAcceptableError(err error) NotAcceptableError {
+	return NotAcceptableError{
+		Err: Err{
+			OriginalError: err,
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err NotAcceptableError) StatusCode() int {
+	return http.StatusNotAcceptable
+}
+
+// ErrNotAcceptable can be used with errors.Is to check for a NotAcceptableError
+// anywhere in an error chain.
+var ErrNotAcceptable = errors.New("not acceptable")
+
+// Is implements errors.Is, matching ErrNotAcceptable.
+func (err NotAcceptableError) Is(target error) bool {
+	return target == ErrNotAcceptable
+}
@@ -1,6 +1,9 @@
 package fail
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
 // NotFoundError represents a resource not found.
 type NotFoundError struct {
@@ -20,3 +23,12 @@ func NewNotFoundError(err error) NotFoundError {
 func (err NotFoundError) StatusCode() int {
 	return http.StatusNotFound
 }
+
+// ErrNotFound can be used with errors.Is to check for a NotFoundError anywhere
+// in an error chain.
+var ErrNotFound = errors.New("not found")
+
+// Is implements errors.Is, matching ErrNotFound.
+func (err NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
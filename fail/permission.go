@@ -1,6 +1,7 @@
 package fail
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -24,6 +25,11 @@ func NewPermissionsError(code int, parts ...string) PermissionsError {
 		description = parts[1]
 	}
 
+	// Fall back to the catalogued description for the code.
+	if description == "" {
+		description = codeDescription(code)
+	}
+
 	// Map our custom permission error code.
 	internalErrCode := map[string]string{
 		"error_code": strconv.Itoa(code),
@@ -43,3 +49,12 @@ func NewPermissionsError(code int, parts ...string) PermissionsError {
 func (err PermissionsError) StatusCode() int {
 	return http.StatusForbidden
 }
+
+// ErrPermission can be used with errors.Is to check for a PermissionsError
+// anywhere in an error chain.
+var ErrPermission = errors.New("permission denied")
+
+// Is implements errors.Is, matching ErrPermission.
+func (err PermissionsError) Is(target error) bool {
+	return target == ErrPermission
+}
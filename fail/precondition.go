@@ -0,0 +1,68 @@
+package fail
+
+import (
+	"errors"
+	"net/http"
+)
+
+// PreconditionFailedError represents a mutation of an entity that has changed
+// since the client last retrieved it.
+type PreconditionFailedError struct {
+	Err
+}
+
+// NewPreconditionFailedError returns a new PreconditionFailedError to wrap the
+// supplied error.
+func NewPreconditionFailedError(err error) PreconditionFailedError {
+	return PreconditionFailedError{
+		Err: Err{
+			OriginalError: err,
+			Description:   "The entity has been changed since you last retrieved it. Retrieve it again, reapply your changes, and try again.",
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err PreconditionFailedError) StatusCode() int {
+	return http.StatusPreconditionFailed
+}
+
+// ErrPreconditionFailed can be used with errors.Is to check for a
+// PreconditionFailedError anywhere in an error chain.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Is implements errors.Is, matching ErrPreconditionFailed.
+func (err PreconditionFailedError) Is(target error) bool {
+	return target == ErrPreconditionFailed
+}
+
+// PreconditionRequiredError represents a mutation that was attempted without
+// stating which version of the entity it applies to.
+type PreconditionRequiredError struct {
+	Err
+}
+
+// NewPreconditionRequiredError returns a new PreconditionRequiredError to wrap
+// the supplied error.
+func NewPreconditionRequiredError(err error) PreconditionRequiredError {
+	return PreconditionRequiredError{
+		Err: Err{
+			OriginalError: err,
+			Description:   "Changes to this entity require an If-Match header containing the ETag it was last retrieved with, so that nobody else’s changes are lost.",
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err PreconditionRequiredError) StatusCode() int {
+	return http.StatusPreconditionRequired
+}
+
+// ErrPreconditionRequired can be used with errors.Is to check for a
+// PreconditionRequiredError anywhere in an error chain.
+var ErrPreconditionRequired = errors.New("precondition required")
+
+// Is implements errors.Is, matching ErrPreconditionRequired.
+func (err PreconditionRequiredError) Is(target error) bool {
+	return target == ErrPreconditionRequired
+}
@@ -2,6 +2,7 @@ package fail
 
 import (
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -33,6 +34,19 @@ func NewPrivate(err error) *Private {
 	}
 }
 
+// NewPanicError returns a private error for a value recovered from a panic,
+// traced from the point of the panic so the stack is logged along with it.
+// Goroutines started while handling a request should recover with it, and
+// return the error, as a panic outside the handler's goroutine can't be
+// recovered by the handler and crashes the process.
+func NewPanicError(recovered interface{}) *Private {
+	err, ok := recovered.(error)
+	if !ok {
+		err = fmt.Errorf("%v", recovered)
+	}
+	return NewPrivate(Trace(fmt.Errorf("panic: %s", err)))
+}
+
 // WithMessage is a chainable method to set the public message.
 func (private *Private) WithMessage(message string) *Private {
 	private.PublicMessage = message
@@ -63,3 +77,18 @@ func (private Private) LogFields() map[string]string {
 		"original_error": private.OriginalErr.Error(),
 	}
 }
+
+// Unwrap returns the original error, so it can be found with errors.Is and
+// errors.As. The private error still masks it in error responses.
+func (private Private) Unwrap() error {
+	return private.OriginalErr
+}
+
+// ErrPrivate can be used with errors.Is to check for a Private error anywhere
+// in an error chain.
+var ErrPrivate = errors.New("private error")
+
+// Is implements errors.Is, matching ErrPrivate.
+func (private Private) Is(target error) bool {
+	return target == ErrPrivate
+}
@@ -0,0 +1,37 @@
+package fail
+
+import (
+	"errors"
+	"net/http"
+)
+
+// TooManyRequestsError represents a request that exceeds a rate limit or
+// quota.
+type TooManyRequestsError struct {
+	Err
+}
+
+// NewTooManyRequestsError returns a new TooManyRequestsError to wrap the
+// supplied error.
+func NewTooManyRequestsError(err error) TooManyRequestsError {
+	return TooManyRequestsError{
+		Err: Err{
+			OriginalError: err,
+			Description:   "You’ve made too many requests in a short time. Wait until the time in the Retry-After header has passed, then try again.",
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err TooManyRequestsError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// ErrTooManyRequests can be used with errors.Is to check for a
+// TooManyRequestsError anywhere in an error chain.
+var ErrTooManyRequests = errors.New("too many requests")
+
+// Is implements errors.Is, matching ErrTooManyRequests.
+func (err TooManyRequestsError) Is(target error) bool {
+	return target == ErrTooManyRequests
+}
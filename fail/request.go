@@ -1,6 +1,9 @@
 package fail
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
 // BadRequestError represents a bad request error.
 type BadRequestError struct {
@@ -20,3 +23,12 @@ func NewBadRequestError(err error) BadRequestError {
 func (err BadRequestError) StatusCode() int {
 	return http.StatusBadRequest
 }
+
+// ErrBadRequest can be used with errors.Is to check for a BadRequestError
+// anywhere in an error chain.
+var ErrBadRequest = errors.New("bad request")
+
+// Is implements errors.Is, matching ErrBadRequest.
+func (err BadRequestError) Is(target error) bool {
+	return target == ErrBadRequest
+}
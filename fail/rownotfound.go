@@ -2,6 +2,7 @@ package fail
 
 import (
 	"database/sql"
+	"errors"
 	"net/http"
 )
 
@@ -10,11 +11,11 @@ type PossibleRowNotFoundError struct {
 	Err
 }
 
-// NewPossibleRowNotFoundError determines if err matches sql.ErrNoRows and
-// returns the err wrapped in a NotFoundError, otherwise the err returned
-// as normal.
+// NewPossibleRowNotFoundError determines if err matches sql.ErrNoRows, anywhere
+// in its chain, and returns the err wrapped in a NotFoundError, otherwise the
+// err returned as normal.
 func NewPossibleRowNotFoundError(err error) error {
-	if err == sql.ErrNoRows {
+	if errors.Is(err, sql.ErrNoRows) {
 		return NotFoundError{
 			Err: Err{
 				OriginalError: err,
@@ -29,3 +30,8 @@ func NewPossibleRowNotFoundError(err error) error {
 func (err PossibleRowNotFoundError) StatusCode() int {
 	return http.StatusNotFound
 }
+
+// Is implements errors.Is, matching ErrNotFound.
+func (err PossibleRowNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
@@ -1,6 +1,9 @@
 package fail
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
 // ServiceUnavailable represents a service unavailable error.
 type ServiceUnavailable struct {
@@ -20,3 +23,12 @@ func NewServiceUnavailableError(err error) ServiceUnavailable {
 func (err ServiceUnavailable) StatusCode() int {
 	return http.StatusServiceUnavailable
 }
+
+// ErrServiceUnavailable can be used with errors.Is to check for a
+// ServiceUnavailable error anywhere in an error chain.
+var ErrServiceUnavailable = errors.New("service unavailable")
+
+// Is implements errors.Is, matching ErrServiceUnavailable.
+func (err ServiceUnavailable) Is(target error) bool {
+	return target == ErrServiceUnavailable
+}
@@ -0,0 +1,37 @@
+package fail
+
+import (
+	"errors"
+	"net/http"
+)
+
+// TimeoutError represents a request that was cancelled, or ran past its
+// deadline, before it could complete.
+type TimeoutError struct {
+	Err
+}
+
+// NewTimeoutError returns a new TimeoutError to wrap the supplied error,
+// which is generally the result of calling Err() on a cancelled context.
+func NewTimeoutError(err error) TimeoutError {
+	return TimeoutError{
+		Err: Err{
+			OriginalError: err,
+			Description:   "The request took too long to complete and was cancelled",
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err TimeoutError) StatusCode() int {
+	return http.StatusGatewayTimeout
+}
+
+// ErrTimeout can be used with errors.Is to check for a TimeoutError anywhere in
+// an error chain.
+var ErrTimeout = errors.New("timeout")
+
+// Is implements errors.Is, matching ErrTimeout.
+func (err TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
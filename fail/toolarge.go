@@ -0,0 +1,36 @@
+package fail
+
+import (
+	"errors"
+	"net/http"
+)
+
+// PayloadTooLargeError represents a request body that is larger than the api
+// will accept.
+type PayloadTooLargeError struct {
+	Err
+}
+
+// NewPayloadTooLargeError returns a new PayloadTooLargeError to wrap the
+// supplied error.
+func NewPayloadTooLargeError(err error) PayloadTooLargeError {
+	return PayloadTooLargeError{
+		Err: Err{
+			OriginalError: err,
+		},
+	}
+}
+
+// StatusCode implements the `vc.StatusError` interface.
+func (err PayloadTooLargeError) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+// ErrPayloadTooLarge can be used with errors.Is to check for a
+// PayloadTooLargeError anywhere in an error chain.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// Is implements errors.Is, matching ErrPayloadTooLarge.
+func (err PayloadTooLargeError) Is(target error) bool {
+	return target == ErrPayloadTooLarge
+}
@@ -92,6 +92,12 @@ func (err *StackTraceError) Error() string {
 	return buffer.String()
 }
 
+// Unwrap returns the traced error, so it can be found with errors.Is and
+// errors.As.
+func (err *StackTraceError) Unwrap() error {
+	return err.error
+}
+
 // Stack returns the callstack formatted the same way that go does
 // in runtime/debug.Stack()
 func (err StackTraceError) Stack() []byte {
@@ -1,5 +1,7 @@
 package fail
 
+import "errors"
+
 // ValidationErrorStatusCode represents the HTTP status code for ValidationError.
 var ValidationErrorStatusCode = 422
 
@@ -22,3 +24,12 @@ func NewValidationError(err error) ValidationError {
 func (err ValidationError) StatusCode() int {
 	return ValidationErrorStatusCode
 }
+
+// ErrValidation can be used with errors.Is to check for a ValidationError
+// anywhere in an error chain.
+var ErrValidation = errors.New("validation failed")
+
+// Is implements errors.Is, matching ErrValidation.
+func (err ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
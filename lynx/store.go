@@ -4,6 +4,7 @@ import (
 	"errors"
 
 	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
 )
 
 type contextKey int
@@ -42,7 +43,9 @@ func (store *Store) Save(items ...Lockable) {
 	store.Items = append(store.Items, items...)
 }
 
-// KeyHandler is the function that returns an unlock key for a context.
+// KeyHandler is the function that returns an unlock key for a context. The
+// context implements context.Context, and any remote key lookups should honour
+// its deadline and cancellation.
 var KeyHandler func(*ctx.Context) ([]byte, error)
 
 // ErrNoKeyHandler is returned when attempting to find a key with no handler set.
@@ -63,14 +66,20 @@ func (store *Store) Unlock() error {
 		return nil
 	}
 
+	// Don't start unlocking if the context has already been cancelled.
+	if err := store.Context.Err(); err != nil {
+		return fail.NewTimeoutError(err)
+	}
+
 	// Get the unlock key for this context.
 	key, err := ContextKey(store.Context)
 	if err != nil {
 		return err
 	}
-	// Create required variables and start the unlock process.
+	// Create required variables and start the unlock process. The channel is
+	// buffered so unlocks finishing after a cancellation don't block forever.
 	var firstErr error
-	ch := make(chan error)
+	ch := make(chan error, len(store.Items))
 	for i := range store.Items {
 		go store.unlockIndex(ch, i, key)
 	}
@@ -78,17 +87,28 @@ func (store *Store) Unlock() error {
 	// While it may not be true for some users, we're assuming nobody has added to
 	// store.Items between loops.
 	for _ = range store.Items {
-		err := <-ch
-		if err != nil && firstErr == nil {
-			firstErr = err
+		select {
+		case err := <-ch:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-store.Context.Done():
+			return fail.NewTimeoutError(store.Context.Err())
 		}
 	}
 	return firstErr
 }
 
-// unlockIndex will unlock a single item at the supplied index with any error
-// being returned on the supplied error channel.
+// unlockIndex will unlock a single item at the supplied index with any error,
+// including a panic, being returned on the supplied error channel.
 func (store *Store) unlockIndex(ch chan error, i int, key []byte) {
+	// A panic here can't be recovered by the request's handler, so it is
+	// returned as an error instead.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ch <- fail.NewPanicError(recovered)
+		}
+	}()
 	// Get the fields and nonce
 	fields := store.Items[i].LockableValues()
 
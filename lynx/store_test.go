@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
 )
 
 type testUnlocker struct {
@@ -104,3 +105,41 @@ func TestMultiError(t *testing.T) {
 		t.Errorf("Unexpected lack of an error")
 	}
 }
+
+func TestUnlockCancelled(t *testing.T) {
+	l1 := &testUnlocker{
+		field1: nonce + payloadBase64Delimiter + string(cypherText),
+		field2: nonce + payloadBase64Delimiter + string(cypherText),
+	}
+
+	context := ctx.NewContext()
+	cancel := context.WithCancel()
+	cancel()
+	store := NewStore(context)
+	store.Save(l1)
+
+	err := store.Unlock()
+	if _, ok := err.(fail.TimeoutError); !ok {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+	if l1.called {
+		t.Errorf("Unexpected unlock of a cancelled store")
+	}
+}
+
+type panickingUnlocker struct {
+	testUnlocker
+}
+
+func (*panickingUnlocker) LockableValues() []*string {
+	panic("boom")
+}
+
+func TestUnlockPanic(t *testing.T) {
+	store := NewStore(ctx.NewContext())
+	store.Save(&panickingUnlocker{})
+
+	if _, ok := store.Unlock().(*fail.Private); !ok {
+		t.Errorf("Expected a panic to be returned as a private error")
+	}
+}
@@ -3,6 +3,7 @@ package render
 import (
 	"encoding/json"
 
+	"github.com/snikch/api/fail"
 	"github.com/snikch/api/vc"
 )
 
@@ -10,6 +11,11 @@ import (
 type JSONRenderer struct {
 }
 
+// ContentType implements the vc.ContentTyper interface.
+func (j JSONRenderer) ContentType() string {
+	return "application/json"
+}
+
 // Render marshals the supplied data to json.
 func (j JSONRenderer) Render(data interface{}) ([]byte, error) {
 	// A possibly unpopular decision, but if the data is nil, return nothing.
@@ -24,6 +30,8 @@ type jsonError struct {
 	Description string            `json:"description,omitempty"`
 	Code        int               `json:"code,omitempty"`
 	Fields      map[string]string `json:"fields,omitempty"`
+	DocsURL     string            `json:"docs_url,omitempty"`
+	Errors      fail.FieldErrors  `json:"errors,omitempty"`
 }
 
 func (j JSONRenderer) RenderError(error vc.APIError) []byte {
@@ -32,6 +40,8 @@ func (j JSONRenderer) RenderError(error vc.APIError) []byte {
 		Description: error.Description,
 		Code:        error.Code,
 		Fields:      error.Fields,
+		DocsURL:     error.DocsURL,
+		Errors:      error.Errors,
 	}, "", "  ")
 	if err != nil {
 		return []byte(err.Error())
@@ -0,0 +1,45 @@
+package render
+
+import (
+	"encoding/json"
+
+	"github.com/snikch/api/vc"
+)
+
+// NDJSONRenderer is a type that implements the vc.Renderer interface for
+// newline delimited json. Registering it allows vc.Stream payloads to be
+// streamed as ndjson, while any other response is rendered as a single line.
+type NDJSONRenderer struct {
+}
+
+// ContentType implements the vc.ContentTyper interface.
+func (n NDJSONRenderer) ContentType() string {
+	return vc.NDJSONMediaType
+}
+
+// Render marshals the supplied data to a single line of json.
+func (n NDJSONRenderer) Render(data interface{}) ([]byte, error) {
+	if data == nil {
+		return nil, nil
+	}
+	marshalled, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(marshalled, '\n'), nil
+}
+
+func (n NDJSONRenderer) RenderError(error vc.APIError) []byte {
+	marshalled, err := json.Marshal(jsonError{
+		Error:       error.Error,
+		Description: error.Description,
+		Code:        error.Code,
+		Fields:      error.Fields,
+		DocsURL:     error.DocsURL,
+		Errors:      error.Errors,
+	})
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return append(marshalled, '\n')
+}
@@ -0,0 +1,345 @@
+/*
+Package report groups and ships errors to sinks, such as a log, a file, or an
+error tracking service.
+
+Errors are fingerprinted by their type and, for errors traced with fail.Trace,
+the functions in their stack, so every occurrence of the same failure is
+grouped together regardless of its message. Untraced errors have no stack to
+tell them apart, so their message is included instead, with any numbers and
+ids replaced so occurrences that only differ by them are grouped. Each
+occurrence is sent to every
+sink along with its group's count, and when it was first and last seen.
+
+	reporter := report.NewReporter(report.LogSink{}, report.NewHTTPSink(url))
+	vc.DefaultErrorReporter = reporter
+
+Events are queued and sent to sinks in the background, so a slow sink never
+holds up the request reporting the error. Flush waits for the queue to be
+sent, such as before the process exits.
+*/
+package report
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/log"
+)
+
+// DefaultMaxGroups is the number of groups a Reporter tracks by default.
+const DefaultMaxGroups = 1000
+
+// DefaultQueueSize is the number of events a Reporter queues for its sinks by
+// default.
+const DefaultQueueSize = 1000
+
+// Occurrence is a single error to be reported.
+type Occurrence struct {
+	Error error `json:"-"`
+	// Fingerprint, Type, Message and Stack are set by the Reporter.
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Message     string `json:"message"`
+	Stack       string `json:"stack,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	// PrivateID is the id of the fail.Private error returned to the client,
+	// which links their error response to this occurrence.
+	PrivateID string `json:"private_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+	ActorType string `json:"actor_type,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	// Panic is true for errors recovered from a panic.
+	Panic bool      `json:"panic,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Group is the summary of every occurrence with the same fingerprint.
+type Group struct {
+	Fingerprint string    `json:"fingerprint"`
+	Type        string    `json:"type"`
+	Message     string    `json:"message"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Event is sent to sinks for each reported occurrence, along with the state
+// of its group.
+type Event struct {
+	Occurrence
+	Group Group `json:"group"`
+}
+
+// Sink ships events somewhere they can be seen.
+type Sink interface {
+	Send(Event) error
+}
+
+// SinkFunc wraps a function with the Send signature to a Sink.
+type SinkFunc func(Event) error
+
+// Send implements the Sink interface and simply calls the function.
+func (fn SinkFunc) Send(event Event) error {
+	return fn(event)
+}
+
+// Reporter groups occurrences and sends them to its sinks. Events are sent to
+// the sinks one at a time from a queue, in the background.
+type Reporter struct {
+	Sinks []Sink
+	// MinStatus is the lowest status code reported. Occurrences without a
+	// status are always reported.
+	MinStatus int
+	// SampleAfter and SampleRate reduce the events sent for noisy groups. Once
+	// a group has SampleAfter occurrences, only one in every SampleRate is
+	// sent. Every occurrence is still counted.
+	SampleAfter int64
+	SampleRate  int64
+	// MaxGroups limits the groups tracked, with the least recently seen
+	// group forgotten to make room for a new one.
+	MaxGroups int
+	// QueueSize limits the events waiting to be sent. Events reported while
+	// the queue is full are dropped, and logged. If zero, DefaultQueueSize is
+	// used. It can't be changed once an event has been reported.
+	QueueSize int
+	// Now returns the current time, and defaults to time.Now.
+	Now    func() time.Time
+	groups map[string]*Group
+	lock   sync.Mutex
+	queue  chan queuedEvent
+	start  sync.Once
+}
+
+// queuedEvent is an event waiting to be sent, or if flushed is set, a marker
+// closed once every event queued before it has been sent.
+type queuedEvent struct {
+	event   Event
+	flushed chan struct{}
+}
+
+// NewReporter returns a Reporter sending server errors to the sinks.
+func NewReporter(sinks ...Sink) *Reporter {
+	return &Reporter{
+		Sinks:     sinks,
+		MinStatus: http.StatusInternalServerError,
+		MaxGroups: DefaultMaxGroups,
+		groups:    map[string]*Group{},
+	}
+}
+
+// Report fingerprints and groups the occurrence, then sends it to every sink
+// unless it has been sampled out.
+func (reporter *Reporter) Report(occurrence Occurrence) {
+	if occurrence.Error == nil || (occurrence.Status != 0 && occurrence.Status < reporter.MinStatus) {
+		return
+	}
+	if occurrence.Time.IsZero() {
+		occurrence.Time = time.Now()
+		if reporter.Now != nil {
+			occurrence.Time = reporter.Now()
+		}
+	}
+	if occurrence.PrivateID == "" {
+		occurrence.PrivateID = PrivateID(occurrence.Error)
+	}
+	occurrence.Fingerprint = Fingerprint(occurrence.Error)
+	occurrence.Type = errorType(occurrence.Error)
+	occurrence.Message = message(occurrence.Error)
+	if traced := stackTrace(occurrence.Error); traced != nil {
+		occurrence.Stack = string(traced.Stack())
+	}
+
+	group, send := reporter.record(occurrence)
+	if !send {
+		return
+	}
+	select {
+	case reporter.events() <- queuedEvent{event: Event{Occurrence: occurrence, Group: group}}:
+	default:
+		log.WithField("fingerprint", occurrence.Fingerprint).Error("Dropped error report as the queue is full")
+	}
+}
+
+// Flush waits until every event reported so far has been sent to the sinks.
+func (reporter *Reporter) Flush() {
+	flushed := make(chan struct{})
+	reporter.events() <- queuedEvent{flushed: flushed}
+	<-flushed
+}
+
+// events returns the queue of events to send, starting the goroutine sending
+// them on first use.
+func (reporter *Reporter) events() chan<- queuedEvent {
+	reporter.start.Do(func() {
+		size := reporter.QueueSize
+		if size <= 0 {
+			size = DefaultQueueSize
+		}
+		reporter.queue = make(chan queuedEvent, size)
+		go reporter.send()
+	})
+	return reporter.queue
+}
+
+// send sends each queued event to every sink.
+func (reporter *Reporter) send() {
+	for queued := range reporter.queue {
+		if queued.flushed != nil {
+			close(queued.flushed)
+			continue
+		}
+		for _, sink := range reporter.Sinks {
+			if err := sink.Send(queued.event); err != nil {
+				log.WithError(err).WithField("fingerprint", queued.event.Fingerprint).Error("Could not send error report")
+			}
+		}
+	}
+}
+
+// record adds the occurrence to its group, returning a copy of the group and
+// whether the occurrence should be sent.
+func (reporter *Reporter) record(occurrence Occurrence) (Group, bool) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	if reporter.groups == nil {
+		reporter.groups = map[string]*Group{}
+	}
+	group, ok := reporter.groups[occurrence.Fingerprint]
+	if !ok {
+		reporter.evict()
+		group = &Group{
+			Fingerprint: occurrence.Fingerprint,
+			Type:        occurrence.Type,
+			Message:     occurrence.Message,
+			FirstSeen:   occurrence.Time,
+		}
+		reporter.groups[occurrence.Fingerprint] = group
+	}
+	group.Count++
+	group.LastSeen = occurrence.Time
+
+	send := true
+	if reporter.SampleRate > 1 && group.Count > reporter.SampleAfter {
+		send = (group.Count-reporter.SampleAfter)%reporter.SampleRate == 1
+	}
+	return *group, send
+}
+
+// evict forgets the least recently seen group if the reporter is tracking
+// MaxGroups groups.
+func (reporter *Reporter) evict() {
+	if reporter.MaxGroups <= 0 || len(reporter.groups) < reporter.MaxGroups {
+		return
+	}
+	var oldest *Group
+	for _, group := range reporter.groups {
+		if oldest == nil || group.LastSeen.Before(oldest.LastSeen) {
+			oldest = group
+		}
+	}
+	delete(reporter.groups, oldest.Fingerprint)
+}
+
+// Groups returns a copy of every group being tracked.
+func (reporter *Reporter) Groups() []Group {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	groups := make([]Group, 0, len(reporter.groups))
+	for _, group := range reporter.groups {
+		groups = append(groups, *group)
+	}
+	return groups
+}
+
+// Fingerprint identifies the failure an error represents by its type, and the
+// functions in its stack if it has been traced, or otherwise its normalised
+// message. Line numbers aren't included, so a group survives unrelated changes
+// to the same file.
+func Fingerprint(err error) string {
+	hash := sha1.New()
+	io.WriteString(hash, errorType(err))
+	if traced := stackTrace(err); traced != nil {
+		for _, frame := range traced.StackFrames() {
+			io.WriteString(hash, "\n"+frame.Package+"."+frame.Name)
+		}
+	} else {
+		io.WriteString(hash, "\n"+normalise(message(err)))
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))[:16]
+}
+
+// variablePattern matches the parts of a message that vary between
+// occurrences of the same failure, i.e. numbers, and hex ids such as uuids.
+var variablePattern = regexp.MustCompile(`[0-9a-fA-F]*[0-9][0-9a-fA-F]*`)
+
+// normalise replaces the numbers and ids in a message.
+func normalise(message string) string {
+	return variablePattern.ReplaceAllString(message, "#")
+}
+
+// PrivateID returns the tracking id of a fail.Private error, or an empty
+// string for any other error.
+func PrivateID(err error) string {
+	switch private := err.(type) {
+	case *fail.Private:
+		return private.ID
+	case fail.Private:
+		return private.ID
+	}
+	return ""
+}
+
+// unwrapPrivate returns the error a fail.Private is masking, as the private
+// error's own type is the same for every failure.
+func unwrapPrivate(err error) error {
+	for {
+		var original error
+		switch private := err.(type) {
+		case *fail.Private:
+			original = private.OriginalErr
+		case fail.Private:
+			original = private.OriginalErr
+		}
+		if original == nil {
+			return err
+		}
+		err = original
+	}
+}
+
+// stackTrace returns the first traced error in the error's chain, if any.
+func stackTrace(err error) *fail.StackTraceError {
+	var traced *fail.StackTraceError
+	errors.As(err, &traced)
+	return traced
+}
+
+// describedError returns the error whose type and message describe the
+// error, which is the original error of a private or traced error.
+func describedError(err error) error {
+	err = unwrapPrivate(err)
+	if traced, ok := err.(*fail.StackTraceError); ok && traced.Unwrap() != nil {
+		return traced.Unwrap()
+	}
+	return err
+}
+
+// errorType returns the type name of the error.
+func errorType(err error) string {
+	return fmt.Sprintf("%T", describedError(err))
+}
+
+// message returns the first line of the error's message.
+func message(err error) string {
+	return strings.SplitN(describedError(err).Error(), "\n", 2)[0]
+}
@@ -0,0 +1,156 @@
+package report_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/report"
+	"github.com/snikch/api/report/reporttest"
+)
+
+// traced returns an error traced from the same place on every call.
+func traced(message string) error {
+	return fail.Trace(errors.New(message))
+}
+
+func TestFingerprint(t *testing.T) {
+	first := report.Fingerprint(traced("first"))
+	if first != report.Fingerprint(traced("second")) {
+		t.Errorf("Expected errors traced from the same place to share a fingerprint")
+	}
+	if first == report.Fingerprint(fail.Trace(errors.New("first"))) {
+		t.Errorf("Expected errors traced from elsewhere to have a different fingerprint")
+	}
+	if first != report.Fingerprint(fail.NewPrivate(traced("private"))) {
+		t.Errorf("Expected private errors to be fingerprinted by their original error")
+	}
+	if report.Fingerprint(errors.New("a")) == report.Fingerprint(errors.New("b")) {
+		t.Errorf("Expected untraced errors to be fingerprinted by their message")
+	}
+	if report.Fingerprint(errors.New("user 42 not found in 123e4567-e89b-12d3-a456-426614174000")) != report.Fingerprint(errors.New("user 7 not found in 9f0c2b1e-0d4c-4e8e-9a57-3b2c1d0e9f8a")) {
+		t.Errorf("Expected numbers and ids not to change the fingerprint of untraced errors")
+	}
+	if report.Fingerprint(errors.New("a")) == report.Fingerprint(fail.NewNotFoundError(errors.New("a"))) {
+		t.Errorf("Expected errors of different types to have different fingerprints")
+	}
+}
+
+func TestReporter(t *testing.T) {
+	sink := &reporttest.Sink{}
+	reporter := report.NewReporter(sink)
+	reporter.SampleAfter = 2
+	reporter.SampleRate = 3
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	reporter.Now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for i := 0; i < 5; i++ {
+		private := fail.NewPrivate(traced("broken"))
+		reporter.Report(report.Occurrence{Error: private, Status: 500, RequestID: "req", ActorID: "u1"})
+	}
+	reporter.Report(report.Occurrence{Error: fail.NewNotFoundError(errors.New("missing")), Status: 404})
+	reporter.Flush()
+
+	// The first two are sent, then one in every three after that.
+	events := sink.Events()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events to be sent, got %d", len(events))
+	}
+	last := events[2]
+	if last.Group.Count != 3 || last.Group.FirstSeen.Equal(last.Group.LastSeen) {
+		t.Errorf("Unexpected group %+v", last.Group)
+	}
+	if last.PrivateID == "" || last.RequestID != "req" || last.ActorID != "u1" || last.Message != "broken" {
+		t.Errorf("Unexpected occurrence %+v", last.Occurrence)
+	}
+	if !strings.Contains(last.Stack, "report_test.go") {
+		t.Errorf("Expected the stack to be reported, got %s", last.Stack)
+	}
+
+	groups := reporter.Groups()
+	if len(groups) != 1 || groups[0].Count != 5 {
+		t.Errorf("Expected client errors to be ignored and every occurrence counted, got %+v", groups)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	server := reporttest.NewServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileSink, err := report.NewFileSink(filepath.Join(dir, "errors.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := report.NewReporter(report.NewHTTPSink(server.URL), fileSink)
+
+	reporter.Report(report.Occurrence{Error: errors.New("failed 1"), Status: 500})
+	reporter.Report(report.Occurrence{Error: errors.New("failed 2"), Panic: true})
+	reporter.Flush()
+	fileSink.Close()
+
+	events := server.Events()
+	if len(events) != 2 || events[1].Group.Count != 2 || !events[1].Panic || events[1].Fingerprint == "" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "errors.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"message":"failed 1"`) {
+		t.Errorf("Unexpected file contents %s", contents)
+	}
+
+	server.Status = 500
+	if err := report.NewHTTPSink(server.URL).Send(report.Event{}); err == nil {
+		t.Errorf("Expected an error response to fail")
+	}
+}
+
+func TestReporterQueue(t *testing.T) {
+	entered := make(chan bool, 3)
+	release := make(chan bool)
+	sent := make(chan bool, 3)
+	reporter := report.NewReporter(report.SinkFunc(func(report.Event) error {
+		entered <- true
+		<-release
+		sent <- true
+		return nil
+	}))
+	reporter.QueueSize = 1
+
+	// Reporting doesn't wait for the sink, and drops events once the queue
+	// is full.
+	done := make(chan bool)
+	go func() {
+		reporter.Report(report.Occurrence{Error: errors.New("slow")})
+		<-entered
+		reporter.Report(report.Occurrence{Error: errors.New("slow")})
+		reporter.Report(report.Occurrence{Error: errors.New("slow")})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected reporting not to wait for the sink")
+	}
+	close(release)
+	reporter.Flush()
+	if len(sent) != 2 {
+		t.Errorf("Expected 2 events to be sent, got %d", len(sent))
+	}
+	if groups := reporter.Groups(); len(groups) != 1 || groups[0].Count != 3 {
+		t.Errorf("Expected every occurrence to be counted, got %+v", groups)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Package reporttest provides stand-ins for error report sinks, so reporting can
+be tested without shipping errors anywhere.
+*/
+package reporttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/snikch/api/report"
+)
+
+// Sink records every event sent to it.
+type Sink struct {
+	events []report.Event
+	lock   sync.Mutex
+}
+
+// Send implements the report.Sink interface.
+func (sink *Sink) Send(event report.Event) error {
+	sink.lock.Lock()
+	sink.events = append(sink.events, event)
+	sink.lock.Unlock()
+	return nil
+}
+
+// Events returns every event sent so far.
+func (sink *Sink) Events() []report.Event {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return append([]report.Event{}, sink.events...)
+}
+
+// Server is a local HTTP endpoint accepting events from a report.HTTPSink.
+// Events are decoded from json, so their Error is always nil.
+type Server struct {
+	*httptest.Server
+	Sink
+	// Status is the status code responded with, and defaults to 202.
+	Status int
+}
+
+// NewServer starts a Server. It should be closed once finished with.
+func NewServer() *Server {
+	server := &Server{Status: http.StatusAccepted}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server
+}
+
+// serveHTTP records the posted event.
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	event := report.Event{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	server.Send(event)
+	w.WriteHeader(server.Status)
+}
@@ -0,0 +1,135 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snikch/api/log"
+)
+
+// LogSink logs each event, with its occurrence and group as structured
+// fields.
+type LogSink struct{}
+
+// Send implements the Sink interface.
+func (LogSink) Send(event Event) error {
+	fields := logrus.Fields{
+		"fingerprint": event.Fingerprint,
+		"type":        event.Type,
+		"count":       event.Group.Count,
+		"first_seen":  event.Group.FirstSeen,
+	}
+	for key, value := range map[string]string{
+		"private_id": event.PrivateID,
+		"request_id": event.RequestID,
+		"actor_id":   event.ActorID,
+		"actor_type": event.ActorType,
+		"method":     event.Method,
+		"path":       event.Path,
+		"stack":      event.Stack,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	if event.Status != 0 {
+		fields["status"] = event.Status
+	}
+	if event.Panic {
+		fields["panic"] = true
+	}
+	log.WithFields(fields).Error(event.Message)
+	return nil
+}
+
+// FileSink appends each event to a file as a line of json.
+type FileSink struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// NewFileSink opens the file for appending, creating it if required.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("report: %s", err.Error())
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Send implements the Sink interface.
+func (sink *FileSink) Send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	_, err = sink.file.Write(append(body, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (sink *FileSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.file.Close()
+}
+
+// DefaultHTTPSinkTimeout is the time an HTTPSink waits for a response.
+const DefaultHTTPSinkTimeout = 5 * time.Second
+
+// HTTPSink posts each event as json to an endpoint, such as an error tracking
+// service.
+type HTTPSink struct {
+	URL string
+	// Header is sent with every request, e.g. for authentication.
+	Header http.Header
+	Client *http.Client
+}
+
+// NewHTTPSink returns an HTTPSink posting to the url.
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{
+		URL:    url,
+		Header: http.Header{},
+		Client: &http.Client{Timeout: DefaultHTTPSinkTimeout},
+	}
+}
+
+// Send implements the Sink interface. Any response other than a 2xx is an
+// error.
+func (sink *HTTPSink) Send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range sink.Header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := sink.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("report: %s responded with %d", sink.URL, response.StatusCode)
+	}
+	return nil
+}
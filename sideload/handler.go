@@ -1,10 +1,16 @@
 package sideload
 
-import "github.com/snikch/api/ctx"
+import (
+	"sort"
+
+	"github.com/snikch/api/ctx"
+)
 
 var handlerRegistry = map[string]EntityHandler{}
 
-// EntityHandler represents a callback handler for an entity type.
+// EntityHandler represents a callback handler for an entity type. The supplied
+// context implements context.Context, and should be passed on to any queries
+// so they are abandoned when the request is cancelled or times out.
 type EntityHandler func(*ctx.Context, []string) (map[string]interface{}, error)
 
 // RegisterEntityHandler registers an EntityHandler for handling a specific type
@@ -12,3 +18,14 @@ type EntityHandler func(*ctx.Context, []string) (map[string]interface{}, error)
 func RegisterEntityHandler(name string, handler EntityHandler) {
 	handlerRegistry[name] = handler
 }
+
+// EntityTypes returns the names of every registered entity handler, sorted.
+// These are the values clients may request to be sideloaded.
+func EntityTypes() []string {
+	types := make([]string, 0, len(handlerRegistry))
+	for name := range handlerRegistry {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 
 	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
 )
 
 var (
@@ -147,7 +148,9 @@ func hydrateEntitiesFromMap(context *ctx.Context, ids map[string]map[string]bool
 		return entities, nil
 	}
 
-	resultChan := make(chan entityCollectionResult)
+	// The channel is buffered so that handlers finishing after a cancellation
+	// don't block forever on a result nobody is waiting for.
+	resultChan := make(chan entityCollectionResult, len(ids))
 	for name, idMap := range ids {
 		// Turn the map of ids into a slice.
 		idSlice := make([]string, len(idMap))
@@ -163,8 +166,13 @@ func hydrateEntitiesFromMap(context *ctx.Context, ids map[string]map[string]bool
 	var firstErr error
 	// Loops over the ids again, for the correct count.
 	for _ = range ids {
-		// Retrieve a result off the result chan.
-		result := <-resultChan
+		// Retrieve a result off the result chan, unless the context is done.
+		var result entityCollectionResult
+		select {
+		case result = <-resultChan:
+		case <-context.Done():
+			return entities, fail.NewTimeoutError(context.Err())
+		}
 		// An error should be assigned to the firstErr is it's empty.
 		if result.err != nil {
 			if firstErr == nil {
@@ -191,6 +199,20 @@ func singleEntityCollection(context *ctx.Context, resultChan chan<- entityCollec
 	result := entityCollectionResult{
 		name: name,
 	}
+	// A panic here can't be recovered by the request's handler, so it is
+	// returned as an error instead.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			resultChan <- entityCollectionResult{name: name, err: fail.NewPanicError(recovered)}
+		}
+	}()
+
+	// Don't bother calling the handler if the context is already done.
+	if err := context.Err(); err != nil {
+		result.err = fail.NewTimeoutError(err)
+		resultChan <- result
+		return
+	}
 
 	// Get the handler for this entity type
 	handler, ok := handlerRegistry[name]
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
 )
 
 type TestStruct struct {
@@ -210,6 +211,20 @@ func TestHydrateEntitiesFromMapNoHandler(t *testing.T) {
 	}
 }
 
+// A panicking handler
+func TestHydrateEntitiesFromMapPanic(t *testing.T) {
+	resetRegistry()
+	RegisterEntityHandler("users", func(*ctx.Context, []string) (map[string]interface{}, error) {
+		panic("boom")
+	})
+	_, err := hydrateEntitiesFromMap(ctx.NewContext(), map[string]map[string]bool{
+		"users": {"u1": true},
+	})
+	if _, ok := err.(*fail.Private); !ok {
+		t.Errorf("Expected a private error, got %v", err)
+	}
+}
+
 var (
 	u1 = &TestStruct{UserID: "u1"}
 	u2 = &TestStruct{UserID: "u2"}
@@ -324,3 +339,22 @@ func TestHydrateEntitiesWithPreloaded(t *testing.T) {
 		t.Errorf("Unexpected map received: %s", entities)
 	}
 }
+
+func TestHydrateEntitiesFromMapCancelled(t *testing.T) {
+	resetRegistry()
+	block := make(chan struct{})
+	defer close(block)
+	RegisterEntityHandler("users", func(_ *ctx.Context, ids []string) (map[string]interface{}, error) {
+		<-block
+		return map[string]interface{}{}, nil
+	})
+	context := ctx.NewContext()
+	cancel := context.WithTimeout(10 * time.Millisecond)
+	defer cancel()
+	_, err := hydrateEntitiesFromMap(context, map[string]map[string]bool{
+		"users": {"u1": true},
+	})
+	if _, ok := err.(fail.TimeoutError); !ok {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package validate
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// builtinRules are registered with every new Validator. The required and
+// omitempty options are handled by the Validator itself.
+var builtinRules = map[string]Rule{
+	"min":     minRule,
+	"max":     maxRule,
+	"email":   emailRule,
+	"oneof":   oneOfRule,
+	"eqfield": equalFieldRule(true, "Must match %s"),
+	"nefield": equalFieldRule(false, "Must not match %s"),
+	"gtfield": orderFieldRule(func(c int) bool { return c > 0 }, "Must be greater than %s"),
+	"ltfield": orderFieldRule(func(c int) bool { return c < 0 }, "Must be less than %s"),
+}
+
+// paramCheck checks the parameter of a rule on a field of a struct when the
+// struct's rules are parsed, so a mistake in a tag is returned as an error
+// rather than reported to the client as an invalid field. Indexes holds every
+// field of the struct by the names rules can refer to them by.
+type paramCheck func(structType reflect.Type, field reflect.StructField, param string, indexes map[string][]int) error
+
+// builtinParamChecks check the parameters of the built in rules.
+var builtinParamChecks = map[string]paramCheck{
+	"min":     measurableParam,
+	"max":     measurableParam,
+	"oneof":   optionsParam,
+	"eqfield": siblingParam(false),
+	"nefield": siblingParam(false),
+	"gtfield": siblingParam(true),
+	"ltfield": siblingParam(true),
+}
+
+// measurableParam checks the parameter is a number, and the field is a kind
+// that measure supports.
+func measurableParam(_ reflect.Type, field reflect.StructField, param string, _ map[string][]int) error {
+	if _, err := strconv.ParseFloat(param, 64); err != nil {
+		return fmt.Errorf("invalid limit %q", param)
+	}
+	switch kind := indirectType(field.Type).Kind(); kind {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Interface:
+	default:
+		return fmt.Errorf("a field of kind %s can't be measured", kind)
+	}
+	return nil
+}
+
+// optionsParam checks the parameter has at least one option.
+func optionsParam(_ reflect.Type, _ reflect.StructField, param string, _ map[string][]int) error {
+	if len(strings.Fields(param)) == 0 {
+		return fmt.Errorf("no options")
+	}
+	return nil
+}
+
+// siblingParam returns a check that the parameter names another field of the
+// struct. If ordered is set, the fields must also be of the same type, and one
+// that compare can order.
+func siblingParam(ordered bool) paramCheck {
+	return func(structType reflect.Type, field reflect.StructField, param string, indexes map[string][]int) error {
+		index, ok := indexes[param]
+		if !ok {
+			return fmt.Errorf("unknown field %q", param)
+		}
+		if !ordered {
+			return nil
+		}
+		typ := indirectType(field.Type)
+		if typ.Kind() == reflect.Interface {
+			return nil
+		}
+		if other := indirectType(structType.FieldByIndex(index).Type); other != typ {
+			return fmt.Errorf("can't compare %s to %s", typ, other)
+		}
+		zero := reflect.New(typ).Elem()
+		_, err := compare(zero, zero)
+		return err
+	}
+}
+
+// indirectType returns the type a pointer type points to, or the type itself.
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// minRule checks the length of strings, slices and maps, or the value of
+// numbers, is at least the parameter.
+func minRule(field Field) error {
+	limit, err := parseLimit("min", field)
+	if err != nil {
+		return err
+	}
+	if size, unit, ok := measure(field.Value); !ok || size < limit {
+		return fmt.Errorf("Must be at least %s%s", field.Param, unit)
+	}
+	return nil
+}
+
+// maxRule checks the length of strings, slices and maps, or the value of
+// numbers, is at most the parameter.
+func maxRule(field Field) error {
+	limit, err := parseLimit("max", field)
+	if err != nil {
+		return err
+	}
+	if size, unit, ok := measure(field.Value); !ok || size > limit {
+		return fmt.Errorf("Must be at most %s%s", field.Param, unit)
+	}
+	return nil
+}
+
+// parseLimit returns the rule's parameter as the limit to measure against.
+func parseLimit(rule string, field Field) (float64, error) {
+	limit, err := strconv.ParseFloat(field.Param, 64)
+	if err != nil {
+		return 0, RuleError{Rule: rule, Field: field.Name, Err: fmt.Errorf("invalid limit %q", field.Param)}
+	}
+	return limit, nil
+}
+
+// measure returns the size of the value to compare against a limit, and the
+// unit to describe it with. Values that can't be measured, which only an
+// interface field can hold as other kinds are rejected when a type's rules
+// are parsed, return false.
+func measure(value reflect.Value) (float64, string, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), " characters long", true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), " items", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), "", true
+	}
+	return 0, "", false
+}
+
+// emailRule checks a string is a bare email address, without a display name.
+func emailRule(field Field) error {
+	if field.Value.Kind() == reflect.String {
+		address, err := mail.ParseAddress(field.Value.String())
+		if err == nil && address.Address == field.Value.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("Must be a valid email address")
+}
+
+// oneOfRule checks the value is one of the space separated options.
+func oneOfRule(field Field) error {
+	options := strings.Fields(field.Param)
+	value := fmt.Sprint(field.Value.Interface())
+	for _, option := range options {
+		if value == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("Must be one of %s", strings.Join(options, ", "))
+}
+
+// equalFieldRule returns a rule checking whether the field is equal to the
+// sibling named by the parameter.
+func equalFieldRule(equal bool, message string) Rule {
+	return func(field Field) error {
+		other, found := field.Sibling(field.Param)
+		same := found && field.Value.Type() == other.Type()
+		if same {
+			if comparison, err := compare(field.Value, other); err == nil {
+				same = comparison == 0
+			} else {
+				same = reflect.DeepEqual(field.Value.Interface(), other.Interface())
+			}
+		}
+		if same != equal {
+			return fmt.Errorf(message, field.Param)
+		}
+		return nil
+	}
+}
+
+// orderFieldRule returns a rule comparing the field to the sibling named by
+// the parameter, which passes if the comparison's result satisfies ok. An
+// absent sibling can't be compared, so passes. Values that can't be ordered,
+// which only interface fields can hold as other types are checked when a
+// type's rules are parsed, fail.
+func orderFieldRule(ok func(int) bool, message string) Rule {
+	return func(field Field) error {
+		other, found := field.Sibling(field.Param)
+		if !found {
+			return nil
+		}
+		if comparison, err := compare(field.Value, other); err != nil || !ok(comparison) {
+			return fmt.Errorf(message, field.Param)
+		}
+		return nil
+	}
+}
+
+// compare returns -1, 0 or 1 as a is less than, equal to, or greater than b.
+// Numbers, strings and times can be compared.
+func compare(a, b reflect.Value) (int, error) {
+	if a.Type() != b.Type() {
+		return 0, fmt.Errorf("can't compare %s to %s", a.Type(), b.Type())
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareFloats(float64(a.Int()), float64(b.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareFloats(float64(a.Uint()), float64(b.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float()), nil
+	}
+	if at, ok := a.Interface().(time.Time); ok {
+		bt := b.Interface().(time.Time)
+		switch {
+		case at.Before(bt):
+			return -1, nil
+		case at.After(bt):
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("can't order %s", a.Type())
+}
+
+// compareFloats returns -1, 0 or 1 as a is less than, equal to, or greater
+// than b.
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,370 @@
+/*
+Package validate checks structs against the rules in their validate tags, so
+domain objects built from any source, not just json bodies checked against a
+schema, can be validated.
+
+	type Thing struct {
+		Name     string `json:"name" validate:"required,min=1,max=255"`
+		Email    string `json:"email" validate:"omitempty,email"`
+		Kind     string `json:"kind" validate:"oneof=small large"`
+		Password string `json:"password" validate:"required,min=8"`
+		Confirm  string `json:"confirm" validate:"eqfield=password"`
+	}
+
+	if err := validate.Struct(thing); err != nil {
+		return nil, 0, err
+	}
+
+Invalid fields are returned in a fail.ValidationError, keyed by the same names
+as the Validator's KeyMapper, which by default uses json tags, so they match
+the names clients send. Nested structs, and structs in slices, are validated
+too, and their fields are prefixed with their parent's name, e.g.
+"items.0.sku". The rules for each type are parsed once and cached.
+
+Rules comparing fields, such as eqfield, name the other field by its key or
+its Go name. Custom rules can be added with Register, and can compare fields
+with Field.Sibling.
+*/
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/snikch/api/changes"
+	"github.com/snikch/api/fail"
+)
+
+// Tag is the struct tag rules are read from.
+const Tag = "validate"
+
+// ErrNotStruct is returned when anything other than a struct, or a pointer to
+// one, is validated.
+var ErrNotStruct = errors.New("a struct must be supplied")
+
+// DefaultValidator is used by Struct and Register.
+var DefaultValidator = NewValidator(changes.NewTagNameMapper("json"))
+
+// Struct validates a struct, or a pointer to one, with the DefaultValidator.
+func Struct(value interface{}) error {
+	return DefaultValidator.Struct(value)
+}
+
+// Register adds a rule to the DefaultValidator.
+func Register(name string, rule Rule) {
+	DefaultValidator.Register(name, rule)
+}
+
+// Rule checks a field, returning an error describing why it is invalid. The
+// error's message is returned to the client as the field's message, unless
+// it's a RuleError.
+type Rule func(field Field) error
+
+// RuleError is returned by a Rule that can't check a field, such as for a
+// parameter it doesn't accept. It's a programming error rather than an invalid
+// field, so it's returned by Struct as is.
+type RuleError struct {
+	Rule  string
+	Field string
+	Err   error
+}
+
+// Error implements the error interface.
+func (err RuleError) Error() string {
+	return fmt.Sprintf("validate: rule %s on %s: %s", err.Rule, err.Field, err.Err)
+}
+
+// Unwrap returns the error the rule failed with.
+func (err RuleError) Unwrap() error {
+	return err.Err
+}
+
+// Field is the field a Rule is checking.
+type Field struct {
+	// Name is the field's name, without the prefix of any parent struct.
+	Name string
+	// Value is the field's value. Pointers have already been dereferenced,
+	// and interfaces replaced by the value they hold.
+	Value reflect.Value
+	// Param is the rule's parameter, e.g. "255" for max=255.
+	Param string
+	// Struct is the struct the field belongs to.
+	Struct reflect.Value
+	plan   *plan
+}
+
+// Sibling returns another field of the same struct by its name, for rules
+// that compare fields. Pointers and interfaces are dereferenced, as with
+// Value.
+func (field Field) Sibling(name string) (reflect.Value, bool) {
+	index, ok := field.plan.indexes[name]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	value := indirectValue(field.Struct.FieldByIndex(index))
+	return value, value.IsValid()
+}
+
+// indirectValue returns the value a pointer points to, or an interface holds,
+// or an invalid value if either is nil.
+func indirectValue(value reflect.Value) reflect.Value {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return reflect.Value{}
+		}
+		value = value.Elem()
+	}
+	return value
+}
+
+// Validator validates structs against the rules in their validate tags. Field
+// names are generated by its KeyMapper.
+type Validator struct {
+	KeyMapper   changes.KeyMapper
+	rules       map[string]Rule
+	paramChecks map[string]paramCheck
+	plans       map[reflect.Type]*plan
+	sync.RWMutex
+}
+
+// NewValidator returns a Validator using the supplied mapper, with the built
+// in rules registered.
+func NewValidator(mapper changes.KeyMapper) *Validator {
+	validator := &Validator{
+		KeyMapper:   mapper,
+		rules:       map[string]Rule{},
+		paramChecks: map[string]paramCheck{},
+		plans:       map[reflect.Type]*plan{},
+	}
+	for name, rule := range builtinRules {
+		validator.rules[name] = rule
+	}
+	for name, check := range builtinParamChecks {
+		validator.paramChecks[name] = check
+	}
+	return validator
+}
+
+// Register adds a rule, replacing any existing rule with the same name. Rules
+// are resolved when a type is first validated, so they should be registered
+// during setup. A rule's parameter is passed to it as is, so a rule should
+// return a RuleError for any parameter it doesn't accept.
+func (validator *Validator) Register(name string, rule Rule) {
+	validator.Lock()
+	validator.rules[name] = rule
+	delete(validator.paramChecks, name)
+	validator.Unlock()
+}
+
+// Struct validates a struct, or a pointer to one, returning a
+// fail.ValidationError with every invalid field. Any other error, such as a
+// tag naming an unknown rule, a built in rule with an invalid parameter, or a
+// RuleError, is a programming error.
+func (validator *Validator) Struct(value interface{}) error {
+	val := reflect.Indirect(reflect.ValueOf(value))
+	if val.Kind() != reflect.Struct {
+		return ErrNotStruct
+	}
+	fields := map[string]string{}
+	if err := validator.validateStruct("", val, fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	err := fail.NewValidationError(errors.New("Invalid data supplied"))
+	err.AdditionalFields = fields
+	return err
+}
+
+// validateStruct adds the messages for the invalid fields of a struct, and
+// any structs nested in it, to fields.
+func (validator *Validator) validateStruct(prefix string, val reflect.Value, fields map[string]string) error {
+	plan, err := validator.plan(val)
+	if err != nil {
+		return err
+	}
+	for _, fieldPlan := range plan.fields {
+		value := val.FieldByIndex(fieldPlan.index)
+		message, ok, err := fieldPlan.check(plan, val, value)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fields[prefix+fieldPlan.name] = message
+			continue
+		}
+		if err := validator.validateNested(prefix+fieldPlan.name+".", indirectValue(value), fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNested validates a struct field, or the structs in a slice or array
+// field, prefixing the names of their fields.
+func (validator *Validator) validateNested(prefix string, value reflect.Value, fields map[string]string) error {
+	switch value.Kind() {
+	case reflect.Struct:
+		return validator.validateStruct(prefix, value, fields)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			elem := reflect.Indirect(value.Index(i))
+			if elem.Kind() != reflect.Struct {
+				continue
+			}
+			if err := validator.validateStruct(prefix+strconv.Itoa(i)+".", elem, fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// plan is the parsed rules for each field of a type.
+type plan struct {
+	fields  []fieldPlan
+	indexes map[string][]int
+}
+
+// fieldPlan is the parsed rules for a field.
+type fieldPlan struct {
+	name  string
+	index []int
+	// omitEmpty skips the field's rules if it is empty, and required fails if
+	// it is.
+	omitEmpty, required bool
+	rules               []ruleCall
+}
+
+// ruleCall is a rule and the parameter it is called with.
+type ruleCall struct {
+	rule  Rule
+	param string
+}
+
+// check runs the field's rules in order, returning the message of the first
+// that fails, or the RuleError of a rule that couldn't check the field.
+func (fieldPlan fieldPlan) check(plan *plan, val, value reflect.Value) (string, bool, error) {
+	empty := isEmpty(value)
+	if fieldPlan.required && empty {
+		return "Required", false, nil
+	}
+	// Nil pointers and interfaces are treated as absent, so only required
+	// applies to them.
+	value = indirectValue(value)
+	if (fieldPlan.omitEmpty && empty) || !value.IsValid() {
+		return "", true, nil
+	}
+	for _, call := range fieldPlan.rules {
+		err := call.rule(Field{
+			Name:   fieldPlan.name,
+			Value:  value,
+			Param:  call.param,
+			Struct: val,
+			plan:   plan,
+		})
+		var ruleErr RuleError
+		if errors.As(err, &ruleErr) {
+			return "", false, err
+		}
+		if err != nil {
+			return err.Error(), false, nil
+		}
+	}
+	return "", true, nil
+}
+
+// plan returns the cached plan for the value's type, creating it if this is
+// the first time the type has been validated.
+func (validator *Validator) plan(val reflect.Value) (*plan, error) {
+	validator.RLock()
+	typ := val.Type()
+	cached, ok := validator.plans[typ]
+	validator.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	// Map the zero value, so the keys don't depend on this value's pointers.
+	indexes, err := validator.KeyMapper.KeyIndexes(reflect.New(typ).Elem())
+	if err != nil {
+		return nil, err
+	}
+	validator.Lock()
+	defer validator.Unlock()
+	typePlan := &plan{indexes: map[string][]int{}}
+	// Parameters are checked once every field is indexed, as some name
+	// other fields.
+	type pendingCheck struct {
+		check           paramCheck
+		field           reflect.StructField
+		ruleName, param string
+	}
+	checks := []pendingCheck{}
+	for _, name := range indexes.Keys {
+		index := indexes.Indexes[name]
+		field := typ.FieldByIndex(index)
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		typePlan.indexes[name] = index
+		// Fields can also be referred to by their Go name in cross field rules.
+		if _, ok := typePlan.indexes[field.Name]; !ok {
+			typePlan.indexes[field.Name] = index
+		}
+
+		fieldPlan := fieldPlan{name: name, index: index}
+		for _, part := range strings.Split(field.Tag.Get(Tag), ",") {
+			ruleName, param := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				ruleName, param = part[:i], part[i+1:]
+			}
+			switch ruleName {
+			case "":
+				continue
+			case "omitempty":
+				fieldPlan.omitEmpty = true
+				continue
+			case "required":
+				fieldPlan.required = true
+				continue
+			}
+			rule, ok := validator.rules[ruleName]
+			if !ok {
+				return nil, fmt.Errorf("validate: unknown rule %q on %s.%s", ruleName, typ, field.Name)
+			}
+			if check, ok := validator.paramChecks[ruleName]; ok {
+				checks = append(checks, pendingCheck{check: check, field: field, ruleName: ruleName, param: param})
+			}
+			fieldPlan.rules = append(fieldPlan.rules, ruleCall{rule: rule, param: param})
+		}
+		typePlan.fields = append(typePlan.fields, fieldPlan)
+	}
+	for _, pending := range checks {
+		if err := pending.check(typ, pending.field, pending.param, typePlan.indexes); err != nil {
+			return nil, fmt.Errorf("validate: invalid rule %s=%s on %s.%s: %s", pending.ruleName, pending.param, typ, pending.field.Name, err)
+		}
+	}
+	validator.plans[typ] = typePlan
+	return typePlan, nil
+}
+
+// isEmpty returns whether the value is its type's zero value, or an empty
+// slice or map.
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	return value.IsZero()
+}
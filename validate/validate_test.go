@@ -0,0 +1,251 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/snikch/api/changes"
+	"github.com/snikch/api/fail"
+)
+
+type testItem struct {
+	SKU      string `json:"sku" validate:"required"`
+	Quantity int    `json:"quantity" validate:"min=1,max=10"`
+}
+
+type testAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type testThing struct {
+	Name     string       `json:"name,omitempty" validate:"required,min=2,max=5"`
+	Email    string       `json:"email" validate:"omitempty,email"`
+	Kind     string       `json:"kind" validate:"oneof=small large"`
+	Password string       `json:"password" validate:"required"`
+	Confirm  string       `json:"confirm" validate:"eqfield=password"`
+	StartsAt time.Time    `json:"starts_at"`
+	EndsAt   time.Time    `json:"ends_at" validate:"gtfield=StartsAt"`
+	Tags     []string     `json:"tags" validate:"max=2"`
+	Code     *string      `json:"code" validate:"min=3"`
+	Address  *testAddress `json:"address" validate:"required"`
+	Items    []testItem   `json:"items"`
+	NoTag    string       `validate:"omitempty,nefield=name"`
+}
+
+func validThing() testThing {
+	now := time.Now()
+	return testThing{
+		Name:     "Thing",
+		Kind:     "small",
+		Password: "secret",
+		Confirm:  "secret",
+		StartsAt: now,
+		EndsAt:   now.Add(time.Hour),
+		Address:  &testAddress{City: "Wellington"},
+		Items:    []testItem{{SKU: "a", Quantity: 1}},
+	}
+}
+
+func TestStruct(t *testing.T) {
+	thing := validThing()
+	if err := Struct(thing); err != nil {
+		t.Fatalf("Expected a valid thing, got %v", err)
+	}
+	if err := Struct(&thing); err != nil {
+		t.Fatalf("Expected a pointer to a valid thing to be valid, got %s", err)
+	}
+
+	code := "ab"
+	thing = validThing()
+	thing.Name = "Ŧĥïņğš"
+	thing.Email = "Thing <thing@example.com>"
+	thing.Kind = "medium"
+	thing.Confirm = "public"
+	thing.EndsAt = thing.StartsAt.Add(-time.Hour)
+	thing.Tags = []string{"a", "b", "c"}
+	thing.Code = &code
+	thing.Address = &testAddress{}
+	thing.Items = append(thing.Items, testItem{Quantity: 11})
+	thing.NoTag = thing.Name
+
+	err := Struct(thing)
+	var validationErr fail.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.StatusCode() != fail.ValidationErrorStatusCode {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	expected := map[string]string{
+		"name":             "Must be at most 5 characters long",
+		"email":            "Must be a valid email address",
+		"kind":             "Must be one of small, large",
+		"confirm":          "Must match password",
+		"ends_at":          "Must be greater than StartsAt",
+		"tags":             "Must be at most 2 items",
+		"code":             "Must be at least 3 characters long",
+		"address.city":     "Required",
+		"items.1.sku":      "Required",
+		"items.1.quantity": "Must be at most 10",
+		"NoTag":            "Must not match name",
+	}
+	if diff := pretty.Compare(validationErr.ErrorFields(), expected); diff != "" {
+		t.Errorf("Unexpected fields\n%s", diff)
+	}
+
+	thing = validThing()
+	thing.Name = ""
+	thing.Address = nil
+	err = Struct(thing)
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	expected = map[string]string{"name": "Required", "address": "Required"}
+	if diff := pretty.Compare(validationErr.ErrorFields(), expected); diff != "" {
+		t.Errorf("Unexpected fields\n%s", diff)
+	}
+
+	if err := Struct("thing"); err != ErrNotStruct {
+		t.Errorf("Expected ErrNotStruct, got %v", err)
+	}
+}
+
+func TestCustomRules(t *testing.T) {
+	type Order struct {
+		Kind   string `json:"kind" validate:"even"`
+		Amount int    `json:"amount" validate:"even,ltfield=limit"`
+		Limit  int    `json:"limit"`
+	}
+	validator := NewValidator(changes.NewTagNameMapper("json"))
+	if err := validator.Struct(Order{}); err == nil || !strings.Contains(err.Error(), `unknown rule "even"`) {
+		t.Fatalf("Expected an unknown rule error, got %v", err)
+	}
+
+	validator = NewValidator(changes.NewTagNameMapper("json"))
+	validator.Register("even", func(field Field) error {
+		if field.Value.Kind() == reflect.Int && field.Value.Int()%2 != 0 {
+			return errors.New("Must be even")
+		}
+		return nil
+	})
+	err := validator.Struct(Order{Amount: 13, Limit: 10})
+	var validationErr fail.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.ErrorFields()["amount"] != "Must be even" {
+		t.Errorf("Expected the amount to be odd, got %v", err)
+	}
+	err = validator.Struct(Order{Amount: 12, Limit: 10})
+	if !errors.As(err, &validationErr) || validationErr.ErrorFields()["amount"] != "Must be less than limit" {
+		t.Errorf("Expected the amount to be over the limit, got %v", err)
+	}
+	if err := validator.Struct(Order{Amount: 8, Limit: 10}); err != nil {
+		t.Errorf("Expected a valid order, got %v", err)
+	}
+
+	// Plans are cached per type.
+	if len(validator.plans) != 1 {
+		t.Errorf("Expected a single cached plan, got %d", len(validator.plans))
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	for name, test := range map[string]struct {
+		value    interface{}
+		expected string
+	}{
+		"limit": {struct {
+			Name string `validate:"max=abc"`
+		}{}, `invalid rule max=abc on struct { Name string "validate:\"max=abc\"" }.Name`},
+		"kind": {struct {
+			Active bool `validate:"min=1"`
+		}{}, "a field of kind bool can't be measured"},
+		"options": {struct {
+			Kind string `validate:"oneof="`
+		}{}, "no options"},
+		"sibling": {struct {
+			Confirm string `validate:"eqfield=password"`
+		}{}, `unknown field "password"`},
+		"order": {struct {
+			StartsAt time.Time
+			EndsAt   string `validate:"gtfield=StartsAt"`
+		}{}, "can't compare string to time.Time"},
+		"unorderable": {struct {
+			Tags  []string `validate:"ltfield=Other"`
+			Other []string
+		}{}, "can't order []string"},
+	} {
+		// Invalid parameters are errors even when the field is valid.
+		err := NewValidator(changes.NewTagNameMapper("json")).Struct(test.value)
+		if _, ok := err.(fail.ValidationError); ok || err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, test.expected, err)
+		}
+	}
+
+	// Registering a rule replaces the built in rule's check.
+	validator := NewValidator(changes.NewTagNameMapper("json"))
+	validator.Register("max", func(Field) error { return nil })
+	if err := validator.Struct(struct {
+		Name string `validate:"max=abc"`
+	}{}); err != nil {
+		t.Errorf("Expected a registered rule to accept its own parameters, got %v", err)
+	}
+}
+
+func TestInterfaceFields(t *testing.T) {
+	type Loose struct {
+		V interface{} `validate:"min=2"`
+		O interface{} `validate:"gtfield=V"`
+	}
+	// Interfaces are checked by the value they hold, and values that can't be
+	// measured or ordered are invalid, rather than reported as the rule's
+	// failure.
+	err := Struct(Loose{"abc", 1})
+	var validationErr fail.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	expected := map[string]string{"O": "Must be greater than V"}
+	if diff := pretty.Compare(validationErr.ErrorFields(), expected); diff != "" {
+		t.Errorf("Unexpected fields\n%s", diff)
+	}
+
+	err = Struct(Loose{"a", true})
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	expected = map[string]string{"V": "Must be at least 2 characters long", "O": "Must be greater than V"}
+	if diff := pretty.Compare(validationErr.ErrorFields(), expected); diff != "" {
+		t.Errorf("Unexpected fields\n%s", diff)
+	}
+
+	if err := Struct(Loose{V: 3, O: 4}); err != nil {
+		t.Errorf("Expected valid numbers, got %v", err)
+	}
+	if err := Struct(Loose{}); err != nil {
+		t.Errorf("Expected nil interfaces to be absent, got %v", err)
+	}
+}
+
+func TestRuleErrors(t *testing.T) {
+	validator := NewValidator(changes.NewTagNameMapper("json"))
+	validator.Register("prefix", func(field Field) error {
+		if field.Param == "" {
+			return RuleError{Rule: "prefix", Field: field.Name, Err: errors.New("no prefix")}
+		}
+		if !strings.HasPrefix(field.Value.String(), field.Param) {
+			return fmt.Errorf("Must start with %s", field.Param)
+		}
+		return nil
+	})
+	err := validator.Struct(struct {
+		Name string `json:"name" validate:"prefix="`
+	}{"thing"})
+	var ruleErr RuleError
+	if !errors.As(err, &ruleErr) || ruleErr.Field != "name" {
+		t.Errorf("Expected the rule's error to be returned, got %v", err)
+	}
+	if _, ok := err.(fail.ValidationError); ok {
+		t.Errorf("Expected a rule error not to be a validation error")
+	}
+}
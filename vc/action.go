@@ -1,14 +1,19 @@
 package vc
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/rcrowley/go-metrics"
+	"github.com/snikch/api/changes"
 	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/log"
 	"github.com/snikch/api/lynx"
 	"github.com/snikch/api/sideload"
+	schema "github.com/xeipuuv/gojsonschema"
 )
 
 // EmptyResponse is used to determine if a response should be empty.
@@ -19,6 +24,13 @@ type contextKey int
 const (
 	criteriaContextKey contextKey = iota
 	paramsContextKey
+	paginationContextKey
+	currentEntityContextKey
+	actorContextKey
+	entityContextKey
+	errorFormatContextKey
+	batchContextKey
+	clientIPContextKey
 )
 
 // ActionProcessor handles an entire action lifecycle, from data retrieval
@@ -26,14 +38,87 @@ const (
 type ActionProcessor struct {
 	SideloadEnabled bool
 	MetricsRegistry metrics.Registry
+	// Timeout is the default deadline applied to every action. A zero value
+	// means actions only finish early if the client goes away.
+	Timeout time.Duration
+	// ActionTimeouts overrides Timeout for specific actions, keyed by the
+	// same "type-action" name used for metrics.
+	ActionTimeouts map[string]time.Duration
+	// Renderers are negotiated against each request's Accept header. If no
+	// renderers are registered, DefaultRenderer is used for every response.
+	Renderers *RendererRegistry
+	// ETag determines whether ETags are generated for GET responses, which
+	// also enables answering conditional requests with a 304.
+	ETag ETagMode
+	// RequireIfMatch rejects PUT, PATCH and DELETE requests without an
+	// If-Match header before the action is handled.
+	RequireIfMatch bool
+	// Differ is used to report the fields that have changed when an If-Match
+	// precondition fails.
+	Differ *changes.Differ
+	// RequestSchemas documents the schemas request bodies are validated
+	// against, keyed by the same "type-action" name used for metrics.
+	RequestSchemas map[string]*schema.Schema
+	// ResponseSchemas are the schemas response payloads are validated against
+	// and documented with, keyed by the same "type-action" name.
+	ResponseSchemas map[string]*schema.Schema
+	// ResponseValidation determines whether response payloads are validated
+	// against ResponseSchemas, and what happens when they don't match.
+	ResponseValidation ResponseValidationMode
+	// Idempotency stores the responses to POST and PATCH requests sent with an
+	// Idempotency-Key header, so retries are replayed rather than repeated.
+	// Idempotency keys are ignored if nil.
+	Idempotency IdempotencyStore
+	// ClientIP returns the client IP that rate limits and idempotency keys of
+	// anonymous requests are scoped to. If nil, the host of the request's
+	// RemoteAddr is used. Services behind a proxy should supply a function that trusts the
+	// proxy's forwarded headers.
+	ClientIP func(*http.Request) string
+	// Authenticator identifies the actor making each request before it is
+	// handled. Requests are anonymous if nil.
+	Authenticator Authenticator
+	// Policies authorize each request before it is handled. Every request is
+	// allowed if nil.
+	Policies *Policies
+	// RateLimiter limits the requests each actor can make. Requests that fail
+	// authentication are counted against the client IP. Requests aren't
+	// limited if nil.
+	RateLimiter *RateLimiter
+	// ErrorFormat determines how error responses are rendered, for every
+	// error returned while handling a request.
+	ErrorFormat ErrorFormat
+	// routes are the routes registered via Handle or RegisterResource.
+	routes []Route
 }
 
 func NewActionProcessor() *ActionProcessor {
 	return &ActionProcessor{
 		MetricsRegistry: metrics.NewRegistry(),
+		ActionTimeouts:  map[string]time.Duration{},
+		RequestSchemas:  map[string]*schema.Schema{},
+		ResponseSchemas: map[string]*schema.Schema{},
+		Renderers:       NewRendererRegistry(),
+		Differ:          defaultDiffer(),
 	}
 }
 
+// SetActionTimeout sets the deadline for a single type and action. This should
+// be called during setup, before any requests are being served.
+func (p *ActionProcessor) SetActionTimeout(typ, action string, timeout time.Duration) {
+	if p.ActionTimeouts == nil {
+		p.ActionTimeouts = map[string]time.Duration{}
+	}
+	p.ActionTimeouts[typ+"-"+action] = timeout
+}
+
+// actionTimeout returns the deadline for the supplied type and action.
+func (p *ActionProcessor) actionTimeout(typ, action string) time.Duration {
+	if timeout, ok := p.ActionTimeouts[typ+"-"+action]; ok {
+		return timeout
+	}
+	return p.Timeout
+}
+
 // ActionHandler implementers are responsible for returning payload data for
 // a request, along with a status code or error.
 type ActionHandler interface {
@@ -66,40 +151,163 @@ func RegisterCriteriaTransformer(transformer func(*ctx.Context, *Criteria)) {
 	requestCriteriaTransformers = append(requestCriteriaTransformers, transformer)
 }
 
+// unlock unlocks any entities registered on the context's store, recording
+// the time taken against the supplied timer.
+func (p *ActionProcessor) unlock(context *ctx.Context, unlockTimer metrics.Timer) error {
+	start := time.Now()
+	err := lynx.ContextStore(context).Unlock()
+	unlockTimer.UpdateSince(start)
+	return err
+}
+
 // HTTPHandler takes an ActionHandler and returns a http.Handler instance
 // that can be used. The type and action are used to determine the context in
 // several areas, such as transformers and metrics.
 func (p *ActionProcessor) HTTPHandler(typ, action string, handler ActionHandler) httprouter.Handle {
-	// Create a new timer for timing this handler.
-	timer := metrics.NewTimer()
-	p.MetricsRegistry.Register(typ+"-"+action, timer)
-	sideloadTimer := metrics.NewTimer()
-	p.MetricsRegistry.Register(typ+"-"+action+"-sideload", sideloadTimer)
-	unlockTimer := metrics.NewTimer()
-	p.MetricsRegistry.Register(typ+"-"+action+"-unlock", unlockTimer)
+	// Create a new timer for timing this handler. Timers are shared by every
+	// handler with the same type and action, such as a resource's PUT and
+	// PATCH routes.
+	timer := p.MetricsRegistry.GetOrRegister(typ+"-"+action, metrics.NewTimer).(metrics.Timer)
+	sideloadTimer := p.MetricsRegistry.GetOrRegister(typ+"-"+action+"-sideload", metrics.NewTimer).(metrics.Timer)
+	unlockTimer := p.MetricsRegistry.GetOrRegister(typ+"-"+action+"-unlock", metrics.NewTimer).(metrics.Timer)
+	panicCounter := p.MetricsRegistry.GetOrRegister(typ+"-"+action+"-panic", metrics.NewCounter).(metrics.Counter)
 
 	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		// At the end of this function, add a time metric.
 		defer timer.UpdateSince(time.Now())
 
-		// Create a new context for this action.
-		context := ctx.NewContext()
+		// Create a new context for this action, which is cancelled when the
+		// client goes away or the action's timeout passes. The request carries
+		// the context, so errors can be reported with its actor.
+		context := ctx.NewContextWithParent(r.Context())
+		if timeout := p.actionTimeout(typ, action); timeout > 0 {
+			cancel := context.WithTimeout(timeout)
+			defer cancel()
+		}
+		r = r.WithContext(context)
 		context.Request = r
 		context.EntityType = typ
+		if p.ErrorFormat != ErrorFormatAPIError {
+			context.Set(errorFormatContextKey, p.ErrorFormat)
+		}
+
+		// Recover from any panic with a private error, unless a response has
+		// already been started.
+		renderer := DefaultRenderer
+		tracker := &responseTracker{ResponseWriter: w}
+		w = tracker
+		defer recoverPanic(&renderer, tracker, r, panicCounter)
+
+		// Pick a renderer for the response based on the Accept header.
+		var err error
+		renderer, err = p.negotiateRenderer(r)
+		if p.Renderers != nil && len(p.Renderers.types) > 1 {
+			w.Header().Add("Vary", "Accept")
+		}
+		if err != nil {
+			RespondWithRenderedError(renderer, w, r, err)
+			return
+		}
 		SetContextParams(context, params)
+		SetContextClientIP(context, clientIP(r, p.ClientIP))
+
+		// Identify the actor making the request.
+		if p.Authenticator != nil {
+			actor, err := p.Authenticator.Authenticate(context)
+			if err != nil {
+				// Failed attempts count against the client IP's limits, so
+				// credentials can't be guessed without limit.
+				if p.RateLimiter != nil {
+					if limitErr := p.checkRateLimit(context, w, typ, action); limitErr != nil {
+						err = limitErr
+					}
+				}
+				RespondWithRenderedError(renderer, w, r, err)
+				return
+			}
+			if actor != nil {
+				SetContextActor(context, actor)
+			}
+		}
+
+		// Deny requests from actors that have exceeded their rate limits.
+		if p.RateLimiter != nil {
+			if err := p.checkRateLimit(context, w, typ, action); err != nil {
+				RespondWithRenderedError(renderer, w, r, err)
+				return
+			}
+		}
 
 		// Get any criteria, and transform it if required.
-		criteria := RequestCriteria(r)
+		criteria, err := RequestTypeCriteria(r, typ)
+		if err == nil {
+			err = ValidateFilters(typ, criteria)
+		}
+		if err != nil {
+			RespondWithRenderedError(renderer, w, r, err)
+			return
+		}
 		for _, transformer := range requestCriteriaTransformers {
 			transformer(context, criteria)
 		}
 		// Make the criteria available on the content.
 		SetContextCriteria(context, criteria)
 
+		// Check the actor is allowed to perform this action.
+		if p.Policies != nil {
+			if err := p.authorize(context, typ, action, handler); err != nil {
+				RespondWithRenderedError(renderer, w, r, err)
+				return
+			}
+		}
+
+		// Replay the response to a request that has already been made, or record
+		// the response to this one.
+		if p.Idempotency != nil && idempotentRequest(r) {
+			recorder, replayed, err := p.beginIdempotentRequest(context, renderer, w, r)
+			if err != nil {
+				RespondWithRenderedError(renderer, w, r, err)
+				return
+			}
+			if replayed {
+				return
+			}
+			w = recorder
+			defer func() {
+				if err := recorder.finish(); err != nil {
+					log.WithError(err).Error("Could not store idempotent response")
+				}
+			}()
+		}
+
+		// Ensure mutations apply to the version of the entity the client has.
+		if mutatingRequest(r) {
+			if p.RequireIfMatch && r.Header.Get("If-Match") == "" {
+				RespondWithRenderedError(renderer, w, r, fail.NewPreconditionRequiredError(errors.New("Missing If-Match header")))
+				return
+			}
+			if preconditionHandler, ok := handler.(PreconditionHandler); ok {
+				if err := p.checkPreconditions(context, preconditionHandler); err != nil {
+					RespondWithRenderedError(renderer, w, r, err)
+					return
+				}
+			}
+		}
+
 		// Get the base payload back from the ActionHandler instance.
 		payload, code, err := handler.HandleAction(context)
 		if err != nil {
-			RespondWithError(w, r, err)
+			// Errors caused by the context finishing are reported as timeouts.
+			if contextErr := context.Err(); contextErr != nil {
+				err = fail.NewTimeoutError(contextErr)
+			}
+			RespondWithRenderedError(renderer, w, r, err)
+			return
+		}
+
+		// Streams are written as they are read, rather than rendered whole.
+		if stream, ok := payload.(Stream); ok {
+			p.respondWithStream(context, renderer, w, r, typ, criteria, stream, code, sideloadTimer, unlockTimer)
 			return
 		}
 
@@ -109,35 +317,102 @@ func (p *ActionProcessor) HTTPHandler(typ, action string, handler ActionHandler)
 			return
 		}
 
+		// Versioned payloads can answer conditional requests before any
+		// sideloading or rendering is done.
+		conditional := p.ETag != ETagNone && conditionalRequest(r, code)
+		var etag string
+		var lastModified time.Time
+		if conditional {
+			if versioned, ok := payload.(Versioned); ok {
+				etag = p.representationETag(r, renderer, versioned.Version())
+			}
+			if modifier, ok := payload.(LastModifier); ok {
+				lastModified = modifier.LastModified()
+			}
+			if (etag != "" || !lastModified.IsZero()) && notModified(r, etag, lastModified) {
+				// Unlocking still runs so the store is cleared and timed as usual.
+				if err := p.unlock(context, unlockTimer); err != nil {
+					RespondWithRenderedError(renderer, w, r, err)
+					return
+				}
+				setValidators(w.Header(), etag, lastModified)
+				RespondWithNotModified(w, r)
+				return
+			}
+		}
+
+		// Let clients know the new version of any mutated entity.
+		if versioned, ok := payload.(Versioned); ok && mutatingRequest(r) {
+			w.Header().Set("ETag", VersionETag(versioned.Version(), p.ETag == ETagWeak))
+		}
+
 		// Build up a response.
 		response := Response{
 			Payload: payload,
 		}
 
+		// Include any pagination set by the handler, and link to other pages.
+		if pagination := ContextPagination(context); pagination != nil {
+			pagination.resolve(r)
+			response.Pagination = pagination
+			if link := pagination.LinkHeader(); link != "" {
+				w.Header().Set("Link", link)
+			}
+		}
+
 		if p.SideloadEnabled {
 			start := time.Now()
 			// Retrieve any sideloaded entities.
 			sideloaded, err := sideload.Load(context, payload, criteria.Sideload)
+			sideloadTimer.UpdateSince(start)
 
 			response.Sideload = &sideloaded
 			if err != nil {
-				timer.UpdateSince(start)
-				RespondWithError(w, r, err)
+				RespondWithRenderedError(renderer, w, r, err)
 				return
 			}
-			timer.UpdateSince(start)
 		}
 
 		// Unlock any entities registered for this request.
-		unlockStartTime := time.Now()
-		err = lynx.ContextStore(context).Unlock()
-		unlockTimer.UpdateSince(unlockStartTime)
+		if err := p.unlock(context, unlockTimer); err != nil {
+			RespondWithRenderedError(renderer, w, r, err)
+			return
+		}
 
-		if err != nil {
-			RespondWithError(w, r, err)
+		// Check the payload matches the published contract, before any fields
+		// are removed from it.
+		if err := p.validateResponse(typ, action, response.Payload); err != nil {
+			RespondWithRenderedError(renderer, w, r, err)
+			return
+		}
+
+		// Restrict the rendered fields if requested. This happens after
+		// unlocking, as it copies field values out of the payload.
+		if err := applySparseFields(typ, criteria, &response); err != nil {
+			RespondWithRenderedError(renderer, w, r, err)
 			return
 		}
 
-		RespondWithData(w, r, response, code)
+		if !conditional {
+			RespondWithRenderedData(renderer, w, r, response, code)
+			return
+		}
+
+		// Conditional responses are rendered up front, so the body can be
+		// hashed if the payload doesn't provide its own version.
+		body, err := renderer.Render(response)
+		if err != nil {
+			RespondWithRenderedError(renderer, w, r, err)
+			return
+		}
+		if etag == "" {
+			etag = bodyETag(body, p.ETag == ETagWeak)
+		}
+		setValidators(w.Header(), etag, lastModified)
+		if notModified(r, etag, lastModified) {
+			RespondWithNotModified(w, r)
+			return
+		}
+		respondWithBody(renderer, w, body, code)
 	})
 }
@@ -0,0 +1,455 @@
+package vc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rcrowley/go-metrics"
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// jsonTestRenderer is a minimal json renderer, as the render package can't be
+// imported here without an import cycle.
+type jsonTestRenderer struct{}
+
+func (jsonTestRenderer) ContentType() string { return "application/json" }
+
+func (jsonTestRenderer) Render(data interface{}) ([]byte, error) { return json.Marshal(data) }
+
+func (jsonTestRenderer) RenderError(err APIError) []byte {
+	body, _ := json.Marshal(err)
+	return body
+}
+
+// serveAction runs a single request through an action handler.
+func serveAction(p *ActionProcessor, r *http.Request, fn func(*ctx.Context) (interface{}, int, error)) *httptest.ResponseRecorder {
+	router := httprouter.New()
+	router.Handle(r.Method, r.URL.Path, p.HandleActionFunc("things", r.Method, fn))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+type testVersionedThing struct {
+	ID string `json:"id"`
+}
+
+func (thing testVersionedThing) Version() string { return "v1" }
+
+func TestConditionalGet(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.ETag = ETagStrong
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		return map[string]string{"id": "t1"}, 0, nil
+	}
+
+	r := httptest.NewRequest("GET", "/things", nil)
+	w := serveAction(p, r, fn)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.Len() == 0 {
+		t.Errorf("Unexpected response: %d %q %s", w.Code, etag, w.Body)
+		return
+	}
+
+	r = httptest.NewRequest("GET", "/things", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = serveAction(p, r, fn)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 304, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestConditionalGetVersioned(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.ETag = ETagStrong
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		return testVersionedThing{"t1"}, 0, nil
+	}
+
+	w := serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+	etag := w.Header().Get("ETag")
+	if etag != `"v1"` {
+		t.Errorf("Expected the version as the ETag, got %q", etag)
+	}
+
+	r := httptest.NewRequest("GET", "/things", nil)
+	r.Header.Set("If-None-Match", `"other", `+etag)
+	w = serveAction(p, r, fn)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected a 304, got %d", w.Code)
+	}
+
+	// Other representations of the same version have their own ETags.
+	p.Renderers.Register("application/x-test", jsonTestRenderer{})
+	for _, path := range []string{"/things?fields=id", "/things?include=owners", "/things?filter[name]=a", "/things?sort=-name&page[size]=1"} {
+		r = httptest.NewRequest("GET", path, nil)
+		r.Header.Set("If-None-Match", etag)
+		w = serveAction(p, r, fn)
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+			t.Errorf("Expected a new representation for %s, got %d %q", path, w.Code, w.Header().Get("ETag"))
+		}
+	}
+	r = httptest.NewRequest("GET", "/things", nil)
+	r.Header.Set("Accept", "application/x-test")
+	r.Header.Set("If-None-Match", etag)
+	w = serveAction(p, r, fn)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new representation for another media type, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	// The same query always has the same tag, whatever the parameter order.
+	first := serveAction(p, httptest.NewRequest("GET", "/things?sort=name&fields=id", nil), fn).Header().Get("ETag")
+	second := serveAction(p, httptest.NewRequest("GET", "/things?fields=id&sort=name", nil), fn).Header().Get("ETag")
+	if first != second {
+		t.Errorf("Expected the same tag for the same query, got %q and %q", first, second)
+	}
+}
+
+type testThing struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Revision string `json:"revision"`
+}
+
+func (thing testThing) Version() string { return thing.Revision }
+
+// testThingUpdater updates a thing that has been changed by someone else.
+type testThingUpdater struct {
+	called bool
+}
+
+func (updater *testThingUpdater) CurrentEntity(*ctx.Context) (Versioned, error) {
+	return testThing{"t1", "new", "r2"}, nil
+}
+
+func (updater *testThingUpdater) EntityAtVersion(_ *ctx.Context, version string) (Versioned, error) {
+	return testThing{"t1", "old", version}, nil
+}
+
+func (updater *testThingUpdater) HandleAction(context *ctx.Context) (interface{}, int, error) {
+	updater.called = true
+	return ContextCurrentEntity(context), 0, nil
+}
+
+func TestIfMatch(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+
+	for _, e := range []struct {
+		IfMatch string
+		Code    int
+		Called  bool
+	}{
+		{"", http.StatusPreconditionRequired, false},
+		{`"r1"`, http.StatusPreconditionFailed, false},
+		{`"r1", W/"r2"`, http.StatusOK, true},
+		{`*`, http.StatusOK, true},
+		{`,`, http.StatusPreconditionFailed, false},
+	} {
+		updater := &testThingUpdater{}
+		router := httprouter.New()
+		router.Handle("PATCH", "/things/t1", p.HTTPHandler("things", "update", updater))
+		r := httptest.NewRequest("PATCH", "/things/t1", nil)
+		if e.IfMatch != "" {
+			r.Header.Set("If-Match", e.IfMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != e.Code || updater.called != e.Called {
+			t.Errorf("Unexpected response for %q: %d %s", e.IfMatch, w.Code, w.Body)
+			continue
+		}
+		if w.Code == http.StatusPreconditionFailed && e.IfMatch != "," {
+			apiErr := APIError{}
+			json.Unmarshal(w.Body.Bytes(), &apiErr)
+			if len(apiErr.Fields) != 2 || apiErr.Fields["name"] == "" || apiErr.Fields["revision"] == "" {
+				t.Errorf("Expected changed fields to be reported: %v", apiErr.Fields)
+			}
+		}
+		if w.Code == http.StatusOK && w.Header().Get("ETag") != `"r2"` {
+			t.Errorf("Expected the new version as the ETag, got %q", w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	router := httprouter.New()
+	router.GET("/things/:id", p.HandleActionFunc("things", "show", func(context *ctx.Context) (interface{}, int, error) {
+		id := ContextParams(context).ByName("id")
+		if id == "missing" {
+			return nil, 0, fail.NewNotFoundError(errors.New("Not found"))
+		}
+		return testThing{ID: id}, 0, nil
+	}))
+	router.POST("/batch", p.HandleBatch(router, true))
+
+	body := `[
+		{"id": "a", "method": "GET", "path": "/things/t1"},
+		{"id": "b", "method": "GET", "path": "/things/missing"},
+		{"method": "GET", "path": "/things/t2", "depends_on": ["a"]},
+		{"method": "GET", "path": "/things/t3", "depends_on": ["a", "b"]}
+	]`
+	r := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	response := struct {
+		Payload []BatchResult `json:"payload"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Errorf("Unexpected error: %s %s", err, w.Body)
+		return
+	}
+	results := response.Payload
+	if len(results) != 4 {
+		t.Errorf("Unexpected results: %s", w.Body)
+		return
+	}
+	for i, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusOK, http.StatusFailedDependency} {
+		if results[i].Status != status {
+			t.Errorf("Expected status %d for request %d, got %d", status, i, results[i].Status)
+		}
+	}
+	if string(results[2].Payload) != `{"id":"t2","name":"","revision":""}` {
+		t.Errorf("Unexpected payload: %s", results[2].Payload)
+	}
+	if results[1].Error == nil || results[1].Error.Error != "Not found" {
+		t.Errorf("Unexpected error: %+v", results[1].Error)
+	}
+
+	// Conditional headers of the batch aren't applied to its requests.
+	r = httptest.NewRequest("POST", "/batch", strings.NewReader(`[{"method": "GET", "path": "/things/t1"}]`))
+	r.Header.Set("If-None-Match", "*")
+	p.ETag = ETagStrong
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	p.ETag = ETagNone
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || len(response.Payload) != 1 || response.Payload[0].Status != http.StatusOK {
+		t.Errorf("Expected the batch's headers to be ignored, got %s", w.Body)
+	}
+
+	// Batches can't be nested, even through another batch endpoint.
+	router.POST("/other-batch", p.HandleBatch(router, false))
+	r = httptest.NewRequest("POST", "/batch", strings.NewReader(`[{"method": "POST", "path": "/batch?x=1"}]`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a nested batch to be rejected, got %d %s", w.Code, w.Body)
+	}
+	r = httptest.NewRequest("POST", "/batch", strings.NewReader(`[{"method": "POST", "path": "/other-batch", "body": [{"method": "GET", "path": "/things/t1"}]}]`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || len(response.Payload) != 1 || response.Payload[0].Status != http.StatusBadRequest {
+		t.Errorf("Expected a nested batch to fail, got %s", w.Body)
+	}
+
+	// Bodies are limited in size.
+	r = httptest.NewRequest("POST", "/batch", strings.NewReader(`[`+strings.Repeat(" ", int(MaxBatchBodySize))+`]`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a large batch to be rejected, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.SetResponseSchema("things", "GET", MustSchema(`{"type":"object","required":["id"]}`))
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		return map[string]string{"name": "t1"}, 0, nil
+	}
+
+	for mode, code := range map[ResponseValidationMode]int{
+		ResponseValidationNone: http.StatusOK,
+		ResponseValidationLog:  http.StatusOK,
+		ResponseValidationFail: http.StatusInternalServerError,
+	} {
+		p.ResponseValidation = mode
+		w := serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+		if w.Code != code {
+			t.Errorf("Expected %d for mode %d, got %d %s", code, mode, w.Code, w.Body)
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+
+	r := httptest.NewRequest("GET", "/things", nil)
+	w := serveAction(p, r, func(*ctx.Context) (interface{}, int, error) {
+		panic("boom")
+	})
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "An unexpected error occurred") {
+		t.Errorf("Expected a private error, got %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the negotiated renderer, got %s", w.Header().Get("Content-Type"))
+	}
+
+	// Panics after the response has started abort it, rather than writing a
+	// second response.
+	defer func(size int) { StreamChunkSize = size }(StreamChunkSize)
+	StreamChunkSize = 1
+	r = httptest.NewRequest("GET", "/things", nil)
+	w = httptest.NewRecorder()
+	handler := p.HandleActionFunc("things", "GET", func(*ctx.Context) (interface{}, int, error) {
+		sent := false
+		return StreamFunc(func(*ctx.Context) (interface{}, bool, error) {
+			if sent {
+				panic(errors.New("boom"))
+			}
+			sent = true
+			return testThing{ID: "1"}, true, nil
+		}), 0, nil
+	})
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("Expected the response to be aborted, got %v", recovered)
+			}
+		}()
+		handler(w, r, nil)
+	}()
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "error") {
+		t.Errorf("Expected only the started response, got %d %s", w.Code, w.Body)
+	}
+
+	counter := p.MetricsRegistry.Get("things-GET-panic").(metrics.Counter)
+	if counter.Count() != 2 {
+		t.Errorf("Expected 2 panics to be counted, got %d", counter.Count())
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	entry := fail.RegisterCode(fail.ErrorCode{
+		Code:        9001,
+		Name:        "out_of_stock",
+		Status:      http.StatusConflict,
+		Description: "The thing is out of stock.",
+		DocsURL:     "https://example.com/errors/out_of_stock",
+	})
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	w := serveAction(p, httptest.NewRequest("POST", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		return nil, 0, entry.Errorf("Thing %d is out of stock", 1)
+	})
+	expected := `{"code":9001,"description":"The thing is out of stock.","error":"Thing 1 is out of stock","docs_url":"https://example.com/errors/out_of_stock"}`
+	if w.Code != http.StatusConflict || w.Body.String() != expected {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body)
+	}
+
+	// Policy codes are catalogued, and their errors use the catalogued
+	// descriptions.
+	if entry, ok := fail.LookupCode(ErrorCodeRoleRequired); !ok || entry.Status != http.StatusForbidden {
+		t.Errorf("Expected the role required code to be catalogued, got %+v", entry)
+	}
+	if err := fail.NewPermissionsError(ErrorCodeAccessDenied, "Denied"); err.Description != "You don’t have permission to do that." {
+		t.Errorf("Unexpected description %s", err.Description)
+	}
+	if fields := fail.NewPermissionsError(ErrorCodeAccessDenied, "Denied").ErrorFields(); fields["error_code"] != "2004" {
+		t.Errorf("Expected the code to still be in the error_code field, got %v", fields)
+	}
+	if _, ok := fail.NewCodedError(9002, errors.New("unknown")).(*fail.Private); !ok {
+		t.Errorf("Expected an unregistered code to be private")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected registering a duplicate code to panic")
+			}
+		}()
+		fail.RegisterCode(fail.ErrorCode{Code: 9001, Name: "duplicate", Status: http.StatusBadRequest})
+	}()
+
+	codes := fail.Codes()
+	for i := 1; i < len(codes); i++ {
+		if codes[i-1].Code >= codes[i].Code {
+			t.Errorf("Expected codes to be sorted, got %v", codes)
+		}
+	}
+}
+
+func TestWrappedErrors(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	validationErr := fail.NewValidationError(errors.New("Invalid thing"))
+	validationErr.WithField("name", "Required")
+
+	for name, test := range map[string]struct {
+		err      error
+		code     int
+		expected string
+	}{
+		"wrapped": {
+			fmt.Errorf("loading thing: %w", fail.NewNotFoundError(errors.New("Thing not found"))),
+			http.StatusNotFound,
+			`{"error":"Thing not found"}`,
+		},
+		"traced": {
+			fail.Trace(validationErr),
+			http.StatusUnprocessableEntity,
+			`{"error":"Invalid thing","fields":{"name":"Required"}}`,
+		},
+		"joined": {
+			errors.Join(errors.New("closing rows"), fmt.Errorf("loading thing: %w", fail.NewNotFoundError(errors.New("Thing not found")))),
+			http.StatusNotFound,
+			`{"error":"Thing not found"}`,
+		},
+		"challenge": {
+			fmt.Errorf("authenticating: %w", fail.AuthenticationError{Err: fail.Err{OriginalError: errors.New("Denied")}, Challenge: "Bearer"}),
+			http.StatusUnauthorized,
+			`{"error":"Denied"}`,
+		},
+	} {
+		err := test.err
+		w := serveAction(p, httptest.NewRequest("GET", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+			return nil, 0, err
+		})
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("%s: unexpected response %d %s", name, w.Code, w.Body)
+		}
+		if name == "challenge" && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: expected the challenge header", name)
+		}
+	}
+
+	// Errors masked by a private error aren't exposed.
+	w := serveAction(p, httptest.NewRequest("GET", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		return nil, 0, fmt.Errorf("wrapped: %w", fail.NewPrivate(validationErr))
+	})
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "Required") {
+		t.Errorf("Expected a private error, got %d %s", w.Code, w.Body)
+	}
+	w = serveAction(p, httptest.NewRequest("GET", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		return nil, 0, errors.Join(errors.New("closing rows"), fail.NewPrivate(validationErr))
+	})
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "Required") {
+		t.Errorf("Expected a joined private error, got %d %s", w.Code, w.Body)
+	}
+
+	traced := fail.Trace(fmt.Errorf("wrapped: %w", fail.NewNotFoundError(errors.New("missing")))).(error)
+	if !errors.Is(traced, fail.ErrNotFound) || errors.Is(traced, fail.ErrValidation) {
+		t.Errorf("Expected the traced error to only be a not found error")
+	}
+	var notFound fail.NotFoundError
+	if !errors.As(traced, &notFound) || notFound.Error() != "missing" {
+		t.Errorf("Expected to find the not found error, got %v", notFound)
+	}
+	if !errors.Is(fail.NewPrivate(traced), fail.ErrPrivate) {
+		t.Errorf("Expected a private error to match ErrPrivate")
+	}
+}
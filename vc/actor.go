@@ -1,6 +1,10 @@
 package vc
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/snikch/api/ctx"
+)
 
 // Actor represents a request actor, and is generally either an oauth client or user.
 type Actor interface {
@@ -13,3 +17,20 @@ func ActorID(actor Actor) string {
 	id, typ := actor.ActorInfo()
 	return fmt.Sprintf("%s:%s", id, typ)
 }
+
+// Authenticator implementers identify the actor making a request. A nil actor
+// and error means the request is anonymous.
+type Authenticator interface {
+	Authenticate(*ctx.Context) (Actor, error)
+}
+
+// SetContextActor sets the actor making the request on the context.
+func SetContextActor(context *ctx.Context, actor Actor) {
+	context.Set(actorContextKey, actor)
+}
+
+// ContextActor returns the actor making the request, if there is one.
+func ContextActor(context *ctx.Context) (Actor, bool) {
+	actor, ok := context.Get(actorContextKey).(Actor)
+	return actor, ok
+}
@@ -0,0 +1,295 @@
+package vc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// MaxBatchRequests is the largest number of requests allowed in one batch.
+var MaxBatchRequests = 50
+
+// MaxBatchBodySize is the largest batch request body, in bytes.
+var MaxBatchBodySize int64 = 1 << 20
+
+// BatchRequest represents a single request within a batch.
+type BatchRequest struct {
+	// ID identifies the request within the batch so that other requests can
+	// depend on it, and is returned with its result.
+	ID     string            `json:"id,omitempty"`
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Body   json.RawMessage   `json:"body,omitempty"`
+	Header map[string]string `json:"headers,omitempty"`
+	// DependsOn lists the ids of earlier requests that must succeed before
+	// this request is run. If any of them fail, this request is not run.
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// BatchResult represents the response to a single request within a batch.
+type BatchResult struct {
+	ID       string          `json:"id,omitempty"`
+	Status   int             `json:"status"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Sideload json.RawMessage `json:"related,omitempty"`
+	Error    *APIError       `json:"error,omitempty"`
+}
+
+// BatchHandler is an ActionHandler that runs a json array of BatchRequests
+// against an http.Handler, usually the router the batched actions are
+// registered on, and returns a BatchResult for each.
+type BatchHandler struct {
+	Handler http.Handler
+	// Parallel runs requests concurrently, other than those waiting on a
+	// dependency. Otherwise requests are run in the order supplied.
+	Parallel bool
+	// MaxConcurrency limits the number of requests run at once when running
+	// in parallel. Zero means no limit.
+	MaxConcurrency int
+}
+
+// HandleBatch returns a handler for a batch endpoint that runs requests
+// against the supplied http.Handler. Each request is run in-process with the
+// batch request's headers, and must render json.
+func (p *ActionProcessor) HandleBatch(handler http.Handler, parallel bool) httprouter.Handle {
+	return p.HTTPHandler("batch", "create", &BatchHandler{
+		Handler:  handler,
+		Parallel: parallel,
+	})
+}
+
+// HandleAction implements the ActionHandler interface.
+func (batch *BatchHandler) HandleAction(context *ctx.Context) (interface{}, int, error) {
+	if context.Request == nil || context.Request.Body == nil {
+		return nil, 0, fail.NewBadRequestError(errors.New("No batch requests supplied"))
+	}
+	// Batches can't be run from within a batch, as each level would multiply
+	// the number of requests run.
+	if nested, _ := context.Value(batchContextKey).(bool); nested {
+		return nil, 0, fail.NewBadRequestError(errors.New("Batches cannot be nested"))
+	}
+	context.Set(batchContextKey, true)
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, context.Request.Body, MaxBatchBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, 0, fail.NewBadRequestError(fmt.Errorf("A batch must be at most %d bytes", MaxBatchBodySize))
+		}
+		return nil, 0, err
+	}
+	requests := []BatchRequest{}
+	if err := json.Unmarshal(body, &requests); err != nil {
+		return nil, 0, fail.NewBadRequestError(err)
+	}
+	if err := validateBatch(requests, context.Request.URL.Path); err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]BatchResult, len(requests))
+	if !batch.Parallel {
+		for i := range requests {
+			results[i] = batch.run(context, requests, results, i)
+		}
+		return results, http.StatusOK, nil
+	}
+
+	// Each request waits on its dependencies' done channels before running.
+	done := make([]chan struct{}, len(requests))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	var limit chan struct{}
+	if batch.MaxConcurrency > 0 {
+		limit = make(chan struct{}, batch.MaxConcurrency)
+	}
+	indexes := batchIndexes(requests)
+	for i := range requests {
+		go func(i int) {
+			defer close(done[i])
+			for _, id := range requests[i].DependsOn {
+				<-done[indexes[id]]
+			}
+			if limit != nil {
+				limit <- struct{}{}
+				defer func() { <-limit }()
+			}
+			results[i] = batch.run(context, requests, results, i)
+		}(i)
+	}
+	for i := range done {
+		<-done[i]
+	}
+	return results, http.StatusOK, nil
+}
+
+// validateBatch ensures the batch is within limits, that every request has a
+// method and path other than the batch's own, and that dependencies refer to
+// earlier requests.
+func validateBatch(requests []BatchRequest, batchPath string) error {
+	if len(requests) == 0 || len(requests) > MaxBatchRequests {
+		return fail.NewBadRequestError(fmt.Errorf("A batch must contain from 1 to %d requests", MaxBatchRequests))
+	}
+	invalid := map[string]string{}
+	seen := map[string]bool{}
+	for i, request := range requests {
+		key := fmt.Sprintf("%d", i)
+		switch {
+		case request.Method == "":
+			invalid[key] = "A method is required"
+		case !strings.HasPrefix(request.Path, "/"):
+			invalid[key] = "An absolute path is required"
+		case strings.SplitN(request.Path, "?", 2)[0] == batchPath:
+			invalid[key] = "Batches cannot be nested"
+		case request.ID != "" && seen[request.ID]:
+			invalid[key] = fmt.Sprintf("The id %s is used more than once", request.ID)
+		}
+		for _, id := range request.DependsOn {
+			if !seen[id] {
+				invalid[key] = fmt.Sprintf("Dependency %s must be an earlier request in the batch", id)
+			}
+		}
+		if request.ID != "" {
+			seen[request.ID] = true
+		}
+	}
+	if len(invalid) > 0 {
+		err := fail.NewValidationError(errors.New("Invalid batch requests"))
+		err.AdditionalFields = invalid
+		return err
+	}
+	return nil
+}
+
+// batchIndexes returns a lookup of request id to its index in the batch.
+func batchIndexes(requests []BatchRequest) map[string]int {
+	indexes := map[string]int{}
+	for i, request := range requests {
+		if request.ID != "" {
+			indexes[request.ID] = i
+		}
+	}
+	return indexes
+}
+
+// batchOnlyHeaders are the headers of a batch request that aren't copied to
+// the requests in it, as they describe the batch request itself. Requests can
+// set their own.
+var batchOnlyHeaders = map[string]bool{
+	"Content-Length":      true,
+	IdempotencyKeyHeader:  true,
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+	"If-Range":            true,
+}
+
+// run runs a single request in the batch and returns its result. Requests
+// with a failed dependency are not run, and return a 424.
+func (batch *BatchHandler) run(context *ctx.Context, requests []BatchRequest, results []BatchResult, i int) BatchResult {
+	request := requests[i]
+	result := BatchResult{
+		ID: request.ID,
+	}
+
+	indexes := batchIndexes(requests)
+	for _, id := range request.DependsOn {
+		if status := results[indexes[id]].Status; status >= http.StatusBadRequest {
+			result.Status = http.StatusFailedDependency
+			result.Error = &APIError{
+				Error:       "Failed dependency",
+				Description: fmt.Sprintf("This request depends on %s, which failed with a %d", id, status),
+			}
+			return result
+		}
+	}
+
+	r, err := http.NewRequest(strings.ToUpper(request.Method), request.Path, bytes.NewReader(request.Body))
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = &APIError{Error: err.Error()}
+		return result
+	}
+	// Requests run with the batch's headers, such as authorization, and are
+	// cancelled along with the batch. Headers that only apply to the batch
+	// request itself aren't copied.
+	r = r.WithContext(context)
+	for key, values := range context.Request.Header {
+		if !batchOnlyHeaders[key] {
+			r.Header[key] = values
+		}
+	}
+	for key, value := range request.Header {
+		r.Header.Set(key, value)
+	}
+	r.Header.Set("Accept", "application/json")
+	r.RemoteAddr = context.Request.RemoteAddr
+
+	w := newBatchResponseWriter()
+	batch.Handler.ServeHTTP(w, r)
+	result.Status = w.code
+	if w.body.Len() == 0 {
+		return result
+	}
+
+	if result.Status >= http.StatusBadRequest {
+		result.Error = &APIError{}
+		if err := json.Unmarshal(w.body.Bytes(), result.Error); err != nil {
+			result.Error.Error = w.body.String()
+		}
+		return result
+	}
+	response := struct {
+		Payload  json.RawMessage `json:"payload"`
+		Sideload json.RawMessage `json:"related"`
+	}{}
+	if err := json.Unmarshal(w.body.Bytes(), &response); err != nil || response.Payload == nil {
+		// Not a vc.Response, so return the body as the payload if it's json.
+		if json.Valid(w.body.Bytes()) {
+			result.Payload = json.RawMessage(w.body.Bytes())
+		}
+		return result
+	}
+	result.Payload = response.Payload
+	result.Sideload = response.Sideload
+	return result
+}
+
+// batchResponseWriter is an http.ResponseWriter that records a response.
+type batchResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+// newBatchResponseWriter returns an initialized batchResponseWriter.
+func newBatchResponseWriter() *batchResponseWriter {
+	return &batchResponseWriter{
+		header: http.Header{},
+		code:   http.StatusOK,
+	}
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *batchResponseWriter) Write(bytes []byte) (int, error) {
+	return w.body.Write(bytes)
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *batchResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
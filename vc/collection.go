@@ -0,0 +1,84 @@
+package vc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Collection declares how collections of an entity type may be ordered and
+// limited by clients.
+type Collection struct {
+	// SortableColumns are the columns a client may sort by.
+	SortableColumns []string
+	// DefaultSort is used when a client doesn't supply a sort, in the same
+	// format as the sort query parameter, e.g. "-created_at,id".
+	DefaultSort string
+	// DefaultLimit is used when a client doesn't supply a limit. If zero,
+	// the package level DefaultLimit is used.
+	DefaultLimit int
+	// MaxLimit is the largest limit a client may request. If zero, the
+	// package level MaxLimit is used.
+	MaxLimit int
+}
+
+// sortable returns true if the column is in the sortable columns.
+func (collection Collection) sortable(column string) bool {
+	for _, sortable := range collection.SortableColumns {
+		if sortable == column {
+			return true
+		}
+	}
+	return false
+}
+
+var collectionRegistry = map[string]Collection{}
+
+// RegisterCollection declares the ordering and limits for collections of the
+// entity type. The type is the same name passed to HTTPHandler. Criteria for
+// types without a registered collection aren't sorted, and invalid sort, limit
+// and from parameters are ignored rather than rejected, so handlers can parse
+// them themselves.
+func RegisterCollection(typ string, collection Collection) {
+	collectionRegistry[typ] = collection
+}
+
+// Order represents a single column a collection should be ordered by.
+type Order struct {
+	Column    string
+	Ascending bool
+}
+
+// parseSort parses a sort parameter such as "-created_at,name" into orders.
+// Columns prefixed with a minus are sorted in descending order.
+func parseSort(sort string) ([]Order, error) {
+	orders := []Order{}
+	seen := map[string]bool{}
+	for _, column := range strings.Split(sort, ",") {
+		column = strings.TrimSpace(column)
+		order := Order{
+			Column:    strings.TrimPrefix(column, "-"),
+			Ascending: !strings.HasPrefix(column, "-"),
+		}
+		if order.Column == "" {
+			return nil, fmt.Errorf("Empty sort column")
+		}
+		if seen[order.Column] {
+			return nil, fmt.Errorf("Column %s is sorted more than once", order.Column)
+		}
+		seen[order.Column] = true
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// sortString returns the canonical sort parameter for the orders.
+func sortString(orders []Order) string {
+	columns := make([]string, len(orders))
+	for i, order := range orders {
+		columns[i] = order.Column
+		if !order.Ascending {
+			columns[i] = "-" + order.Column
+		}
+	}
+	return strings.Join(columns, ",")
+}
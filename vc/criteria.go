@@ -1,10 +1,14 @@
 package vc
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
 )
 
 // Criteria defines how results should be modified, or filtered.
@@ -12,14 +16,34 @@ type Criteria struct {
 	// Sideload is a slice of related entities to sideload.
 	Sideload []string
 	// OrderColumn defines the order that collections should be ordered by.
+	// This is the first column in Order, for handlers that only support
+	// ordering by a single column.
 	OrderColumn    *string
 	OrderAscending bool
+	// Order is every column collections should be ordered by, in priority.
+	Order []Order
 	// From represents a time that entities should have been updated after.
 	From *time.Time
 	// Limit is the number of results in a collection
 	Limit int
 	// State is an array of item states to filter by
 	State []string
+	// After is a cursor that results should start after.
+	After *Cursor
+	// Before is a cursor that results should finish before.
+	Before *Cursor
+	// Filters are conditions that every result should match.
+	Filters []Filter
+	// Fields restricts the fields rendered for each entity type. Fields from
+	// a plain fields parameter are keyed by an empty string, and apply to the
+	// primary payload.
+	Fields map[string][]string
+	// invalidFilters holds malformed filter parameters, for reporting once
+	// the filters are validated against the entity type.
+	invalidFilters map[string]string
+	// typ and sort are the entity type and sort the criteria was generated
+	// for, which cursors are bound to.
+	typ, sort string
 }
 
 // ShouldSideload returns true if the supplied name is in the sideload list.
@@ -40,11 +64,67 @@ var SideloadQueryKey = "include"
 // entity states should be returned.
 var StateQueryKey = "state"
 
-// RequestCriteria generates a criteria instance from the request.
+// PageAfterQueryKey, PageBeforeQueryKey and PageSizeQueryKey are the names of
+// the query parameters used for cursor pagination.
+var (
+	PageAfterQueryKey  = "page[after]"
+	PageBeforeQueryKey = "page[before]"
+	PageSizeQueryKey   = "page[size]"
+)
+
+// SortQueryKey, LimitQueryKey and FromQueryKey are the names of the query
+// parameters that determine ordering, limits and a time to return entities
+// updated after. The page[size] parameter is an alias of limit.
+var (
+	SortQueryKey  = "sort"
+	LimitQueryKey = "limit"
+	FromQueryKey  = "from"
+)
+
+// DefaultLimit is the limit used when neither the client nor the entity type's
+// collection supply one. Zero means no limit.
+var DefaultLimit = 0
+
+// MaxLimit is the largest limit a client may request, unless the entity type's
+// collection supplies its own.
+var MaxLimit = 100
+
+// RequestCriteria generates a criteria instance from the request. Invalid
+// parameters are ignored, so use RequestTypeCriteria to report them.
 func RequestCriteria(r *http.Request) *Criteria {
+	criteria, _, _ := requestCriteria(r, "")
+	return criteria
+}
+
+// RequestTypeCriteria generates a criteria instance from the request. The type
+// is the entity type being requested, and determines the sortable columns and
+// limits registered via RegisterCollection. Invalid parameters are returned as
+// a fail.BadRequestError listing each of them. Cursors can't be used without a
+// CursorSecret, which is a private error, as the server is misconfigured.
+func RequestTypeCriteria(r *http.Request, typ string) (*Criteria, error) {
+	criteria, invalid, err := requestCriteria(r, typ)
+	if err != nil {
+		return nil, fail.NewPrivate(err)
+	}
+	if len(invalid) > 0 {
+		err := fail.NewBadRequestError(errors.New("Invalid query parameters"))
+		err.Description = "One or more query parameters couldn’t be understood. Check the fields listed, and note that pagination parameters should be copied from the links in a previous response, rather than constructed by hand."
+		err.WithFields(invalid)
+		return nil, err
+	}
+	return criteria, nil
+}
+
+// requestCriteria generates a criteria instance from the request, along with
+// any invalid parameters, keyed by name. Invalid values aren't set on the
+// criteria. An error is also returned for a server failure, such as a missing
+// CursorSecret.
+func requestCriteria(r *http.Request, typ string) (*Criteria, map[string]string, error) {
+	query := r.URL.Query()
 	criteria := Criteria{
-		Sideload: r.URL.Query()[SideloadQueryKey],
-		State:    r.URL.Query()[StateQueryKey],
+		Sideload: query[SideloadQueryKey],
+		State:    query[StateQueryKey],
+		typ:      typ,
 	}
 	// Prevent overloading of the sideload and state criteria.
 	if len(criteria.Sideload) > 100 {
@@ -53,7 +133,121 @@ func RequestCriteria(r *http.Request) *Criteria {
 	if len(criteria.State) > 100 {
 		criteria.State = nil
 	}
-	return &criteria
+	criteria.Fields = requestFields(query)
+	criteria.Filters, criteria.invalidFilters = requestFilters(query)
+
+	// Collect every invalid parameter so they can be reported together.
+	invalid := map[string]string{}
+
+	collection, registered := collectionRegistry[typ]
+
+	// Limits fall back to the collection, then package defaults.
+	maxLimit := MaxLimit
+	if collection.MaxLimit > 0 {
+		maxLimit = collection.MaxLimit
+	}
+	criteria.Limit = DefaultLimit
+	if collection.DefaultLimit > 0 {
+		criteria.Limit = collection.DefaultLimit
+	}
+	for _, key := range []string{PageSizeQueryKey, LimitQueryKey} {
+		size := query.Get(key)
+		if size == "" {
+			continue
+		}
+		limit, err := strconv.Atoi(size)
+		if err != nil || limit < 1 || limit > maxLimit {
+			invalid[key] = "Must be a number from 1 to " + strconv.Itoa(maxLimit)
+			break
+		}
+		criteria.Limit = limit
+		break
+	}
+
+	// Sorting is only allowed on columns the collection declares sortable.
+	sort := query.Get(SortQueryKey)
+	if sort == "" {
+		sort = collection.DefaultSort
+	}
+	if sort != "" {
+		orders, err := parseSort(sort)
+		switch {
+		case err != nil:
+			invalid[SortQueryKey] = err.Error()
+		case !registered:
+			// Without sortable columns, sorting is left to the handler.
+			orders = nil
+		default:
+			unsortable := []string{}
+			for _, order := range orders {
+				if !collection.sortable(order.Column) {
+					unsortable = append(unsortable, order.Column)
+				}
+			}
+			if len(unsortable) > 0 {
+				invalid[SortQueryKey] = "Cannot sort by " + strings.Join(unsortable, ", ")
+			}
+		}
+		if _, ok := invalid[SortQueryKey]; !ok && len(orders) > 0 {
+			criteria.Order = orders
+			criteria.OrderColumn = &orders[0].Column
+			criteria.OrderAscending = orders[0].Ascending
+		}
+		criteria.sort = sort
+		if err == nil {
+			criteria.sort = sortString(orders)
+		}
+	}
+
+	// Cursors are only accepted for the type, sort and direction they were
+	// issued for.
+	var secretErr error
+	for _, page := range []struct {
+		key       string
+		cursor    **Cursor
+		backwards bool
+	}{
+		{PageAfterQueryKey, &criteria.After, false},
+		{PageBeforeQueryKey, &criteria.Before, true},
+	} {
+		token := query.Get(page.key)
+		if token == "" {
+			continue
+		}
+		cursor, err := ParseCursor(token)
+		switch {
+		case err == ErrNoCursorSecret:
+			secretErr = err
+		case err != nil:
+			invalid[page.key] = err.Error()
+		case !cursor.matches(typ, criteria.sort, page.backwards):
+			invalid[page.key] = "Cursor is for a different collection, sort or direction"
+		default:
+			*page.cursor = cursor
+		}
+	}
+	if criteria.After != nil && criteria.Before != nil {
+		invalid[PageBeforeQueryKey] = "Cannot be combined with " + PageAfterQueryKey
+		criteria.Before = nil
+	}
+
+	if from := query.Get(FromQueryKey); from != "" {
+		fromTime, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			invalid[FromQueryKey] = "Must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z"
+		} else {
+			criteria.From = &fromTime
+		}
+	}
+
+	// Types without a registered collection may parse these parameters
+	// themselves, so invalid values are ignored rather than rejected.
+	if !registered {
+		for _, key := range []string{PageSizeQueryKey, LimitQueryKey, SortQueryKey, FromQueryKey} {
+			delete(invalid, key)
+		}
+	}
+	return &criteria, invalid, secretErr
 }
 
 // SetContextCriteria sets the criteria against a context.
@@ -0,0 +1,79 @@
+package vc
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/snikch/api/fail"
+)
+
+func TestRequestCriteriaOrdering(t *testing.T) {
+	RegisterCollection("orders", Collection{
+		SortableColumns: []string{"created_at", "name"},
+		DefaultLimit:    20,
+		MaxLimit:        50,
+	})
+
+	r, _ := http.NewRequest("GET", "/orders?sort=-created_at,name&from=2016-01-02T15:04:05Z", nil)
+	criteria, err := RequestTypeCriteria(r, "orders")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if !reflect.DeepEqual(criteria.Order, []Order{{"created_at", false}, {"name", true}}) {
+		t.Errorf("Unexpected order: %+v", criteria.Order)
+	}
+	if *criteria.OrderColumn != "created_at" || criteria.OrderAscending {
+		t.Errorf("Unexpected order column: %s %t", *criteria.OrderColumn, criteria.OrderAscending)
+	}
+	if criteria.Limit != 20 {
+		t.Errorf("Expected the default limit, got %d", criteria.Limit)
+	}
+	if !criteria.From.Equal(time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Errorf("Unexpected from: %s", criteria.From)
+	}
+}
+
+func TestRequestCriteriaOrderingInvalid(t *testing.T) {
+	RegisterCollection("orders", Collection{
+		SortableColumns: []string{"created_at"},
+		MaxLimit:        50,
+	})
+
+	r, _ := http.NewRequest("GET", "/orders?sort=-created_at,secret&limit=51&from=yesterday", nil)
+	_, err := RequestTypeCriteria(r, "orders")
+	badRequest, ok := err.(fail.BadRequestError)
+	if !ok {
+		t.Errorf("Expected a BadRequestError, got %v", err)
+		return
+	}
+	for _, key := range []string{SortQueryKey, LimitQueryKey, FromQueryKey} {
+		if _, ok := badRequest.ErrorFields()[key]; !ok {
+			t.Errorf("Expected %s to be invalid: %v", key, badRequest.ErrorFields())
+		}
+	}
+
+	// Types without a collection leave these parameters to their handlers.
+	r, _ = http.NewRequest("GET", "/unregistered?sort=name&limit=500&page[size]=500&from=yesterday", nil)
+	criteria, err := RequestTypeCriteria(r, "unregistered")
+	if err != nil {
+		t.Errorf("Expected an unregistered type's parameters to be ignored, got %v", err)
+		return
+	}
+	if criteria.Order != nil || criteria.Limit != DefaultLimit || criteria.From != nil {
+		t.Errorf("Expected no ordering, limit or from, got %+v", criteria)
+	}
+}
+
+func TestRequestCriteriaIgnoresInvalid(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/things?include=owner&state=open&page[size]=0&page[after]=nope", nil)
+	criteria := RequestCriteria(r)
+	if !reflect.DeepEqual(criteria.Sideload, []string{"owner"}) || !reflect.DeepEqual(criteria.State, []string{"open"}) {
+		t.Errorf("Unexpected criteria: %+v", criteria)
+	}
+	if criteria.Limit != DefaultLimit || criteria.After != nil {
+		t.Errorf("Expected invalid parameters to be ignored: %+v", criteria)
+	}
+}
@@ -1,7 +1,9 @@
 package vc
 
 import (
+	"errors"
 	"net/http"
+	"reflect"
 
 	"github.com/sirupsen/logrus"
 	"github.com/snikch/api/fail"
@@ -32,12 +34,34 @@ type AnnotatedError interface {
 	ErrorFields() map[string]string
 }
 
+// FieldErrorsError defines an interface for an error with every problem found
+// with the fields of a request, such as a fail.MultiError. Unlike the flat
+// fields of an AnnotatedError, a field can have several problems, each with a
+// machine readable code, and fields are identified by JSON pointers so fields
+// of nested objects and array elements can be reported.
+type FieldErrorsError interface {
+	FieldErrors() fail.FieldErrors
+}
+
 // StructuredLogsError defines an interface for additional metadata for an error.
 // This metadata will be logged, but not output to the public error response.
 type StructuredLogsError interface {
 	LogFields() map[string]string
 }
 
+// CodedError defines an interface for an error with a stable code, usually one
+// registered in the fail error code catalog. The code is returned as a first
+// class member of the error response, so clients can rely on it.
+type CodedError interface {
+	ErrorCode() int
+}
+
+// HeaderError defines an interface for headers that should be returned with an
+// error response, such as a WWW-Authenticate challenge.
+type HeaderError interface {
+	ErrorHeaders() map[string]string
+}
+
 // APIError represents an API error response. This will be passed to a renderer
 // error method for conversion into an appropriate response.
 type APIError struct {
@@ -45,35 +69,102 @@ type APIError struct {
 	Description string            `json:"description,omitempty"`
 	Error       string            `json:"error"`
 	Fields      map[string]string `json:"fields,omitempty"`
+	// DocsURL links to the documentation of the error's code, if it is in
+	// the fail error code catalog.
+	DocsURL string `json:"docs_url,omitempty"`
+	// Errors lists every problem with the request's fields. Fields still holds
+	// them flattened, for clients that predate it.
+	Errors fail.FieldErrors `json:"errors,omitempty"`
 }
 
 // RespondWithError will return an error response with the appropriate message,
-// and status codes set.
+// and status codes set, using the default renderer.
 func RespondWithError(w http.ResponseWriter, r *http.Request, err error) {
+	RespondWithRenderedError(DefaultRenderer, w, r, err)
+}
+
+// RespondWithRenderedError will return an error response rendered by the
+// supplied renderer, with the appropriate message, and status codes set.
+func RespondWithRenderedError(renderer Renderer, w http.ResponseWriter, r *http.Request, err error) {
+	respondWithRenderedError(renderer, w, r, err, false)
+}
+
+// respondWithRenderedError writes the error response, reporting whether the
+// error was recovered from a panic.
+func respondWithRenderedError(renderer Renderer, w http.ResponseWriter, r *http.Request, err error, panicked bool) {
+	// Requests handled by an ActionProcessor may use problem details instead.
+	if requestErrorFormat(r) == ErrorFormatProblem {
+		respondWithProblem(w, r, err, panicked)
+		return
+	}
+	errorResponse, code, _ := logAPIError(r, err, panicked)
+	setErrorHeaders(w, err)
+	setContentType(renderer, w.Header())
+	w.WriteHeader(code)
+	w.Write(renderer.RenderError(errorResponse))
+}
+
+// setErrorHeaders sets any headers the error should be returned with.
+func setErrorHeaders(w http.ResponseWriter, err error) {
+	var headerErr HeaderError
+	if findError(err, &headerErr) {
+		for key, value := range headerErr.ErrorHeaders() {
+			w.Header().Set(key, value)
+		}
+	}
+}
+
+// logAPIError logs and reports the error, and returns the APIError and status
+// code that should be returned for it, along with the error as it is returned.
+// Errors without a status code are considered private, and are replaced with
+// a fail.Private error.
+func logAPIError(r *http.Request, err error, panicked bool) (APIError, int, error) {
 	isPublicError := false
 	errorResponse := APIError{
 		Error: err.Error(),
 	}
 	code := http.StatusInternalServerError
-	if statusErr, ok := err.(StatusError); ok {
+	var statusErr StatusError
+	if findError(err, &statusErr) {
 		// If we get a status code, this error can be considered a public error.
+		// Its own message is returned, rather than that of any error wrapping
+		// it, which may include a stack trace.
 		isPublicError = true
 		code = statusErr.StatusCode()
+		if publicErr, ok := statusErr.(error); ok {
+			errorResponse.Error = publicErr.Error()
+		}
+	}
+
+	var codedErr CodedError
+	if findError(err, &codedErr) && codedErr.ErrorCode() != 0 {
+		errorResponse.Code = codedErr.ErrorCode()
+		if entry, ok := fail.LookupCode(errorResponse.Code); ok {
+			errorResponse.DocsURL = entry.DocsURL
+		}
 	}
 
-	if descriptiveErr, ok := err.(DescriptiveError); ok {
+	var descriptiveErr DescriptiveError
+	if findError(err, &descriptiveErr) {
 		errorResponse.Description = descriptiveErr.ErrorDescription()
 	}
 
-	if annotatedErr, ok := err.(AnnotatedError); ok {
+	var annotatedErr AnnotatedError
+	if findError(err, &annotatedErr) {
 		errorResponse.Fields = annotatedErr.ErrorFields()
 	}
 
-	w.WriteHeader(code)
+	var fieldErrorsErr FieldErrorsError
+	if findError(err, &fieldErrorsErr) {
+		errorResponse.Errors = fieldErrorsErr.FieldErrors()
+	}
 
-	// Now log some information about the failure.
+	// Now log some information about the failure. Logs aren't returned to the
+	// client, so unlike the response, they may include fields from errors
+	// masked by a private error.
 	logData := map[string]interface{}{}
-	if structuredLogErr, ok := err.(StructuredLogsError); ok {
+	var structuredLogErr StructuredLogsError
+	if errors.As(err, &structuredLogErr) {
 		for key, value := range structuredLogErr.LogFields() {
 			logData[key] = value
 		}
@@ -86,9 +177,47 @@ func RespondWithError(w http.ResponseWriter, r *http.Request, err error) {
 		errorResponse.Error = err.Error()
 	}
 
-	body := DefaultRenderer.RenderError(errorResponse)
-	w.Write(body)
-
 	log.WithError(err).WithFields(logrus.Fields(logData)).Error("Returning error response")
+	reportError(r, err, code, panicked)
+	return errorResponse, code, err
+}
+
+// findError finds the first error in err's tree that can be assigned to the
+// target, which must be a pointer to an interface, like errors.As. The tree is
+// searched depth first, including errors joined with errors.Join. Unlike
+// errors.As, the search doesn't go past a fail.Private error, as the errors it
+// wraps are masked and must not be exposed in a response.
+func findError(err error, target interface{}) bool {
+	value := reflect.ValueOf(target).Elem()
+	return visitErrors(err, func(err error) bool {
+		if reflect.TypeOf(err).AssignableTo(value.Type()) {
+			value.Set(reflect.ValueOf(err))
+			return true
+		}
+		return false
+	})
+}
 
+// visitErrors calls visit with each error in err's tree, depth first, until it
+// returns true. Errors wrapped by a fail.Private error aren't visited.
+func visitErrors(err error, visit func(error) bool) bool {
+	if err == nil {
+		return false
+	}
+	if visit(err) {
+		return true
+	}
+	switch wrapper := err.(type) {
+	case fail.Private, *fail.Private:
+		return false
+	case interface{ Unwrap() error }:
+		return visitErrors(wrapper.Unwrap(), visit)
+	case interface{ Unwrap() []error }:
+		for _, wrapped := range wrapper.Unwrap() {
+			if visitErrors(wrapped, visit) {
+				return true
+			}
+		}
+	}
+	return false
 }
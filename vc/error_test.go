@@ -0,0 +1,50 @@
+package vc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+func TestMultiErrorResponse(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+
+	schemaErr := fail.NewValidationError(errors.New("Invalid thing"))
+	schemaErr.WithField("owner.name", "Required")
+	other := fail.NewMultiError(errors.New("Invalid items"))
+	other.Add(fail.FieldPath("items", 0, "sku"), "required", "Required")
+	multiErr := fail.NewMultiError(errors.New("Invalid thing"))
+	multiErr.Add("/name", "too_short", "Too short")
+	multiErr.Add("/name", "format", "Must be letters")
+	multiErr.Merge(schemaErr)
+	multiErr.Merge(fmt.Errorf("items: %w", other))
+
+	w := serveAction(p, httptest.NewRequest("POST", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		return nil, 0, multiErr.ErrorOrNil()
+	})
+	expected := `{"error":"Invalid thing",` +
+		`"fields":{"items.0.sku":"Required","name":"Too short; Must be letters","owner.name":"Required"},` +
+		`"errors":[{"path":"/name","code":"too_short","message":"Too short"},` +
+		`{"path":"/name","code":"format","message":"Must be letters"},` +
+		`{"path":"/owner/name","message":"Required"},` +
+		`{"path":"/items/0/sku","code":"required","message":"Required"}]}`
+	if w.Code != http.StatusUnprocessableEntity || w.Body.String() != expected {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body)
+	}
+
+	// The zero value is returned as a validation error too.
+	var zeroErr fail.MultiError
+	zeroErr.Add("/name", "required", "Required")
+	w = serveAction(p, httptest.NewRequest("POST", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		return nil, 0, zeroErr
+	})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body)
+	}
+}
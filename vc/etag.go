@@ -0,0 +1,174 @@
+package vc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETagMode determines whether, and how, an ActionProcessor generates ETags.
+type ETagMode int
+
+const (
+	// ETagNone disables ETags and conditional requests.
+	ETagNone ETagMode = iota
+	// ETagStrong generates strong ETags from the rendered body.
+	ETagStrong
+	// ETagWeak generates weak ETags from the rendered body.
+	ETagWeak
+)
+
+// Versioned can be implemented by payloads that know their own version, such
+// as a revision number or updated timestamp. The version is used as the ETag
+// without rendering the response, which allows sideloading and rendering to
+// be skipped entirely when the client's copy is current. The query string and
+// media type are mixed into the ETag of any other representation, so a
+// filtered or paged collection, or a sparse entity, has its own. The version
+// is also compared against If-Match headers when mutating entities, so only
+// the ETag of the default representation, requested without a query string,
+// can be used in an If-Match header.
+type Versioned interface {
+	Version() string
+}
+
+// LastModifier can be implemented by payloads to provide a Last-Modified
+// header and support If-Modified-Since requests.
+type LastModifier interface {
+	LastModified() time.Time
+}
+
+// bodyETag returns an ETag computed from a rendered body.
+func bodyETag(body []byte, weak bool) string {
+	sum := sha1.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// VersionETag returns the ETag for a version. Versions made up entirely of
+// characters valid in an ETag are used as is, so they can be read back with
+// ETagVersion, while any others are hashed.
+func VersionETag(version string, weak bool) string {
+	for _, c := range version {
+		if c < 0x21 || c == '"' || c > 0x7e {
+			sum := sha1.Sum([]byte(version))
+			version = hex.EncodeToString(sum[:])
+			break
+		}
+	}
+	etag := `"` + version + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// representationETag returns the ETag for a version of a payload, as rendered
+// for the request. The version alone is used for the default representation,
+// so the tag can be sent back in an If-Match header. The canonical query
+// string, which covers sparse fields, sideloads, filters, sorting and paging,
+// and other media types are mixed into the tag, so each representation of
+// the version has its own.
+func (p *ActionProcessor) representationETag(r *http.Request, renderer Renderer, version string) string {
+	parts := []string{}
+	// Encode sorts the parameters by key, so the same query always has the
+	// same tag.
+	if query := r.URL.Query().Encode(); query != "" {
+		parts = append(parts, "query="+query)
+	}
+	if contentType := rendererContentType(renderer); contentType != p.defaultContentType() {
+		parts = append(parts, "content-type="+contentType)
+	}
+	if len(parts) > 0 {
+		// The separator isn't valid in an ETag, so VersionETag hashes it.
+		version += "\n" + strings.Join(parts, "\n")
+	}
+	return VersionETag(version, p.ETag == ETagWeak)
+}
+
+// defaultContentType returns the content type of responses to requests that
+// don't ask for a specific media type.
+func (p *ActionProcessor) defaultContentType() string {
+	if p.Renderers != nil {
+		if renderer := p.Renderers.FallbackRenderer(); renderer != nil {
+			return rendererContentType(renderer)
+		}
+	}
+	return rendererContentType(DefaultRenderer)
+}
+
+// rendererContentType returns the content type a renderer produces, if known.
+func rendererContentType(renderer Renderer) string {
+	if typer, ok := renderer.(ContentTyper); ok {
+		return typer.ContentType()
+	}
+	return ""
+}
+
+// ETagVersion returns the version from an ETag created by VersionETag.
+func ETagVersion(etag string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), `"`)
+}
+
+// conditionalRequest returns true if the request can be answered with a 304.
+func conditionalRequest(r *http.Request, code int) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && (code == 0 || code == http.StatusOK)
+}
+
+// setValidators sets the ETag and Last-Modified headers, if available.
+func setValidators(header http.Header, etag string, lastModified time.Time) {
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified returns true if the client's cached copy, as described by the
+// If-None-Match or If-Modified-Since headers, is still current. As per RFC
+// 7232, If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagListMatches(ifNoneMatch, etag, true)
+	}
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// etagListMatches returns true if the etag is in the comma separated list, or
+// the list is a wildcard. Weak comparison ignores the weak indicator, while
+// strong comparison requires both tags to be strong.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RespondWithNotModified returns an empty 304 response.
+func RespondWithNotModified(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,224 @@
+package vc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/sideload"
+)
+
+// FieldsQueryKey is the name of the query parameter that restricts the fields
+// rendered in a response. A plain fields=a,b applies to the primary payload,
+// while fields[type]=a,b applies to the primary payload or sideloaded
+// entities of that type.
+var FieldsQueryKey = "fields"
+
+// requestFields parses the fields query parameters into a lookup of entity
+// type to field names. A plain fields parameter is keyed by an empty string.
+func requestFields(query url.Values) map[string][]string {
+	fields := map[string][]string{}
+	for key, values := range query {
+		var typ string
+		switch {
+		case key == FieldsQueryKey:
+		case strings.HasPrefix(key, FieldsQueryKey+"[") && strings.HasSuffix(key, "]"):
+			typ = key[len(FieldsQueryKey)+1 : len(key)-1]
+		default:
+			continue
+		}
+		for _, value := range values {
+			for _, field := range strings.Split(value, ",") {
+				if field = strings.TrimSpace(field); field != "" {
+					fields[typ] = append(fields[typ], field)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// fieldsQueryKey returns the query parameter that fields for the type came from.
+func fieldsQueryKey(typ string) string {
+	if typ == "" {
+		return FieldsQueryKey
+	}
+	return FieldsQueryKey + "[" + typ + "]"
+}
+
+// applySparseFields restricts the response payload and sideloaded entities to
+// the fields requested in the criteria. Unknown fields are reported in a
+// fail.ValidationError.
+func applySparseFields(typ string, criteria *Criteria, response *Response) error {
+	if len(criteria.Fields) == 0 {
+		return nil
+	}
+	invalid := map[string]string{}
+
+	// Fields can only be requested for the primary payload's type, or a type
+	// that can be sideloaded.
+	for name := range criteria.Fields {
+		if name != "" && name != typ && !fieldsTypeKnown(name, criteria, response) {
+			invalid[fieldsQueryKey(name)] = fmt.Sprintf("Unknown type %s", name)
+		}
+	}
+
+	// The primary payload may be restricted by either a plain fields
+	// parameter, or one for its entity type.
+	for _, key := range []string{"", typ} {
+		fields, ok := criteria.Fields[key]
+		if !ok {
+			continue
+		}
+		payload, unknown, err := sparseValue(response.Payload, fields)
+		if err != nil {
+			return err
+		}
+		response.Payload = payload
+		addUnknownFields(invalid, fieldsQueryKey(key), unknown)
+	}
+
+	// Sideloaded entities are restricted by the fields for their type, which
+	// may also be the primary payload's type.
+	if response.Sideload != nil {
+		for name, entities := range *response.Sideload {
+			fields, ok := criteria.Fields[name]
+			if !ok {
+				continue
+			}
+			for id, entity := range entities {
+				sparse, unknown, err := sparseValue(entity, fields)
+				if err != nil {
+					return err
+				}
+				entities[id] = sparse
+				addUnknownFields(invalid, fieldsQueryKey(name), unknown)
+			}
+		}
+	}
+
+	if len(invalid) > 0 {
+		err := fail.NewValidationError(errors.New("Unknown fields requested"))
+		err.Description = "One or more of the requested fields don’t exist. Field names are the same as those in a full response."
+		err.AdditionalFields = invalid
+		return err
+	}
+	return nil
+}
+
+// fieldsTypeKnown returns true if the entity type has been requested, or can
+// be, as a sideload.
+func fieldsTypeKnown(name string, criteria *Criteria, response *Response) bool {
+	if criteria.ShouldSideload(name) {
+		return true
+	}
+	if response.Sideload != nil {
+		if _, ok := (*response.Sideload)[name]; ok {
+			return true
+		}
+	}
+	for _, sideloadable := range sideload.EntityTypes() {
+		if name == sideloadable {
+			return true
+		}
+	}
+	return false
+}
+
+// addUnknownFields records unknown fields against their query parameter.
+func addUnknownFields(invalid map[string]string, key string, unknown []string) {
+	if len(unknown) > 0 {
+		invalid[key] = fmt.Sprintf("Unknown fields %s", strings.Join(unknown, ", "))
+	}
+}
+
+// sparseValue returns a copy of the value containing only the supplied json
+// fields, along with any fields that don't exist. The value is converted to
+// json first, so custom marshalling and omitempty are honoured, then every
+// object in it, or in a collection of them, is restricted. Fields are unknown
+// if no object has them and, for structs, they aren't one of its json fields.
+func sparseValue(value interface{}, fields []string) (interface{}, []string, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, nil, err
+	}
+
+	known := map[string]bool{}
+	checkable := knownTypeFields(reflect.TypeOf(value), known)
+	sparse, found := restrictFields(generic, fields, known)
+	if !checkable && !found {
+		return sparse, nil, nil
+	}
+	unknown := []string{}
+	for _, field := range fields {
+		if !known[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	return sparse, unknown, nil
+}
+
+// restrictFields restricts every object in a decoded json value to the
+// supplied fields, adding the keys of each to known. It returns whether any
+// objects were found.
+func restrictFields(value interface{}, fields []string, known map[string]bool) (interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		sparse := map[string]interface{}{}
+		for key := range value {
+			known[key] = true
+		}
+		for _, field := range fields {
+			if fieldValue, ok := value[field]; ok {
+				sparse[field] = fieldValue
+			}
+		}
+		return sparse, true
+	case []interface{}:
+		found := false
+		for i, element := range value {
+			var elementFound bool
+			value[i], elementFound = restrictFields(element, fields, known)
+			found = found || elementFound
+		}
+		return value, found
+	}
+	return value, false
+}
+
+// knownTypeFields adds the json fields of a struct type, or the struct type in
+// a collection, to known, so fields that are omitted when empty, or that are
+// requested from an empty collection, aren't reported as unknown. It returns
+// whether the type's fields could be determined.
+func knownTypeFields(typ reflect.Type, known map[string]bool) bool {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Implements(jsonMarshalerType) || reflect.PtrTo(typ).Implements(jsonMarshalerType) {
+		return false
+	}
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		return knownTypeFields(typ.Elem(), known)
+	case reflect.Struct:
+		for name := range jsonFieldIndexes(typ) {
+			known[name] = true
+		}
+		return true
+	}
+	return false
+}
+
+// jsonMarshalerType is used to find types with custom json marshalling.
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
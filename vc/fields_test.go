@@ -0,0 +1,121 @@
+package vc
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/snikch/api/fail"
+)
+
+type testFieldsThing struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Owner string `json:"owner_id"`
+}
+
+type testFieldsMoney struct {
+	Cents int
+}
+
+func (money testFieldsMoney) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"amount": money.Cents, "currency": "NZD"})
+}
+
+func TestApplySparseFields(t *testing.T) {
+	for name, test := range map[string]struct {
+		query    string
+		payload  interface{}
+		sideload map[string]map[string]interface{}
+		expected string
+		unknown  map[string]string
+	}{
+		"struct": {
+			query:    "fields=id,name",
+			payload:  testFieldsThing{ID: "t1", Name: "Thing", Owner: "o1"},
+			expected: `{"payload":{"id":"t1","name":"Thing"}}`,
+		},
+		"omitempty": {
+			query:    "fields=id,name",
+			payload:  testFieldsThing{ID: "t1", Owner: "o1"},
+			expected: `{"payload":{"id":"t1"}}`,
+		},
+		"custom marshalling": {
+			query:    "fields=currency",
+			payload:  testFieldsMoney{Cents: 100},
+			expected: `{"payload":{"currency":"NZD"}}`,
+		},
+		"collection": {
+			query:    "fields[things]=id",
+			payload:  []*testFieldsThing{{ID: "t1", Name: "Thing"}, {ID: "t2"}},
+			expected: `{"payload":[{"id":"t1"},{"id":"t2"}]}`,
+		},
+		"unknown struct field": {
+			query:   "fields=id,secret",
+			payload: testFieldsThing{ID: "t1"},
+			unknown: map[string]string{"fields": "Unknown fields secret"},
+		},
+		"unknown map field": {
+			query:   "fields=id,secret",
+			payload: map[string]interface{}{"id": "t1"},
+			unknown: map[string]string{"fields": "Unknown fields secret"},
+		},
+		"unknown field of an empty collection": {
+			query:   "fields=secret",
+			payload: []testFieldsThing{},
+			unknown: map[string]string{"fields": "Unknown fields secret"},
+		},
+		"unknown type": {
+			query:   "fields[others]=id",
+			payload: testFieldsThing{ID: "t1"},
+			unknown: map[string]string{"fields[others]": "Unknown type others"},
+		},
+		"requested type": {
+			query:    "fields[owners]=id&include=owners",
+			payload:  testFieldsThing{ID: "t1"},
+			expected: `{"payload":{"id":"t1","owner_id":""}}`,
+		},
+		"sideloads": {
+			query:   "fields[things]=id&fields[owners]=name",
+			payload: testFieldsThing{ID: "t1", Name: "Thing"},
+			sideload: map[string]map[string]interface{}{
+				"things": {"t2": testFieldsThing{ID: "t2", Name: "Other"}},
+				"owners": {"o1": map[string]interface{}{"id": "o1", "name": "Owner"}},
+			},
+			expected: `{"payload":{"id":"t1"},"related":{"owners":{"o1":{"name":"Owner"}},"things":{"t2":{"id":"t2"}}}}`,
+		},
+	} {
+		r, _ := http.NewRequest("GET", "/things?"+test.query, nil)
+		criteria, err := RequestTypeCriteria(r, "things")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		response := Response{Payload: test.payload}
+		if test.sideload != nil {
+			response.Sideload = &test.sideload
+		}
+		err = applySparseFields("things", criteria, &response)
+		if test.unknown != nil {
+			validationErr, ok := err.(fail.ValidationError)
+			if !ok || len(validationErr.ErrorFields()) != len(test.unknown) {
+				t.Errorf("%s: expected unknown fields %v, got %v", name, test.unknown, err)
+				continue
+			}
+			for key, message := range test.unknown {
+				if validationErr.ErrorFields()[key] != message {
+					t.Errorf("%s: expected %s to be %q, got %v", name, key, message, validationErr.ErrorFields())
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		body, _ := json.Marshal(response)
+		if string(body) != test.expected {
+			t.Errorf("%s: expected %s, got %s", name, test.expected, body)
+		}
+	}
+}
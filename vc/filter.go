@@ -0,0 +1,248 @@
+package vc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snikch/api/fail"
+)
+
+// FilterQueryKey is the prefix of the query parameters that filter a
+// collection, e.g. filter[amount][gte]=10 or filter[status][in]=a,b.
+var FilterQueryKey = "filter"
+
+// MaxFilters is the most filters a request may apply. Requests with more are
+// rejected by ValidateFilters, rather than being returned unfiltered.
+var MaxFilters = 100
+
+// FilterOperator represents a comparison applied by a filter.
+type FilterOperator string
+
+// The operators that can be used in a filter. A filter without an operator,
+// e.g. filter[status]=open, uses FilterEqual.
+const (
+	FilterEqual          FilterOperator = "eq"
+	FilterNotEqual       FilterOperator = "ne"
+	FilterGreaterThan    FilterOperator = "gt"
+	FilterGreaterOrEqual FilterOperator = "gte"
+	FilterLessThan       FilterOperator = "lt"
+	FilterLessOrEqual    FilterOperator = "lte"
+	FilterIn             FilterOperator = "in"
+	FilterNotIn          FilterOperator = "nin"
+	FilterContains       FilterOperator = "contains"
+	FilterNull           FilterOperator = "null"
+)
+
+// multiValue returns true if the operator accepts a comma separated list.
+func (operator FilterOperator) multiValue() bool {
+	return operator == FilterIn || operator == FilterNotIn
+}
+
+// FilterType defines the type filter values are converted to.
+type FilterType int
+
+// The types a filterable field can hold. Values are converted to string,
+// float64, time.Time (RFC 3339) and bool respectively. FilterNull always
+// takes a bool value, regardless of the field type.
+const (
+	FilterString FilterType = iota
+	FilterNumber
+	FilterTime
+	FilterBool
+)
+
+// FilterField declares a field as filterable, with its type and the
+// operators that may be used on it.
+type FilterField struct {
+	Type      FilterType
+	Operators []FilterOperator
+}
+
+// allows returns true if the operator may be used on the field.
+func (field FilterField) allows(operator FilterOperator) bool {
+	for _, allowed := range field.Operators {
+		if allowed == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter is a single condition a collection should be filtered by. Every
+// filter in a criteria must match for an entity to be included.
+type Filter struct {
+	// Key is the query parameter the filter was read from.
+	Key      string
+	Field    string
+	Operator FilterOperator
+	// Raw holds the values as supplied in the query string.
+	Raw []string
+	// Values holds the values converted to the field's FilterType. This is
+	// populated once the filter has been validated against the entity type.
+	Values []interface{}
+}
+
+// Value returns the first converted value, for single value operators.
+func (filter Filter) Value() interface{} {
+	if len(filter.Values) == 0 {
+		return nil
+	}
+	return filter.Values[0]
+}
+
+var filterRegistry = map[string]map[string]FilterField{}
+
+// RegisterFilterableFields declares the fields that collections of the entity
+// type can be filtered by. The type is the same name passed to HTTPHandler.
+// Once a type has registered fields, any filter on another field is rejected.
+// Filters on types without registered fields are left to their handlers.
+func RegisterFilterableFields(typ string, fields map[string]FilterField) {
+	existing, ok := filterRegistry[typ]
+	if !ok {
+		existing = map[string]FilterField{}
+		filterRegistry[typ] = existing
+	}
+	for name, field := range fields {
+		existing[name] = field
+	}
+}
+
+// requestFilters parses the filter query parameters into filters. Malformed
+// keys are returned as invalid, keyed by the query parameter.
+func requestFilters(query url.Values) ([]Filter, map[string]string) {
+	filters := []Filter{}
+	invalid := map[string]string{}
+
+	// Sort the keys so filters are always returned in the same order.
+	keys := []string{}
+	for key := range query {
+		if strings.HasPrefix(key, FilterQueryKey+"[") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(key, FilterQueryKey+"["), "]"), "][")
+		if len(parts) > 2 || parts[0] == "" || !strings.HasSuffix(key, "]") {
+			invalid[key] = "Filters must be in the form filter[field] or filter[field][operator]"
+			continue
+		}
+		operator := FilterEqual
+		if len(parts) == 2 {
+			operator = FilterOperator(parts[1])
+		}
+		for _, raw := range query[key] {
+			values := []string{raw}
+			if operator.multiValue() {
+				values = strings.Split(raw, ",")
+			}
+			filters = append(filters, Filter{
+				Key:      key,
+				Field:    parts[0],
+				Operator: operator,
+				Raw:      values,
+			})
+		}
+	}
+
+	// Prevent overloading of the filters.
+	if len(filters) > MaxFilters {
+		invalid[FilterQueryKey] = fmt.Sprintf("Cannot apply more than %d filters", MaxFilters)
+		filters = nil
+	}
+	return filters, invalid
+}
+
+// ValidateFilters checks the criteria's filters against those registered for
+// the entity type, and converts their values to the registered field types.
+// Every rejected filter is listed in the returned fail.ValidationError. Types
+// without registered fields aren't validated, so their handlers can parse the
+// filter parameters themselves, and their filters have no Values.
+func ValidateFilters(typ string, criteria *Criteria) error {
+	fields, registered := filterRegistry[typ]
+	if !registered || (len(criteria.Filters) == 0 && len(criteria.invalidFilters) == 0) {
+		return nil
+	}
+
+	invalid := map[string]string{}
+	for key, message := range criteria.invalidFilters {
+		invalid[key] = message
+	}
+	for i, filter := range criteria.Filters {
+		field, ok := fields[filter.Field]
+		if !ok {
+			addInvalidFilter(invalid, filter.Key, fmt.Sprintf("Cannot filter by %s", filter.Field))
+			continue
+		}
+		if !field.allows(filter.Operator) {
+			addInvalidFilter(invalid, filter.Key, fmt.Sprintf("Cannot filter %s with %s", filter.Field, filter.Operator))
+			continue
+		}
+		values, err := convertFilterValues(field, filter)
+		if err != nil {
+			addInvalidFilter(invalid, filter.Key, err.Error())
+			continue
+		}
+		criteria.Filters[i].Values = values
+	}
+
+	if len(invalid) > 0 {
+		err := fail.NewValidationError(errors.New("Invalid filters"))
+		err.Description = "One or more filters couldn’t be applied. Check the field can be filtered, the operator is supported for it, and the value is of the correct type."
+		err.AdditionalFields = invalid
+		return err
+	}
+	return nil
+}
+
+// addInvalidFilter adds the message for a filter parameter, joining it to any
+// other message for the same parameter, as a parameter can be repeated.
+func addInvalidFilter(invalid map[string]string, key, message string) {
+	existing, ok := invalid[key]
+	switch {
+	case !ok:
+		invalid[key] = message
+	case !strings.Contains("; "+existing+"; ", "; "+message+"; "):
+		invalid[key] = existing + "; " + message
+	}
+}
+
+// convertFilterValues converts raw filter values to the field's type.
+func convertFilterValues(field FilterField, filter Filter) ([]interface{}, error) {
+	typ := field.Type
+	if filter.Operator == FilterNull {
+		typ = FilterBool
+	}
+	values := make([]interface{}, len(filter.Raw))
+	for i, raw := range filter.Raw {
+		switch typ {
+		case FilterNumber:
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a number", raw)
+			}
+			values[i] = value
+		case FilterTime:
+			value, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not an RFC 3339 time", raw)
+			}
+			values[i] = value
+		case FilterBool:
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not true or false", raw)
+			}
+			values[i] = value
+		default:
+			values[i] = raw
+		}
+	}
+	return values, nil
+}
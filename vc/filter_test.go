@@ -0,0 +1,100 @@
+package vc
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/snikch/api/fail"
+)
+
+func TestValidateFilters(t *testing.T) {
+	RegisterFilterableFields("payments", map[string]FilterField{
+		"amount": {Type: FilterNumber, Operators: []FilterOperator{FilterGreaterOrEqual, FilterLessThan}},
+		"status": {Type: FilterString, Operators: []FilterOperator{FilterEqual, FilterIn}},
+	})
+
+	r, _ := http.NewRequest("GET", "/payments?filter[amount][gte]=10&filter[status][in]=a,b&filter[status]=c", nil)
+	criteria, err := RequestTypeCriteria(r, "payments")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if err := ValidateFilters("payments", criteria); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	expected := []Filter{
+		{Key: "filter[amount][gte]", Field: "amount", Operator: FilterGreaterOrEqual, Raw: []string{"10"}, Values: []interface{}{10.0}},
+		{Key: "filter[status]", Field: "status", Operator: FilterEqual, Raw: []string{"c"}, Values: []interface{}{"c"}},
+		{Key: "filter[status][in]", Field: "status", Operator: FilterIn, Raw: []string{"a", "b"}, Values: []interface{}{"a", "b"}},
+	}
+	if !reflect.DeepEqual(criteria.Filters, expected) {
+		t.Errorf("Unexpected filters: %+v", criteria.Filters)
+	}
+}
+
+func TestValidateFiltersRejected(t *testing.T) {
+	RegisterFilterableFields("payments", map[string]FilterField{
+		"amount": {Type: FilterNumber, Operators: []FilterOperator{FilterGreaterOrEqual}},
+	})
+
+	r, _ := http.NewRequest("GET", "/payments?filter[amount][gte]=ten&filter[amount][gte]=eleven&filter[amount][lt]=1&filter[secret]=x&filter[secret]=y&filter[a][b][c]=1", nil)
+	criteria, err := RequestTypeCriteria(r, "payments")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	err = ValidateFilters("payments", criteria)
+	validationErr, ok := err.(fail.ValidationError)
+	if !ok {
+		t.Errorf("Expected a ValidationError, got %v", err)
+		return
+	}
+	for _, key := range []string{"filter[amount][gte]", "filter[amount][lt]", "filter[secret]", "filter[a][b][c]"} {
+		if _, ok := validationErr.ErrorFields()[key]; !ok {
+			t.Errorf("Expected %s to be rejected: %v", key, validationErr.ErrorFields())
+		}
+	}
+	// Repeated parameters report every distinct problem.
+	if message := validationErr.ErrorFields()["filter[amount][gte]"]; message != "ten is not a number; eleven is not a number" {
+		t.Errorf("Unexpected message %q", message)
+	}
+	if message := validationErr.ErrorFields()["filter[secret]"]; message != "Cannot filter by secret" {
+		t.Errorf("Unexpected message %q", message)
+	}
+
+	// Types without registered fields handle their own filters.
+	r, _ = http.NewRequest("GET", "/unfilterable?filter[anything]=x", nil)
+	criteria, _ = RequestTypeCriteria(r, "unfilterable")
+	if err := ValidateFilters("unfilterable", criteria); err != nil || len(criteria.Filters) != 1 {
+		t.Errorf("Expected an unregistered type's filters to be left alone, got %v", err)
+	}
+}
+
+func TestValidateFiltersLimit(t *testing.T) {
+	RegisterFilterableFields("payments", map[string]FilterField{
+		"status": {Type: FilterString, Operators: []FilterOperator{FilterEqual}},
+	})
+
+	query := url.Values{}
+	for i := 0; i <= MaxFilters; i++ {
+		query.Add("filter[status]", "open")
+	}
+	r, _ := http.NewRequest("GET", "/payments?"+query.Encode(), nil)
+	criteria, err := RequestTypeCriteria(r, "payments")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	err = ValidateFilters("payments", criteria)
+	validationErr, ok := err.(fail.ValidationError)
+	if !ok {
+		t.Errorf("Expected a ValidationError, got %v", err)
+		return
+	}
+	if _, ok := validationErr.ErrorFields()[FilterQueryKey]; !ok {
+		t.Errorf("Expected too many filters to be rejected: %v", validationErr.ErrorFields())
+	}
+}
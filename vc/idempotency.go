@@ -0,0 +1,352 @@
+package vc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// IdempotencyKeyHeader is the request header clients use to mark a POST or
+// PATCH request as safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on responses replayed from a previous
+// request with the same key.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// MaxIdempotencyKeyLength is the longest idempotency key a client may send.
+var MaxIdempotencyKeyLength = 255
+
+// MaxIdempotentBodySize is the largest body, in bytes, of a request sent with
+// an idempotency key, as the body is read into memory to compare it with
+// retries. Larger requests fail with a fail.PayloadTooLargeError.
+var MaxIdempotentBodySize int64 = 10 << 20
+
+// DefaultIdempotencyTTL is how long idempotency records are kept by stores
+// that don't set their own TTL.
+var DefaultIdempotencyTTL = 24 * time.Hour
+
+// DefaultIdempotencyLockTTL is how long a key stays reserved for a request that
+// is still in flight, by stores that don't set their own. A request that never
+// finishes, such as one running when the process died, stops blocking retries
+// once this passes, so it should be longer than any action can run.
+var DefaultIdempotencyLockTTL = time.Minute
+
+// ErrIdempotencyLockLost is returned by an IdempotencyStore when a request's
+// reservation of a key has expired, and the key may now be reserved by a retry,
+// so the request can no longer complete or release it.
+var ErrIdempotencyLockLost = errors.New("idempotency key reservation has expired")
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// idempotency key.
+type IdempotencyRecord struct {
+	// Key is the idempotency key prefixed with the actor that sent it.
+	Key string
+	// RequestHash identifies the method, path, negotiated media type and body
+	// of the request, so a key can't be reused for a different request.
+	RequestHash string
+	// Token is a random value identifying the request that reserved the key,
+	// so a request whose reservation has expired can't complete or release a
+	// reservation made since.
+	Token string
+	// Status is zero while the request is still in flight.
+	Status    int
+	Header    http.Header
+	Body      []byte
+	CreatedAt time.Time
+}
+
+// Complete returns true once the response for the request has been stored.
+func (record IdempotencyRecord) Complete() bool {
+	return record.Status != 0
+}
+
+// IdempotencyStore stores the responses to requests made with an idempotency
+// key. Implementations must be safe for concurrent use, and Begin must be
+// atomic so that only one of several concurrent requests can reserve a key.
+type IdempotencyStore interface {
+	// Begin reserves the key for a request, identified by the token. If the
+	// key has already been reserved, and hasn't expired, the existing record
+	// is returned instead. Reservations for requests still in flight expire
+	// after the lock TTL.
+	Begin(context *ctx.Context, key, requestHash, token string) (*IdempotencyRecord, error)
+	// Complete stores the response for a key reserved with the record's
+	// token, returning ErrIdempotencyLockLost if it's no longer reserved with
+	// that token.
+	Complete(context *ctx.Context, record IdempotencyRecord) error
+	// Release removes a key reserved with the token without storing a
+	// response, so the request can be retried. ErrIdempotencyLockLost is
+	// returned if it's no longer reserved with that token.
+	Release(context *ctx.Context, key, token string) error
+}
+
+// replayedHeader returns true if a response header should be stored and
+// replayed. Rate limit headers describe the request they were sent with, so
+// a replay keeps its own.
+func replayedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return !strings.HasPrefix(name, "Ratelimit-") && name != "Retry-After"
+}
+
+// idempotentRequest returns true if the request should honour an idempotency
+// key.
+func idempotentRequest(r *http.Request) bool {
+	return (r.Method == "POST" || r.Method == "PATCH") && r.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// beginIdempotentRequest reserves the request's idempotency key. If the key has
+// already been used, the stored response is replayed and true is returned.
+// Otherwise the returned recorder should be used to write the response, and
+// finished once it has been written.
+func (p *ActionProcessor) beginIdempotentRequest(context *ctx.Context, renderer Renderer, w http.ResponseWriter, r *http.Request) (*idempotencyRecorder, bool, error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > MaxIdempotencyKeyLength {
+		err := fail.NewBadRequestError(errors.New("Idempotency key is too long"))
+		err.WithField(IdempotencyKeyHeader, fmt.Sprintf("Must be no longer than %d characters", MaxIdempotencyKeyLength))
+		return nil, false, err
+	}
+	// Keys are only unique to the actor that sent them, or for anonymous
+	// requests, the client's IP.
+	if actor, ok := ContextActor(context); ok {
+		key = "actor:" + ActorID(actor) + "/" + key
+	} else {
+		key = "ip:" + ContextClientIP(context) + "/" + key
+	}
+
+	// Read the body so it can be compared with future requests, then put it
+	// back for the handler.
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MaxIdempotentBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, false, fail.NewPayloadTooLargeError(fmt.Errorf("Requests with an idempotency key must be at most %d bytes", MaxIdempotentBodySize))
+			}
+			return nil, false, fail.NewBadRequestError(err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	// The same request accepting a different media type gets a different
+	// response, so can't be replayed.
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + rendererContentType(renderer) + "\n"))
+	hash.Write(body)
+	requestHash := hex.EncodeToString(hash.Sum(nil))
+
+	token, err := idempotencyToken()
+	if err != nil {
+		return nil, false, err
+	}
+	record, err := p.Idempotency.Begin(context, key, requestHash, token)
+	if err != nil {
+		return nil, false, err
+	}
+	if record == nil {
+		return &idempotencyRecorder{
+			ResponseWriter: w,
+			store:          p.Idempotency,
+			record: IdempotencyRecord{
+				Key:         key,
+				RequestHash: requestHash,
+				Token:       token,
+				CreatedAt:   time.Now(),
+			},
+		}, false, nil
+	}
+
+	if record.RequestHash != requestHash {
+		err := fail.NewValidationError(errors.New("Idempotency key has been used for a different request"))
+		err.Description = "Each idempotency key can only be used for a single request. Retries must have the same method, path, accepted media type and body as the original request."
+		return nil, false, err
+	}
+	if !record.Complete() {
+		err := fail.NewConflictError(errors.New("A request with this idempotency key is in progress"))
+		err.Description = "The original request with this idempotency key hasn’t finished yet. Wait a moment, then retry."
+		return nil, false, err
+	}
+
+	for name, values := range record.Header {
+		if replayedHeader(name) {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+	return nil, true, nil
+}
+
+// idempotencyToken returns a random token identifying a request's reservation
+// of an idempotency key.
+func idempotencyToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// idempotencyRecorder writes a response while recording it for replaying.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	store  IdempotencyStore
+	record IdempotencyRecord
+	body   bytes.Buffer
+}
+
+// WriteHeader implements the http.ResponseWriter interface, recording the
+// status and headers.
+func (w *idempotencyRecorder) WriteHeader(code int) {
+	if w.record.Status == 0 {
+		w.record.Status = code
+		w.record.Header = http.Header{}
+		for name, values := range w.Header() {
+			if replayedHeader(name) {
+				w.record.Header[name] = append([]string{}, values...)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface, recording the body.
+func (w *idempotencyRecorder) Write(body []byte) (int, error) {
+	if w.record.Status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(body)
+	return w.ResponseWriter.Write(body)
+}
+
+// Flush implements the http.Flusher interface if the underlying writer does.
+func (w *idempotencyRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish stores the recorded response. Server errors aren't stored, so the
+// request can be retried. A new context is used, as the request's context may
+// have been cancelled by now.
+func (w *idempotencyRecorder) finish() error {
+	context := ctx.NewContext()
+	if w.record.Status == 0 || w.record.Status >= 500 {
+		return w.store.Release(context, w.record.Key, w.record.Token)
+	}
+	w.record.Body = w.body.Bytes()
+	return w.store.Complete(context, w.record)
+}
+
+// MemoryIdempotencyStore is an in memory IdempotencyStore, suitable for tests
+// and services running as a single instance.
+type MemoryIdempotencyStore struct {
+	// TTL is how long records are kept. If zero, DefaultIdempotencyTTL is used.
+	TTL time.Duration
+	// LockTTL is how long a key is reserved for a request in flight. If zero,
+	// DefaultIdempotencyLockTTL is used.
+	LockTTL   time.Duration
+	records   map[string]IdempotencyRecord
+	nextSweep time.Time
+	sync.Mutex
+}
+
+// NewMemoryIdempotencyStore returns an initialized MemoryIdempotencyStore.
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		TTL:     ttl,
+		records: map[string]IdempotencyRecord{},
+	}
+}
+
+// ttl returns the duration records are kept.
+func (store *MemoryIdempotencyStore) ttl() time.Duration {
+	if store.TTL > 0 {
+		return store.TTL
+	}
+	return DefaultIdempotencyTTL
+}
+
+// lockTTL returns the duration keys are reserved for requests in flight.
+func (store *MemoryIdempotencyStore) lockTTL() time.Duration {
+	if store.LockTTL > 0 {
+		return store.LockTTL
+	}
+	return DefaultIdempotencyLockTTL
+}
+
+// Begin implements the IdempotencyStore interface.
+func (store *MemoryIdempotencyStore) Begin(context *ctx.Context, key, requestHash, token string) (*IdempotencyRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+	if store.records == nil {
+		store.records = map[string]IdempotencyRecord{}
+	}
+
+	// Remove expired records at most once a minute.
+	now := time.Now()
+	cutoff := now.Add(-store.ttl())
+	if now.After(store.nextSweep) {
+		for existingKey, record := range store.records {
+			if record.CreatedAt.Before(cutoff) {
+				delete(store.records, existingKey)
+			}
+		}
+		store.nextSweep = now.Add(time.Minute)
+	}
+
+	if record, ok := store.records[key]; ok && !record.CreatedAt.Before(cutoff) {
+		if record.Complete() || !record.CreatedAt.Before(now.Add(-store.lockTTL())) {
+			return &record, nil
+		}
+	}
+	store.records[key] = IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		Token:       token,
+		CreatedAt:   now,
+	}
+	return nil, nil
+}
+
+// reserved returns the record for a key that is still reserved with the token.
+func (store *MemoryIdempotencyStore) reserved(key, token string) (IdempotencyRecord, bool) {
+	existing, ok := store.records[key]
+	return existing, ok && !existing.Complete() && existing.Token == token
+}
+
+// Complete implements the IdempotencyStore interface.
+func (store *MemoryIdempotencyStore) Complete(context *ctx.Context, record IdempotencyRecord) error {
+	store.Lock()
+	defer store.Unlock()
+	existing, ok := store.reserved(record.Key, record.Token)
+	if !ok {
+		return ErrIdempotencyLockLost
+	}
+	record.CreatedAt = existing.CreatedAt
+	store.records[record.Key] = record
+	return nil
+}
+
+// Release implements the IdempotencyStore interface.
+func (store *MemoryIdempotencyStore) Release(context *ctx.Context, key, token string) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.reserved(key, token); !ok {
+		return ErrIdempotencyLockLost
+	}
+	delete(store.records, key)
+	return nil
+}
@@ -0,0 +1,154 @@
+package vc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/snikch/api/ctx"
+)
+
+// SQLIdempotencyStore is an IdempotencyStore backed by a database/sql table,
+// for services running as several instances. The table needs a unique key on
+// idempotency_key, e.g. for MySQL:
+//
+//	CREATE TABLE idempotency_keys (
+//		idempotency_key VARCHAR(512) NOT NULL PRIMARY KEY,
+//		request_hash CHAR(64) NOT NULL,
+//		token CHAR(32) NOT NULL,
+//		status INT NOT NULL,
+//		header TEXT NOT NULL,
+//		body LONGBLOB NOT NULL,
+//		created_at DATETIME NOT NULL
+//	);
+type SQLIdempotencyStore struct {
+	DB *sql.DB
+	// Table is the name of the table, which defaults to idempotency_keys.
+	Table string
+	// TTL is how long records are kept. If zero, DefaultIdempotencyTTL is used.
+	TTL time.Duration
+	// LockTTL is how long a key is reserved for a request in flight. If zero,
+	// DefaultIdempotencyLockTTL is used.
+	LockTTL time.Duration
+	// Placeholder returns the bind parameter for the nth argument of a query,
+	// starting at one. If nil, ? is used, as with MySQL and SQLite. For
+	// Postgres, return fmt.Sprintf("$%d", n).
+	Placeholder func(n int) string
+}
+
+// NewSQLIdempotencyStore returns a SQLIdempotencyStore using the default table.
+func NewSQLIdempotencyStore(db *sql.DB) *SQLIdempotencyStore {
+	return &SQLIdempotencyStore{
+		DB:    db,
+		Table: "idempotency_keys",
+	}
+}
+
+// query replaces each %s in the query with the table name, followed by a
+// placeholder for every argument.
+func (store *SQLIdempotencyStore) query(query string, args int) string {
+	table := store.Table
+	if table == "" {
+		table = "idempotency_keys"
+	}
+	values := []interface{}{table}
+	for i := 1; i <= args; i++ {
+		if store.Placeholder == nil {
+			values = append(values, "?")
+			continue
+		}
+		values = append(values, store.Placeholder(i))
+	}
+	return fmt.Sprintf(query, values...)
+}
+
+// Begin implements the IdempotencyStore interface. Expired records for the key,
+// and expired reservations, are removed, then the key is inserted. If the
+// insert fails because the key exists, the existing record is returned.
+func (store *SQLIdempotencyStore) Begin(context *ctx.Context, key, requestHash, token string) (*IdempotencyRecord, error) {
+	ttl := store.TTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	lockTTL := store.LockTTL
+	if lockTTL <= 0 {
+		lockTTL = DefaultIdempotencyLockTTL
+	}
+	now := time.Now().UTC()
+	_, err := store.DB.ExecContext(context,
+		store.query("DELETE FROM %s WHERE idempotency_key = %s AND (created_at < %s OR (status = 0 AND created_at < %s))", 3),
+		key, now.Add(-ttl), now.Add(-lockTTL),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, insertErr := store.DB.ExecContext(context,
+		store.query("INSERT INTO %s (idempotency_key, request_hash, token, status, header, body, created_at) VALUES (%s, %s, %s, %s, %s, %s, %s)", 7),
+		key, requestHash, token, 0, "{}", []byte{}, now,
+	)
+	if insertErr == nil {
+		return nil, nil
+	}
+
+	// Drivers don't report duplicate keys consistently, so look for the
+	// existing record instead.
+	record := IdempotencyRecord{Key: key}
+	var header string
+	err = store.DB.QueryRowContext(context,
+		store.query("SELECT request_hash, status, header, body, created_at FROM %s WHERE idempotency_key = %s", 1),
+		key,
+	).Scan(&record.RequestHash, &record.Status, &header, &record.Body, &record.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, insertErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	record.Header = http.Header{}
+	if err := json.Unmarshal([]byte(header), &record.Header); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Complete implements the IdempotencyStore interface.
+func (store *SQLIdempotencyStore) Complete(context *ctx.Context, record IdempotencyRecord) error {
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return err
+	}
+	result, err := store.DB.ExecContext(context,
+		store.query("UPDATE %s SET status = %s, header = %s, body = %s WHERE idempotency_key = %s AND token = %s AND status = 0", 5),
+		record.Status, string(header), record.Body, record.Key, record.Token,
+	)
+	return reservationResult(result, err)
+}
+
+// Release implements the IdempotencyStore interface.
+func (store *SQLIdempotencyStore) Release(context *ctx.Context, key, token string) error {
+	result, err := store.DB.ExecContext(context,
+		store.query("DELETE FROM %s WHERE idempotency_key = %s AND token = %s AND status = 0", 2),
+		key, token,
+	)
+	return reservationResult(result, err)
+}
+
+// reservationResult returns ErrIdempotencyLockLost if a statement for a
+// reserved key affected no rows, as the key is no longer reserved by the
+// request.
+func reservationResult(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrIdempotencyLockLost
+	}
+	return nil
+}
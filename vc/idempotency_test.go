@@ -0,0 +1,149 @@
+package vc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snikch/api/ctx"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.Idempotency = NewMemoryIdempotencyStore(0)
+	calls := 0
+	entered := make(chan bool, 1)
+	release := make(chan bool)
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		calls++
+		if calls == 2 {
+			entered <- true
+			<-release
+		}
+		return map[string]int{"order": calls}, http.StatusCreated, nil
+	}
+	request := func(key, body string) *http.Request {
+		r := httptest.NewRequest("POST", "/things", strings.NewReader(body))
+		r.Header.Set(IdempotencyKeyHeader, key)
+		return r
+	}
+
+	w := serveAction(p, request("k1", `{"a":1}`), fn)
+	first := w.Body.String()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status %d %s", w.Code, w.Body)
+	}
+
+	w = serveAction(p, request("k1", `{"a":1}`), fn)
+	if w.Code != http.StatusCreated || w.Body.String() != first || w.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("Expected a replay, got %d %s", w.Code, w.Body)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the handler to be called once, got %d", calls)
+	}
+
+	w = serveAction(p, request("k1", `{"a":2}`), fn)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a 422 for a different body, got %d %s", w.Code, w.Body)
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- serveAction(p, request("k2", `{}`), fn).Code
+	}()
+	<-entered
+	w = serveAction(p, request("k2", `{}`), fn)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a 409 for an in flight request, got %d %s", w.Code, w.Body)
+	}
+	close(release)
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("Unexpected status %d for the in flight request", code)
+	}
+
+	// Anonymous keys are scoped to the client's IP.
+	r := request("k1", `{"a":1}`)
+	r.RemoteAddr = "192.0.2.2:1234"
+	w = serveAction(p, r, fn)
+	if w.Code != http.StatusCreated || w.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("Expected another client's key not to be replayed, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMemoryIdempotencyStoreLockTTL(t *testing.T) {
+	store := NewMemoryIdempotencyStore(0)
+	store.LockTTL = time.Millisecond
+	context := ctx.NewContext()
+	if record, err := store.Begin(context, "k1", "h1", "t1"); record != nil || err != nil {
+		t.Fatalf("Expected the key to be reserved, got %v %v", record, err)
+	}
+	if record, _ := store.Begin(context, "k1", "h1", "t2"); record == nil {
+		t.Errorf("Expected the reservation to be returned")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if record, err := store.Begin(context, "k1", "h1", "t3"); record != nil || err != nil {
+		t.Errorf("Expected an expired reservation to be replaced, got %v %v", record, err)
+	}
+
+	// The request whose reservation expired can't complete or release the new
+	// one.
+	late := IdempotencyRecord{Key: "k1", RequestHash: "h1", Token: "t1", Status: http.StatusCreated}
+	if err := store.Complete(context, late); err != ErrIdempotencyLockLost {
+		t.Errorf("Expected a late Complete to have lost the lock, got %v", err)
+	}
+	if err := store.Release(context, "k1", "t1"); err != ErrIdempotencyLockLost {
+		t.Errorf("Expected a late Release to have lost the lock, got %v", err)
+	}
+	if record := store.records["k1"]; record.Token != "t3" || record.Complete() {
+		t.Errorf("Expected the new reservation to be kept, got %v", record)
+	}
+	late.Token = "t3"
+	if err := store.Complete(context, late); err != nil {
+		t.Errorf("Unexpected error completing the reservation %s", err)
+	}
+}
+
+func TestIdempotencyKeyRequests(t *testing.T) {
+	defer func(max int64) { MaxIdempotentBodySize = max }(MaxIdempotentBodySize)
+	MaxIdempotentBodySize = 16
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.Renderers.Register("application/vnd.things+json", jsonTestRenderer{})
+	p.Idempotency = NewMemoryIdempotencyStore(0)
+	p.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), RateLimit{Limit: 10, Window: time.Hour})
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		return map[string]bool{"ok": true}, http.StatusCreated, nil
+	}
+	request := func(key, body, accept string) *http.Request {
+		r := httptest.NewRequest("POST", "/things", strings.NewReader(body))
+		r.Header.Set(IdempotencyKeyHeader, key)
+		r.Header.Set("Accept", accept)
+		return r
+	}
+
+	w := serveAction(p, request("k1", `{}`, "application/json"), fn)
+	if w.Code != http.StatusCreated || w.Header().Get("RateLimit-Remaining") != "9" {
+		t.Fatalf("Unexpected response %d %v", w.Code, w.Header())
+	}
+	// Replays keep the rate limit headers for the replaying request.
+	w = serveAction(p, request("k1", `{}`, "application/json"), fn)
+	if w.Header().Get(IdempotentReplayedHeader) != "true" || w.Header().Get("RateLimit-Remaining") != "8" {
+		t.Errorf("Expected a replay with its own rate limit headers, got %d %v", w.Code, w.Header())
+	}
+	if record, ok := p.Idempotency.(*MemoryIdempotencyStore).records["ip:192.0.2.1/k1"]; !ok || record.Header.Get("RateLimit-Remaining") != "" {
+		t.Errorf("Expected rate limit headers not to be stored, got %v", record.Header)
+	}
+
+	w = serveAction(p, request("k1", `{}`, "application/vnd.things+json"), fn)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a 422 for a different media type, got %d %s", w.Code, w.Body)
+	}
+
+	w = serveAction(p, request("k2", strings.Repeat(" ", 17), "application/json"), fn)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a 413 for a large body, got %d %s", w.Code, w.Body)
+	}
+}
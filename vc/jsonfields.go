@@ -0,0 +1,110 @@
+package vc
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// jsonFields caches the json key to field index lookup for struct types.
+var jsonFields = struct {
+	types map[reflect.Type]map[string][]int
+	sync.RWMutex
+}{
+	types: map[reflect.Type]map[string][]int{},
+}
+
+// jsonFieldIndexes returns the field indexes for the supplied struct type,
+// keyed by the name encoding/json would use for each field.
+func jsonFieldIndexes(typ reflect.Type) map[string][]int {
+	jsonFields.RLock()
+	indexes, ok := jsonFields.types[typ]
+	jsonFields.RUnlock()
+	if ok {
+		return indexes
+	}
+
+	indexes = map[string][]int{}
+	registerJSONFields(indexes, typ, []int{})
+	jsonFields.Lock()
+	jsonFields.types[typ] = indexes
+	jsonFields.Unlock()
+	return indexes
+}
+
+// registerJSONFields adds the json names of every exported field in typ to the
+// supplied indexes, recursing into untagged embedded structs as encoding/json
+// does. Shallower fields take precedence over promoted ones.
+func registerJSONFields(indexes map[string][]int, typ reflect.Type, runningIndex []int) {
+	embedded := [][]int{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		// Create the index value.
+		index := make([]int, len(runningIndex)+1)
+		copy(index, runningIndex)
+		index[len(runningIndex)] = i
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		// Untagged embedded structs have their fields promoted.
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			embedded = append(embedded, index)
+			continue
+		}
+
+		// Exclude unexported fields.
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		indexes[name] = index
+	}
+
+	for _, index := range embedded {
+		fieldType := typ.Field(index[len(index)-1]).Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		promoted := map[string][]int{}
+		registerJSONFields(promoted, fieldType, index)
+		for name, index := range promoted {
+			if _, ok := indexes[name]; !ok {
+				indexes[name] = index
+			}
+		}
+	}
+}
+
+// jsonFieldValue returns the value of the field with the supplied json name,
+// or false if the value is not a struct, has no such field, or the field sits
+// behind a nil embedded pointer.
+func jsonFieldValue(value reflect.Value, name string) (reflect.Value, bool) {
+	value = reflect.Indirect(value)
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	index, ok := jsonFieldIndexes(value.Type())[name]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	for _, i := range index {
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return reflect.Value{}, false
+			}
+			value = value.Elem()
+		}
+		value = value.Field(i)
+	}
+	return value, true
+}
@@ -0,0 +1,200 @@
+package vc
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snikch/api/fail"
+)
+
+// RendererRegistry holds renderers keyed by the media type they produce, and
+// picks the most appropriate one for a request based on its Accept header.
+type RendererRegistry struct {
+	// Fallback is the media type used when a request has no Accept header.
+	// If empty, the first registered media type is used.
+	Fallback  string
+	renderers map[string]Renderer
+	types     []string
+}
+
+// NewRendererRegistry returns an initialized RendererRegistry.
+func NewRendererRegistry() *RendererRegistry {
+	return &RendererRegistry{
+		renderers: map[string]Renderer{},
+		types:     []string{},
+	}
+}
+
+// Register adds a renderer for the supplied media type. Registration order is
+// used as the preference order when a client accepts several types equally.
+func (registry *RendererRegistry) Register(mediaType string, renderer Renderer) {
+	mediaType = strings.ToLower(mediaType)
+	if _, ok := registry.renderers[mediaType]; !ok {
+		registry.types = append(registry.types, mediaType)
+	}
+	registry.renderers[mediaType] = renderer
+}
+
+// FallbackRenderer returns the renderer for the fallback media type, or nil if
+// no renderers have been registered.
+func (registry *RendererRegistry) FallbackRenderer() Renderer {
+	if len(registry.types) == 0 {
+		return nil
+	}
+	return registry.renderer(registry.preferredTypes()[0])
+}
+
+// preferredTypes returns the registered media types with the fallback first.
+func (registry *RendererRegistry) preferredTypes() []string {
+	fallback := strings.ToLower(registry.Fallback)
+	if _, ok := registry.renderers[fallback]; !ok {
+		return registry.types
+	}
+	types := []string{fallback}
+	for _, mediaType := range registry.types {
+		if mediaType != fallback {
+			types = append(types, mediaType)
+		}
+	}
+	return types
+}
+
+// renderer returns the registered renderer for the media type.
+func (registry *RendererRegistry) renderer(mediaType string) Renderer {
+	return mediaTypeRenderer{
+		Renderer:  registry.renderers[mediaType],
+		mediaType: mediaType,
+	}
+}
+
+// Negotiate returns the renderer best matching the supplied Accept header.
+// The returned renderer reports the matched media type via ContentTyper. If
+// the client accepts none of the registered types, a fail.NotAcceptableError
+// is returned along with the fallback renderer, for rendering that error.
+func (registry *RendererRegistry) Negotiate(accept string) (Renderer, error) {
+	fallback := registry.FallbackRenderer()
+	if strings.TrimSpace(accept) == "" {
+		return fallback, nil
+	}
+
+	ranges := parseAccept(accept)
+	for _, mediaRange := range ranges {
+		// A zero quality means the client explicitly refuses this type.
+		if mediaRange.quality <= 0 {
+			continue
+		}
+		// Wildcards are satisfied by whatever we'd prefer to send.
+		for _, mediaType := range registry.preferredTypes() {
+			if mediaRange.matches(mediaType) && !refused(ranges, mediaType) {
+				return registry.renderer(mediaType), nil
+			}
+		}
+	}
+
+	err := fail.NewNotAcceptableError(fmt.Errorf("None of the accepted media types can be rendered"))
+	err.Description = "The Accept header doesn’t include any media type this api can respond with. Supported types are " + strings.Join(registry.types, ", ") + "."
+	return fallback, err
+}
+
+// refused returns true if the media ranges explicitly give the exact media
+// type a zero quality.
+func refused(ranges []acceptRange, mediaType string) bool {
+	for _, mediaRange := range ranges {
+		if mediaRange.mediaType == mediaType {
+			return mediaRange.quality <= 0
+		}
+	}
+	return false
+}
+
+// acceptRange represents a single media range from an Accept header.
+type acceptRange struct {
+	mediaType string
+	quality   float64
+	order     int
+}
+
+// matches returns true if the supplied media type falls within the range.
+func (mediaRange acceptRange) matches(mediaType string) bool {
+	if mediaRange.mediaType == "*/*" || mediaRange.mediaType == mediaType {
+		return true
+	}
+	if strings.HasSuffix(mediaRange.mediaType, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange.mediaType, "*"))
+	}
+	return false
+}
+
+// specificity ranks exact types above subtype wildcards above full wildcards.
+func (mediaRange acceptRange) specificity() int {
+	switch {
+	case mediaRange.mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange.mediaType, "/*"):
+		return 1
+	}
+	return 2
+}
+
+// parseAccept parses an Accept header into media ranges ordered by preference,
+// i.e. quality, then specificity, then the order the client listed them.
+func parseAccept(accept string) []acceptRange {
+	ranges := []acceptRange{}
+	for i, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := acceptRange{
+			mediaType: strings.ToLower(strings.TrimSpace(params[0])),
+			quality:   1,
+			order:     i,
+		}
+		if mediaRange.mediaType == "" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			quality, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err == nil {
+				mediaRange.quality = quality
+			}
+		}
+		ranges = append(ranges, mediaRange)
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].quality != ranges[j].quality {
+			return ranges[i].quality > ranges[j].quality
+		}
+		if ranges[i].specificity() != ranges[j].specificity() {
+			return ranges[i].specificity() > ranges[j].specificity()
+		}
+		return ranges[i].order < ranges[j].order
+	})
+	return ranges
+}
+
+// mediaTypeRenderer wraps a registered renderer with the media type it was
+// negotiated for, so the correct Content-Type can be set on the response.
+type mediaTypeRenderer struct {
+	Renderer
+	mediaType string
+}
+
+// ContentType implements the ContentTyper interface.
+func (renderer mediaTypeRenderer) ContentType() string {
+	return renderer.mediaType
+}
+
+// negotiateRenderer returns the renderer to use for the supplied request. If
+// no renderers are registered, DefaultRenderer is used for every request.
+func (p *ActionProcessor) negotiateRenderer(r *http.Request) (Renderer, error) {
+	if p.Renderers == nil || len(p.Renderers.types) == 0 {
+		return DefaultRenderer, nil
+	}
+	return p.Renderers.Negotiate(r.Header.Get("Accept"))
+}
@@ -0,0 +1,72 @@
+package vc
+
+import (
+	"testing"
+
+	"github.com/snikch/api/fail"
+)
+
+type testRenderer struct{}
+
+func (testRenderer) Render(interface{}) ([]byte, error) { return nil, nil }
+func (testRenderer) RenderError(APIError) []byte        { return nil }
+
+func TestNegotiate(t *testing.T) {
+	registry := NewRendererRegistry()
+	registry.Register("application/json", testRenderer{})
+	registry.Register("application/xml", testRenderer{})
+	registry.Register("text/csv", testRenderer{})
+
+	for _, e := range []struct {
+		Accept   string
+		Expected string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/csv", "text/csv"},
+		{"text/*", "text/csv"},
+		{"application/xml;q=0.9, text/csv", "text/csv"},
+		{"application/xml, text/csv;q=0.5", "application/xml"},
+		{"application/*, application/xml;q=2", "application/xml"},
+		{"application/json;q=0, */*", "application/xml"},
+		{"image/png, */*;q=0.1", "application/json"},
+	} {
+		renderer, err := registry.Negotiate(e.Accept)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", e.Accept, err)
+			continue
+		}
+		if contentType := renderer.(ContentTyper).ContentType(); contentType != e.Expected {
+			t.Errorf("Expected %s for %q, got %s", e.Expected, e.Accept, contentType)
+		}
+	}
+}
+
+func TestNegotiateFallback(t *testing.T) {
+	registry := NewRendererRegistry()
+	registry.Register("application/json", testRenderer{})
+	registry.Register("application/xml", testRenderer{})
+	registry.Fallback = "application/xml"
+
+	renderer, err := registry.Negotiate("*/*")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if contentType := renderer.(ContentTyper).ContentType(); contentType != "application/xml" {
+		t.Errorf("Unexpected content type: %s", contentType)
+	}
+}
+
+func TestNegotiateNotAcceptable(t *testing.T) {
+	registry := NewRendererRegistry()
+	registry.Register("application/json", testRenderer{})
+
+	renderer, err := registry.Negotiate("image/png, application/json;q=0")
+	if _, ok := err.(fail.NotAcceptableError); !ok {
+		t.Errorf("Expected a NotAcceptableError, got %v", err)
+	}
+	if renderer == nil {
+		t.Errorf("Expected the fallback renderer to be returned")
+	}
+}
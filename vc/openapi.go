@@ -0,0 +1,424 @@
+package vc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/snikch/api/sideload"
+	schema "github.com/xeipuuv/gojsonschema"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification documents are
+// generated for. 3.1 allows request schemas to be embedded as they are.
+const OpenAPIVersion = "3.1.0"
+
+// OpenAPIInfo describes the API in a generated OpenAPI document.
+type OpenAPIInfo struct {
+	Title       string
+	Version     string
+	Description string
+	// Servers are the base URLs the API is served from.
+	Servers []string
+}
+
+// RequestSchemaHandler can be implemented by an ActionHandler to document the
+// schema its request bodies are validated against. Along with SetRequestSchema
+// it's the only way a request schema is documented; schemas passed to
+// UnmarshalAndValidateRequestSchema aren't recorded.
+type RequestSchemaHandler interface {
+	RequestSchema() *schema.Schema
+}
+
+// SetRequestSchema documents the schema request bodies for a single type and
+// action are validated against, for handlers that don't implement
+// RequestSchemaHandler. The schema must be created by MustSchema or
+// MustSchemaFromFile for its source to be included. This should be called
+// during setup, before any requests are being served.
+func (p *ActionProcessor) SetRequestSchema(typ, action string, s *schema.Schema) {
+	if p.RequestSchemas == nil {
+		p.RequestSchemas = map[string]*schema.Schema{}
+	}
+	p.RequestSchemas[typ+"-"+action] = s
+}
+
+// requestSchema returns the source of the request schema for the route.
+func (p *ActionProcessor) requestSchema(route Route) (json.RawMessage, bool) {
+	if handler, ok := route.Handler.(RequestSchemaHandler); ok {
+		if s := handler.RequestSchema(); s != nil {
+			return SchemaSource(s)
+		}
+	}
+	if s, ok := p.RequestSchemas[route.Type+"-"+route.Action]; ok {
+		return SchemaSource(s)
+	}
+	return nil, false
+}
+
+// OpenAPI generates an OpenAPI document describing every route registered
+// via Handle or RegisterResource.
+func (p *ActionProcessor) OpenAPI(info OpenAPIInfo) map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	operationIDs := map[string]bool{}
+	for _, route := range p.routes {
+		path, params := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+
+		// PUT and PATCH routes share an action, so the method is added to
+		// keep operation ids unique.
+		operationID := route.Type + "-" + route.Action
+		if operationIDs[operationID] {
+			operationID += "-" + strings.ToLower(route.Method)
+		}
+		operationIDs[operationID] = true
+
+		// Include the payload's schema in the response if it is known.
+		responseSchema := map[string]interface{}{"$ref": "#/components/schemas/Response"}
+		if s, ok := p.ResponseSchemas[route.Type+"-"+route.Action]; ok {
+			if source, ok := SchemaSource(s); ok {
+				responseSchema = map[string]interface{}{
+					"allOf": []interface{}{
+						responseSchema,
+						map[string]interface{}{
+							"properties": map[string]interface{}{"payload": source},
+						},
+					},
+				}
+			}
+		}
+
+		operation := map[string]interface{}{
+			"operationId": operationID,
+			"tags":        []string{route.Type},
+			"parameters":  append(params, p.openAPIQueryParameters(route)...),
+			"responses": map[string]interface{}{
+				"2XX": map[string]interface{}{
+					"description": "The " + route.Type + " " + route.Action + " response.",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": responseSchema,
+						},
+					},
+				},
+				"default": map[string]interface{}{
+					"description": "An error response.",
+					"content":     p.openAPIErrorContent(),
+				},
+			},
+		}
+		if source, ok := p.requestSchema(route); ok {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": source,
+					},
+				},
+			}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	infoObject := map[string]interface{}{
+		"title":   info.Title,
+		"version": info.Version,
+	}
+	if info.Description != "" {
+		infoObject["description"] = info.Description
+	}
+	document := map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info":    infoObject,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"APIError": openAPIErrorSchema(),
+				"Problem":  openAPIProblemSchema(),
+				"Response": openAPIResponseSchema(),
+			},
+		},
+	}
+	if len(info.Servers) > 0 {
+		servers := []map[string]string{}
+		for _, url := range info.Servers {
+			servers = append(servers, map[string]string{"url": url})
+		}
+		document["servers"] = servers
+	}
+	return document
+}
+
+// WriteOpenAPI writes the OpenAPI document as indented JSON.
+func (p *ActionProcessor) WriteOpenAPI(w io.Writer, info OpenAPIInfo) error {
+	body, err := json.MarshalIndent(p.OpenAPI(info), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
+// OpenAPIHandler returns a handler that serves the OpenAPI document. Routes
+// registered after the handler is created are included.
+func (p *ActionProcessor) OpenAPIHandler(info OpenAPIInfo) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := p.WriteOpenAPI(w, info); err != nil {
+			RespondWithError(w, r, err)
+		}
+	}
+}
+
+// OpenAPICommand exports the OpenAPI document when the arguments, usually
+// os.Args[1:], are "openapi" optionally followed by a file to write to,
+// otherwise it is written to stdout. Routes must be registered beforehand.
+// It returns true if the command was run, in which case the service should
+// exit rather than start serving.
+//
+//	if ok, err := p.OpenAPICommand(info, os.Args[1:]); ok {
+//		...
+//	}
+func (p *ActionProcessor) OpenAPICommand(info OpenAPIInfo, args []string) (bool, error) {
+	if len(args) == 0 || args[0] != "openapi" {
+		return false, nil
+	}
+	if len(args) == 1 || args[1] == "-" {
+		return true, p.WriteOpenAPI(os.Stdout, info)
+	}
+	file, err := os.Create(args[1])
+	if err != nil {
+		return true, err
+	}
+	if err := p.WriteOpenAPI(file, info); err != nil {
+		file.Close()
+		return true, err
+	}
+	return true, file.Close()
+}
+
+// openAPIPath converts a router path to an OpenAPI path, returning the path
+// parameters it contains.
+func openAPIPath(path string) (string, []interface{}) {
+	params := []interface{}{}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			continue
+		}
+		name := segment[1:]
+		segments[i] = "{" + name + "}"
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// openAPIQueryParameters describes the query parameters RequestCriteria reads
+// for the route. Collection parameters are only described for list routes,
+// along with the sort columns and filters registered for the type.
+func (p *ActionProcessor) openAPIQueryParameters(route Route) []interface{} {
+	params := []interface{}{}
+	include := map[string]interface{}{"type": "string"}
+	if types := sideload.EntityTypes(); len(types) > 0 {
+		include["enum"] = types
+	}
+	if p.SideloadEnabled {
+		params = append(params, openAPIQueryParameter(SideloadQueryKey, "Related entities to include.", map[string]interface{}{
+			"type":  "array",
+			"items": include,
+		}))
+	}
+	params = append(params, openAPIQueryParameter(FieldsQueryKey, "A comma separated list of fields to render for the payload. Use "+FieldsQueryKey+"[type] to restrict related entities.", map[string]string{"type": "string"}))
+
+	if route.Method != "GET" || route.Action != ListAction {
+		return params
+	}
+
+	maxLimit := MaxLimit
+	sortDescription := "A comma separated list of columns to sort by, prefixed with a minus for descending order."
+	if collection, ok := collectionRegistry[route.Type]; ok {
+		if collection.MaxLimit > 0 {
+			maxLimit = collection.MaxLimit
+		}
+		if len(collection.SortableColumns) > 0 {
+			sortDescription += " Sortable columns: " + strings.Join(collection.SortableColumns, ", ") + "."
+		}
+	}
+	limit := map[string]interface{}{"type": "integer", "minimum": 1}
+	if maxLimit > 0 {
+		limit["maximum"] = maxLimit
+	}
+	params = append(params,
+		openAPIQueryParameter(SortQueryKey, sortDescription, map[string]string{"type": "string"}),
+		openAPIQueryParameter(LimitQueryKey, "The number of results to return.", limit),
+		openAPIQueryParameter(PageSizeQueryKey, "An alias of "+LimitQueryKey+".", limit),
+		openAPIQueryParameter(PageAfterQueryKey, "A cursor to return results after.", map[string]string{"type": "string"}),
+		openAPIQueryParameter(PageBeforeQueryKey, "A cursor to return results before.", map[string]string{"type": "string"}),
+		openAPIQueryParameter(FromQueryKey, "Only return entities updated after this time.", map[string]string{"type": "string", "format": "date-time"}),
+		openAPIQueryParameter(StateQueryKey, "Entity states to return.", map[string]interface{}{
+			"type":  "array",
+			"items": map[string]string{"type": "string"},
+		}),
+	)
+
+	fields := filterRegistry[route.Type]
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := fields[name]
+		for _, operator := range field.Operators {
+			key := fmt.Sprintf("%s[%s][%s]", FilterQueryKey, name, operator)
+			description := fmt.Sprintf("Filter by %s using the %s operator.", name, operator)
+			if operator.multiValue() {
+				description += " Accepts a comma separated list."
+			}
+			params = append(params, openAPIQueryParameter(key, description, openAPIFilterSchema(field.Type, operator)))
+		}
+	}
+	return params
+}
+
+// openAPIQueryParameter describes a single optional query parameter.
+func openAPIQueryParameter(name, description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      schema,
+	}
+}
+
+// openAPIFilterSchema returns the schema for a filter value.
+func openAPIFilterSchema(typ FilterType, operator FilterOperator) map[string]string {
+	if operator == FilterNull {
+		return map[string]string{"type": "boolean"}
+	}
+	if operator.multiValue() {
+		return map[string]string{"type": "string"}
+	}
+	switch typ {
+	case FilterNumber:
+		return map[string]string{"type": "number"}
+	case FilterTime:
+		return map[string]string{"type": "string", "format": "date-time"}
+	case FilterBool:
+		return map[string]string{"type": "boolean"}
+	}
+	return map[string]string{"type": "string"}
+}
+
+// openAPIErrorContent describes the content of error responses, in the
+// processor's error format.
+func (p *ActionProcessor) openAPIErrorContent() map[string]interface{} {
+	if p.ErrorFormat == ErrorFormatProblem {
+		return map[string]interface{}{
+			ProblemMediaType: map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": map[string]interface{}{"$ref": "#/components/schemas/APIError"},
+		},
+	}
+}
+
+// openAPIProblemSchema describes Problem.
+func openAPIProblemSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"type", "title", "status"},
+		"properties": map[string]interface{}{
+			"type":        map[string]string{"type": "string", "format": "uri-reference"},
+			"title":       map[string]string{"type": "string"},
+			"status":      map[string]string{"type": "integer"},
+			"detail":      map[string]string{"type": "string"},
+			"instance":    map[string]string{"type": "string", "format": "uri-reference"},
+			"code":        map[string]string{"type": "integer"},
+			"description": map[string]string{"type": "string"},
+			"fields": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]string{"type": "string"},
+			},
+			"docs_url": map[string]string{"type": "string", "format": "uri"},
+			"errors":   openAPIFieldErrorsSchema(),
+			"id":       map[string]string{"type": "string"},
+		},
+	}
+}
+
+// openAPIErrorSchema describes APIError.
+func openAPIErrorSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": map[string]interface{}{
+			"error":       map[string]string{"type": "string"},
+			"description": map[string]string{"type": "string"},
+			"code":        map[string]string{"type": "integer"},
+			"fields": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]string{"type": "string"},
+			},
+			"docs_url": map[string]string{"type": "string", "format": "uri"},
+			"errors":   openAPIFieldErrorsSchema(),
+		},
+	}
+}
+
+// openAPIFieldErrorsSchema describes fail.FieldErrors.
+func openAPIFieldErrorsSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "array",
+		"items": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"path", "message"},
+			"properties": map[string]interface{}{
+				"path":    map[string]string{"type": "string", "format": "json-pointer"},
+				"code":    map[string]string{"type": "string"},
+				"message": map[string]string{"type": "string"},
+			},
+		},
+	}
+}
+
+// openAPIResponseSchema describes Response.
+func openAPIResponseSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"payload"},
+		"properties": map[string]interface{}{
+			"payload": map[string]interface{}{},
+			"related": map[string]interface{}{
+				"type":        "object",
+				"description": "Related entities, keyed by type then id.",
+				"additionalProperties": map[string]interface{}{
+					"type": "object",
+				},
+			},
+			"pagination": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"size": map[string]string{"type": "integer"},
+					"next": map[string]string{"type": "string"},
+					"prev": map[string]string{"type": "string"},
+				},
+			},
+		},
+	}
+}
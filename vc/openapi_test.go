@@ -0,0 +1,75 @@
+package vc
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestOpenAPI(t *testing.T) {
+	p := NewActionProcessor()
+	handler := ActionHandlerFunc{}
+	RegisterCollection("openapi_things", Collection{SortableColumns: []string{"name"}, MaxLimit: 20})
+	RegisterFilterableFields("openapi_things", map[string]FilterField{
+		"amount": {Type: FilterNumber, Operators: []FilterOperator{FilterGreaterOrEqual}},
+	})
+	p.RegisterResource(httprouter.New(), Resource{
+		Name:   "openapi_things",
+		List:   handler,
+		Create: handler,
+		Update: handler,
+	})
+	p.SetRequestSchema("openapi_things", CreateAction, MustSchema(`{"type":"object","required":["name"]}`))
+
+	buf := bytes.Buffer{}
+	if err := p.WriteOpenAPI(&buf, OpenAPIInfo{Title: "Things", Version: "1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	document := struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Parameters  []struct {
+				Name   string                 `json:"name"`
+				In     string                 `json:"in"`
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"parameters"`
+			RequestBody *struct {
+				Content map[string]struct {
+					Schema map[string]interface{} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+		} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), &document); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	list := document.Paths["/openapi_things"]["get"]
+	params := map[string]map[string]interface{}{}
+	for _, param := range list.Parameters {
+		params[param.Name] = param.Schema
+	}
+	if params["limit"]["maximum"] != float64(20) {
+		t.Errorf("Expected the collection's max limit, got %v", params["limit"])
+	}
+	if params["filter[amount][gte]"]["type"] != "number" {
+		t.Errorf("Expected a number filter, got %v", params["filter[amount][gte]"])
+	}
+
+	create := document.Paths["/openapi_things"]["post"]
+	if create.RequestBody == nil || create.RequestBody.Content["application/json"].Schema["type"] != "object" {
+		t.Errorf("Expected the request schema on create, got %+v", create.RequestBody)
+	}
+
+	put := document.Paths["/openapi_things/{id}"]["put"]
+	patch := document.Paths["/openapi_things/{id}"]["patch"]
+	if put.OperationID == patch.OperationID {
+		t.Errorf("Expected unique operation ids, got %s", put.OperationID)
+	}
+	if len(put.Parameters) == 0 || put.Parameters[0].Name != "id" || put.Parameters[0].In != "path" {
+		t.Errorf("Expected an id path parameter, got %+v", put.Parameters)
+	}
+}
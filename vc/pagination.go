@@ -0,0 +1,213 @@
+package vc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/snikch/api/ctx"
+)
+
+// CursorSecret is the key used to sign and verify cursor tokens, so clients
+// can't craft their own cursors. It must be set before cursors can be used,
+// and be the same across every instance serving the api.
+var CursorSecret []byte
+
+var (
+	// ErrNoCursorSecret is returned when encoding or decoding a cursor without
+	// a CursorSecret set.
+	ErrNoCursorSecret = errors.New("No vc.CursorSecret has been set")
+	// ErrInvalidCursor is returned when a cursor token is malformed, or its
+	// signature doesn't match.
+	ErrInvalidCursor = errors.New("Invalid cursor")
+)
+
+// Cursor represents a position in an ordered collection. Values holds the
+// ordering column values of the item at the position, keyed by column name.
+// Values round trip through json, so numbers are returned as float64 and
+// times as RFC 3339 strings.
+type Cursor struct {
+	Values map[string]interface{} `json:"v"`
+	// Type, Sort and Backwards bind the cursor to the entity type, ordering
+	// and direction it was issued for, so it is rejected by any other. They
+	// are set by Paginate. Backwards is set for cursors used with
+	// page[before].
+	Type      string `json:"t,omitempty"`
+	Sort      string `json:"s,omitempty"`
+	Backwards bool   `json:"b,omitempty"`
+}
+
+// matches returns true if the cursor was issued for the type, sort and
+// direction.
+func (cursor Cursor) matches(typ, sort string, backwards bool) bool {
+	return cursor.Type == typ && cursor.Sort == sort && cursor.Backwards == backwards
+}
+
+// Token returns an opaque, signed representation of the cursor.
+func (cursor Cursor) Token() (string, error) {
+	if len(CursorSecret) == 0 {
+		return "", ErrNoCursorSecret
+	}
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(cursorSignature(payload)), nil
+}
+
+// ParseCursor verifies and decodes a cursor token created by Cursor.Token.
+func ParseCursor(token string) (*Cursor, error) {
+	if len(CursorSecret) == 0 {
+		return nil, ErrNoCursorSecret
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if !hmac.Equal(signature, cursorSignature(payload)) {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &Cursor{}
+	if err := json.Unmarshal(payload, cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// cursorSignature returns the HMAC of the payload using the CursorSecret.
+func cursorSignature(payload []byte) []byte {
+	mac := hmac.New(sha256.New, CursorSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// CursorFromItem builds a cursor from an item in a collection. The columns are
+// the json names of the fields the collection is ordered by.
+func CursorFromItem(item interface{}, columns ...string) (Cursor, error) {
+	cursor := Cursor{
+		Values: map[string]interface{}{},
+	}
+	for _, column := range columns {
+		field, ok := jsonFieldValue(reflect.ValueOf(item), column)
+		if !ok {
+			return cursor, fmt.Errorf("Cursor column %s not found on %T", column, item)
+		}
+		cursor.Values[column] = field.Interface()
+	}
+	return cursor, nil
+}
+
+// Pagination represents the position of a page within a collection.
+type Pagination struct {
+	Size   int    `json:"size,omitempty"`
+	Next   string `json:"next,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+	After  string `json:"-"`
+	Before string `json:"-"`
+}
+
+// Paginate builds the pagination for a page of items being returned by an
+// action, and stores it on the context so it is rendered with the response.
+// The items must be a slice in display order, hasMore should be true if more
+// items exist beyond the page in the direction being paged, and columns are
+// the json names of the fields the collection is ordered by.
+func Paginate(context *ctx.Context, items interface{}, hasMore bool, columns ...string) (*Pagination, error) {
+	value := reflect.Indirect(reflect.ValueOf(items))
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, fmt.Errorf("Paginate requires a slice, got %T", items)
+	}
+
+	criteria := ContextCriteria(context)
+	pagination := &Pagination{
+		Size: criteria.Limit,
+	}
+	if value.Len() > 0 {
+		backwards := criteria.Before != nil
+		// There is a next page if we're going forwards and have more, or if
+		// we've come backwards from a later item.
+		if hasMore || backwards {
+			cursor, err := CursorFromItem(value.Index(value.Len()-1).Interface(), columns...)
+			if err != nil {
+				return nil, err
+			}
+			cursor.Type, cursor.Sort = criteria.typ, criteria.sort
+			if pagination.After, err = cursor.Token(); err != nil {
+				return nil, err
+			}
+		}
+		// There is a previous page if we're going backwards and have more, or
+		// if we've come forwards from an earlier item.
+		if hasMore && backwards || criteria.After != nil {
+			cursor, err := CursorFromItem(value.Index(0).Interface(), columns...)
+			if err != nil {
+				return nil, err
+			}
+			cursor.Type, cursor.Sort, cursor.Backwards = criteria.typ, criteria.sort, true
+			if pagination.Before, err = cursor.Token(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	SetContextPagination(context, pagination)
+	return pagination, nil
+}
+
+// SetContextPagination sets the pagination against a context.
+func SetContextPagination(context *ctx.Context, pagination *Pagination) {
+	context.Set(paginationContextKey, pagination)
+}
+
+// ContextPagination returns the pagination for the supplied context, if any.
+func ContextPagination(context *ctx.Context) *Pagination {
+	pagination, _ := context.Get(paginationContextKey).(*Pagination)
+	return pagination
+}
+
+// resolve fills in the Next and Prev links relative to the supplied request.
+func (pagination *Pagination) resolve(r *http.Request) {
+	if pagination.After != "" {
+		pagination.Next = pageURL(r, PageAfterQueryKey, pagination.After)
+	}
+	if pagination.Before != "" {
+		pagination.Prev = pageURL(r, PageBeforeQueryKey, pagination.Before)
+	}
+}
+
+// LinkHeader returns an RFC 8288 Link header value for the pagination.
+func (pagination Pagination) LinkHeader() string {
+	links := []string{}
+	if pagination.Next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pagination.Next))
+	}
+	if pagination.Prev != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pagination.Prev))
+	}
+	return strings.Join(links, ", ")
+}
+
+// pageURL returns the request url with its cursor replaced by the supplied one.
+func pageURL(r *http.Request, key, token string) string {
+	query := r.URL.Query()
+	query.Del(PageAfterQueryKey)
+	query.Del(PageBeforeQueryKey)
+	query.Set(key, token)
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
@@ -0,0 +1,121 @@
+package vc
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+type testPaginatedItem struct {
+	ID        string `json:"id"`
+	CreatedAt int    `json:"created_at,omitempty"`
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	CursorSecret = []byte("secret")
+	cursor, err := CursorFromItem(testPaginatedItem{"i1", 10}, "created_at", "id")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	token, err := cursor.Token()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	parsed, err := ParseCursor(token)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if parsed.Values["id"] != "i1" || parsed.Values["created_at"] != float64(10) {
+		t.Errorf("Unexpected cursor values: %v", parsed.Values)
+	}
+
+	// Changing the secret invalidates every issued token.
+	CursorSecret = []byte("other")
+	if _, err := ParseCursor(token); err != ErrInvalidCursor {
+		t.Errorf("Expected an invalid cursor error, got %v", err)
+	}
+}
+
+func TestRequestCriteriaPagination(t *testing.T) {
+	RegisterCollection("items", Collection{SortableColumns: []string{"id"}})
+	CursorSecret = []byte("secret")
+	token, _ := Cursor{Values: map[string]interface{}{"id": "i1"}, Type: "items"}.Token()
+
+	r, _ := http.NewRequest("GET", "/items?page[size]=2&page[after]="+token, nil)
+	criteria, err := RequestTypeCriteria(r, "items")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if criteria.Limit != 2 || criteria.After == nil || criteria.After.Values["id"] != "i1" {
+		t.Errorf("Unexpected criteria: %+v", criteria)
+	}
+
+	r, _ = http.NewRequest("GET", "/items?page[size]=0&page[after]=nope", nil)
+	_, err = RequestTypeCriteria(r, "items")
+	badRequest, ok := err.(fail.BadRequestError)
+	if !ok {
+		t.Errorf("Expected a BadRequestError, got %v", err)
+		return
+	}
+	if len(badRequest.ErrorFields()) != 2 {
+		t.Errorf("Unexpected error fields: %v", badRequest.ErrorFields())
+	}
+
+	// Cursors are bound to the type, sort and direction they were issued for.
+	for name, cursor := range map[string]Cursor{
+		"type":      {Type: "others"},
+		"sort":      {Type: "items", Sort: "-id"},
+		"direction": {Type: "items", Backwards: true},
+	} {
+		token, _ := cursor.Token()
+		r, _ = http.NewRequest("GET", "/items?page[after]="+token, nil)
+		if _, err := RequestTypeCriteria(r, "items"); err == nil {
+			t.Errorf("%s: expected a mismatched cursor to be rejected", name)
+		}
+	}
+
+	// Cursors can't be used without a secret, which is the server's fault.
+	CursorSecret = nil
+	defer func() { CursorSecret = []byte("secret") }()
+	r, _ = http.NewRequest("GET", "/items?page[after]="+token, nil)
+	if _, err = RequestTypeCriteria(r, "items"); !errors.Is(err, fail.ErrPrivate) {
+		t.Errorf("Expected a private error, got %v", err)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	CursorSecret = []byte("secret")
+	r, _ := http.NewRequest("GET", "/items?page[size]=2", nil)
+	criteria, _ := RequestTypeCriteria(r, "items")
+	context := ctx.NewContext()
+	SetContextCriteria(context, criteria)
+
+	pagination, err := Paginate(context, []testPaginatedItem{{"i1", 1}, {"i2", 2}}, true, "id")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if pagination.After == "" || pagination.Before != "" {
+		t.Errorf("Expected only a next page: %+v", pagination)
+	}
+	pagination.resolve(r)
+	if pagination.LinkHeader() != `<`+pagination.Next+`>; rel="next"` {
+		t.Errorf("Unexpected link header: %s", pagination.LinkHeader())
+	}
+	if ContextPagination(context) != pagination {
+		t.Errorf("Expected pagination to be stored on the context")
+	}
+
+	// The next page's cursor is accepted by the next request.
+	r, _ = http.NewRequest("GET", pagination.Next, nil)
+	if criteria, err := RequestTypeCriteria(r, "items"); err != nil || criteria.After == nil {
+		t.Errorf("Expected the next page's cursor to be accepted, got %v", err)
+	}
+}
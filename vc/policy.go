@@ -0,0 +1,256 @@
+package vc
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// The codes used for errors returned by the built in policies. These are
+// stable, so clients can rely on them, and are registered in the fail error
+// code catalog, in the range reserved by fail.ReservedCodeMin.
+const (
+	ErrorCodeAuthenticationRequired = 2001
+	ErrorCodeRoleRequired           = 2002
+	ErrorCodeScopeRequired          = 2003
+	ErrorCodeAccessDenied           = 2004
+)
+
+func init() {
+	fail.RegisterCode(fail.ErrorCode{
+		Code:        ErrorCodeAuthenticationRequired,
+		Name:        "authentication_required",
+		Status:      http.StatusUnauthorized,
+		Description: "You need to be authenticated to do that.",
+	})
+	fail.RegisterCode(fail.ErrorCode{
+		Code:        ErrorCodeRoleRequired,
+		Name:        "role_required",
+		Status:      http.StatusForbidden,
+		Description: "You don’t have a role that’s allowed to do that.",
+	})
+	fail.RegisterCode(fail.ErrorCode{
+		Code:        ErrorCodeScopeRequired,
+		Name:        "scope_required",
+		Status:      http.StatusForbidden,
+		Description: "You haven’t been granted access to do that.",
+	})
+	fail.RegisterCode(fail.ErrorCode{
+		Code:        ErrorCodeAccessDenied,
+		Name:        "access_denied",
+		Status:      http.StatusForbidden,
+		Description: "You don’t have permission to do that.",
+	})
+}
+
+// RoleActor can be implemented by an Actor to be authorized by role.
+type RoleActor interface {
+	Roles() []string
+}
+
+// ScopedActor can be implemented by an Actor to be authorized by the scopes
+// it has been granted.
+type ScopedActor interface {
+	Scopes() []string
+}
+
+// EntityLoader can be implemented by an ActionHandler to load the entity an
+// action applies to before policies are evaluated, so they can inspect it.
+// The entity is available to HandleAction via ContextEntity, to avoid loading
+// it twice.
+type EntityLoader interface {
+	LoadEntity(*ctx.Context) (interface{}, error)
+}
+
+// SetContextEntity sets the entity an action applies to against a context.
+func SetContextEntity(context *ctx.Context, entity interface{}) {
+	context.Set(entityContextKey, entity)
+}
+
+// ContextEntity returns the entity loaded by an EntityLoader for the supplied
+// context, if any.
+func ContextEntity(context *ctx.Context) interface{} {
+	return context.Get(entityContextKey)
+}
+
+// PolicyRequest is everything a policy can use to authorize a request.
+type PolicyRequest struct {
+	Context *ctx.Context
+	Type    string
+	Action  string
+	// Actor is nil for anonymous requests.
+	Actor  Actor
+	Params httprouter.Params
+	// Entity is the entity loaded by an EntityLoader, if any.
+	Entity interface{}
+}
+
+// Policy authorizes a request, returning an error if it is denied. Errors
+// should generally be a fail.PermissionsError, or a fail.AuthenticationError
+// if the request needs an actor.
+type Policy interface {
+	Authorize(PolicyRequest) error
+}
+
+// PolicyFunc wraps a function with the Authorize signature to a Policy.
+type PolicyFunc func(PolicyRequest) error
+
+// Authorize implements the Policy interface and simply calls the function.
+func (fn PolicyFunc) Authorize(request PolicyRequest) error {
+	return fn(request)
+}
+
+// Policies holds the policies registered for each type and action. Every
+// policy registered for an action must allow a request for it to be handled.
+type Policies struct {
+	// DenyUnregistered denies requests to any action without a policy, which
+	// ensures new actions can't be released without one.
+	DenyUnregistered bool
+	policies         map[string][]Policy
+}
+
+// NewPolicies returns an initialized Policies.
+func NewPolicies() *Policies {
+	return &Policies{
+		policies: map[string][]Policy{},
+	}
+}
+
+// Register adds policies for a type and action, which are the same names
+// passed to HTTPHandler. An action of "*" applies the policies to every action
+// of the type. This should be called during setup, before any requests are
+// being served.
+func (policies *Policies) Register(typ, action string, policy ...Policy) {
+	if policies.policies == nil {
+		policies.policies = map[string][]Policy{}
+	}
+	policies.policies[typ+"-"+action] = append(policies.policies[typ+"-"+action], policy...)
+}
+
+// Authorize evaluates every policy for the request's type and action,
+// returning the first error.
+func (policies *Policies) Authorize(request PolicyRequest) error {
+	registered := append(
+		append([]Policy{}, policies.policies[request.Type+"-*"]...),
+		policies.policies[request.Type+"-"+request.Action]...,
+	)
+	if len(registered) == 0 && policies.DenyUnregistered {
+		return fail.NewPermissionsError(ErrorCodeAccessDenied, "No policy allows this action")
+	}
+	for _, policy := range registered {
+		if err := policy.Authorize(request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorize loads the entity if the handler is an EntityLoader, then
+// evaluates the processor's policies for the request.
+func (p *ActionProcessor) authorize(context *ctx.Context, typ, action string, handler ActionHandler) error {
+	request := PolicyRequest{
+		Context: context,
+		Type:    typ,
+		Action:  action,
+		Params:  ContextParams(context),
+	}
+	request.Actor, _ = ContextActor(context)
+	if loader, ok := handler.(EntityLoader); ok {
+		entity, err := loader.LoadEntity(context)
+		if err != nil {
+			return err
+		}
+		SetContextEntity(context, entity)
+		request.Entity = entity
+	}
+	return p.Policies.Authorize(request)
+}
+
+// Allow is a policy that allows every request, for actions that are public
+// when DenyUnregistered is set.
+var Allow Policy = PolicyFunc(func(PolicyRequest) error {
+	return nil
+})
+
+// RequireActor is a policy that allows any authenticated actor.
+var RequireActor Policy = PolicyFunc(func(request PolicyRequest) error {
+	if request.Actor == nil {
+		return authenticationRequired()
+	}
+	return nil
+})
+
+// authenticationRequired returns the error for an anonymous request that needs
+// an actor.
+func authenticationRequired() error {
+	return fail.NewAuthError(ErrorCodeAuthenticationRequired, "Authentication required")
+}
+
+// RequireRole returns a policy that allows actors with any of the roles.
+func RequireRole(roles ...string) Policy {
+	return PolicyFunc(func(request PolicyRequest) error {
+		if request.Actor == nil {
+			return authenticationRequired()
+		}
+		if actor, ok := request.Actor.(RoleActor); ok && containsAny(actor.Roles(), roles) {
+			return nil
+		}
+		err := fail.NewPermissionsError(ErrorCodeRoleRequired, "Missing required role")
+		err.WithField("roles", strings.Join(roles, " "))
+		return err
+	})
+}
+
+// RequireScope returns a policy that allows actors granted every scope.
+func RequireScope(scopes ...string) Policy {
+	return PolicyFunc(func(request PolicyRequest) error {
+		if request.Actor == nil {
+			return authenticationRequired()
+		}
+		granted := []string{}
+		if actor, ok := request.Actor.(ScopedActor); ok {
+			granted = actor.Scopes()
+		}
+		missing := []string{}
+		for _, scope := range scopes {
+			if !containsAny(granted, []string{scope}) {
+				missing = append(missing, scope)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		err := fail.NewPermissionsError(ErrorCodeScopeRequired, "Missing required scope")
+		err.WithField("scopes", strings.Join(missing, " "))
+		return err
+	})
+}
+
+// AnyOf returns a policy that allows requests allowed by any of the policies.
+// If every policy denies the request, the last error is returned.
+func AnyOf(policies ...Policy) Policy {
+	return PolicyFunc(func(request PolicyRequest) error {
+		var err error = fail.NewPermissionsError(ErrorCodeAccessDenied, "No policy allows this action")
+		for _, policy := range policies {
+			if err = policy.Authorize(request); err == nil {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// containsAny returns true if any of the values are in the slice.
+func containsAny(slice, values []string) bool {
+	for _, item := range slice {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
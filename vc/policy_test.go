@@ -0,0 +1,83 @@
+package vc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+type testActor struct {
+	roles  []string
+	scopes []string
+}
+
+func (actor testActor) ActorInfo() (string, string) { return "a1", "user" }
+func (actor testActor) Roles() []string             { return actor.roles }
+func (actor testActor) Scopes() []string            { return actor.scopes }
+
+type testAuthenticator struct{ actor Actor }
+
+func (authenticator testAuthenticator) Authenticate(*ctx.Context) (Actor, error) {
+	return authenticator.actor, nil
+}
+
+func TestPolicies(t *testing.T) {
+	policies := NewPolicies()
+	policies.Register("things", "*", RequireActor)
+	policies.Register("things", "read", RequireScope("things:read"))
+	policies.Register("things", "delete", AnyOf(RequireRole("admin"), PolicyFunc(func(request PolicyRequest) error {
+		if request.Entity == "owned" {
+			return nil
+		}
+		return fail.NewPermissionsError(ErrorCodeAccessDenied, "Not the owner")
+	})))
+
+	for name, test := range map[string]struct {
+		actor  Actor
+		action string
+		entity interface{}
+		code   int
+	}{
+		"anonymous":     {nil, "read", nil, ErrorCodeAuthenticationRequired},
+		"scope":         {testActor{scopes: []string{"things:read"}}, "read", nil, 0},
+		"missing scope": {testActor{}, "read", nil, ErrorCodeScopeRequired},
+		"role":          {testActor{roles: []string{"admin"}}, "delete", nil, 0},
+		"owner":         {testActor{}, "delete", "owned", 0},
+		"not owner":     {testActor{}, "delete", "other", ErrorCodeAccessDenied},
+		"unregistered":  {testActor{}, "update", nil, 0},
+	} {
+		err := policies.Authorize(PolicyRequest{Type: "things", Action: test.action, Actor: test.actor, Entity: test.entity})
+		code := 0
+		if codeErr, ok := err.(interface{ ErrorCode() int }); ok {
+			code = codeErr.ErrorCode()
+		}
+		if code != test.code {
+			t.Errorf("%s: expected code %d, got %v", name, test.code, err)
+		}
+	}
+
+	policies.DenyUnregistered = true
+	if err := policies.Authorize(PolicyRequest{Type: "others", Action: "read"}); err == nil {
+		t.Errorf("Expected an unregistered action to be denied")
+	}
+}
+
+func TestAuthorizedAction(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.Authenticator = testAuthenticator{testActor{}}
+	p.Policies = NewPolicies()
+	p.Policies.Register("things", "GET", RequireRole("admin"))
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		t.Errorf("The handler shouldn't be called")
+		return nil, 0, nil
+	}
+
+	w := serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a 403, got %d %s", w.Code, w.Body)
+	}
+}
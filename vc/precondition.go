@@ -0,0 +1,135 @@
+package vc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/snikch/api/changes"
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// PreconditionHandler can be implemented by an ActionHandler to load the
+// current state of the entity an action mutates. The ActionProcessor then
+// checks the request's If-Match header against the entity's version before
+// HandleAction is called, rejecting requests without the header. The loaded
+// entity is available to HandleAction via ContextCurrentEntity, to avoid
+// loading it twice.
+type PreconditionHandler interface {
+	CurrentEntity(*ctx.Context) (Versioned, error)
+}
+
+// VersionHistory can be implemented by a PreconditionHandler to load an entity
+// as it was at a previous version. When a precondition fails, the entity at
+// the client's version is compared with the current entity, and the changed
+// fields are reported in the error.
+type VersionHistory interface {
+	EntityAtVersion(context *ctx.Context, version string) (Versioned, error)
+}
+
+// mutatingRequest returns true if the request method changes an entity.
+func mutatingRequest(r *http.Request) bool {
+	return r.Method == "PUT" || r.Method == "PATCH" || r.Method == "DELETE"
+}
+
+// SetContextCurrentEntity sets the current entity against a context.
+func SetContextCurrentEntity(context *ctx.Context, entity Versioned) {
+	context.Set(currentEntityContextKey, entity)
+}
+
+// ContextCurrentEntity returns the entity loaded by a PreconditionHandler for
+// the supplied context, if any.
+func ContextCurrentEntity(context *ctx.Context) Versioned {
+	entity, _ := context.Get(currentEntityContextKey).(Versioned)
+	return entity
+}
+
+// CheckIfMatch compares the If-Match header on the context's request with the
+// current version of an entity. A fail.PreconditionRequiredError is returned
+// if the header is missing, and a fail.PreconditionFailedError if the entity
+// has changed. Handlers that don't implement PreconditionHandler can call this
+// directly once they've loaded the entity.
+func CheckIfMatch(context *ctx.Context, current Versioned) error {
+	ifMatch := context.Request.Header.Get("If-Match")
+	if ifMatch == "" {
+		return fail.NewPreconditionRequiredError(errors.New("Missing If-Match header"))
+	}
+	candidates := splitETags(ifMatch)
+	if len(candidates) == 0 {
+		return fail.NewPreconditionFailedError(errors.New("If-Match header has no ETags"))
+	}
+	// ETags are compared by the version they contain, ignoring the weak
+	// indicator, rather than with the strong comparison of RFC 7232. Versions
+	// identify the entity itself, and this lets clients of processors using
+	// ETagWeak send back the ETags they were given. The ETags of other
+	// representations, such as sparse or sideloaded responses, hash the
+	// version, so never match and must not be used here.
+	etag := VersionETag(current.Version(), false)
+	for _, candidate := range candidates {
+		if candidate == "*" || VersionETag(ETagVersion(candidate), false) == etag {
+			return nil
+		}
+	}
+	return fail.NewPreconditionFailedError(fmt.Errorf("Entity has changed since version %s", ETagVersion(candidates[0])))
+}
+
+// checkPreconditions loads the current entity from a PreconditionHandler and
+// checks it against the request. If the precondition fails and the handler
+// implements VersionHistory, the changed fields are included in the error.
+func (p *ActionProcessor) checkPreconditions(context *ctx.Context, handler PreconditionHandler) error {
+	current, err := handler.CurrentEntity(context)
+	if err != nil {
+		return err
+	}
+	SetContextCurrentEntity(context, current)
+
+	err = CheckIfMatch(context, current)
+	preconditionErr, ok := err.(fail.PreconditionFailedError)
+	if !ok {
+		return err
+	}
+	history, ok := handler.(VersionHistory)
+	if !ok {
+		return err
+	}
+
+	// Report which fields have changed since the client's version. Only the
+	// first version listed is compared, as clients generally only send one.
+	candidates := splitETags(context.Request.Header.Get("If-Match"))
+	if len(candidates) == 0 {
+		return err
+	}
+	version := ETagVersion(candidates[0])
+	previous, historyErr := history.EntityAtVersion(context, version)
+	if historyErr != nil || previous == nil {
+		return err
+	}
+	diffs, diffErr := p.Differ.Between(previous, current)
+	if diffErr != nil {
+		return err
+	}
+	for key := range diffs {
+		preconditionErr.WithField(key, "Changed since version "+version)
+	}
+	return preconditionErr
+}
+
+// splitETags splits a comma separated list of ETags.
+func splitETags(list string) []string {
+	etags := []string{}
+	for _, etag := range strings.Split(list, ",") {
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// defaultDiffer compares entities using the same names as the json renderer.
+func defaultDiffer() *changes.Differ {
+	return &changes.Differ{
+		KeyMapper: changes.NewTagNameMapper("json"),
+	}
+}
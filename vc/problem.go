@@ -0,0 +1,159 @@
+package vc
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// ProblemMediaType is the media type of RFC 7807 problem details.
+const ProblemMediaType = "application/problem+json"
+
+// ErrorFormat determines how an ActionProcessor renders error responses.
+type ErrorFormat int
+
+const (
+	// ErrorFormatAPIError renders errors as an APIError with the negotiated
+	// renderer.
+	ErrorFormatAPIError ErrorFormat = iota
+	// ErrorFormatProblem renders errors as RFC 7807 problem details, as
+	// application/problem+json.
+	ErrorFormatProblem
+)
+
+// ProblemTypeBaseURI is prefixed to the names of the problem types the fail
+// errors map to. The default is relative, so it resolves against the API's
+// own url, where each type can be documented.
+var ProblemTypeBaseURI = "/problems/"
+
+// Problem is an RFC 7807 problem details object. Code, Description, Fields,
+// DocsURL, Errors and ID are extension members carrying the same information
+// as an APIError.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Code is the error's own code, if it has one.
+	Code        int               `json:"code,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	DocsURL     string            `json:"docs_url,omitempty"`
+	Errors      fail.FieldErrors  `json:"errors,omitempty"`
+	// ID is the tracking id of a fail.Private error.
+	ID string `json:"id,omitempty"`
+}
+
+// ProblemTypeError can be implemented by an error to be rendered as a problem
+// of its own type. The type is a URI, and the title is a short summary that
+// is the same for every occurrence of the type.
+type ProblemTypeError interface {
+	ProblemType() (string, string)
+}
+
+// problemType is the name and title of a built in problem type.
+type problemType struct {
+	name, title string
+}
+
+// problemTypes maps each of the fail error types to a stable problem type.
+var problemTypes = map[reflect.Type]problemType{
+	reflect.TypeOf(fail.BadRequestError{}):           {"bad-request", "Bad request"},
+	reflect.TypeOf(fail.AuthenticationError{}):       {"authentication-required", "Authentication required"},
+	reflect.TypeOf(fail.PermissionsError{}):          {"permission-denied", "Permission denied"},
+	reflect.TypeOf(fail.NotFoundError{}):             {"not-found", "Not found"},
+	reflect.TypeOf(fail.PossibleRowNotFoundError{}):  {"not-found", "Not found"},
+	reflect.TypeOf(fail.NotAcceptableError{}):        {"not-acceptable", "Not acceptable"},
+	reflect.TypeOf(fail.ConflictError{}):             {"conflict", "Conflict"},
+	reflect.TypeOf(fail.PreconditionFailedError{}):   {"precondition-failed", "Precondition failed"},
+	reflect.TypeOf(fail.PreconditionRequiredError{}): {"precondition-required", "Precondition required"},
+	reflect.TypeOf(fail.PayloadTooLargeError{}):      {"payload-too-large", "Payload too large"},
+	reflect.TypeOf(fail.ValidationError{}):           {"validation-failed", "Validation failed"},
+	reflect.TypeOf(fail.MultiError{}):                {"validation-failed", "Validation failed"},
+	reflect.TypeOf(fail.TooManyRequestsError{}):      {"rate-limited", "Too many requests"},
+	reflect.TypeOf(fail.TimeoutError{}):              {"timeout", "Request timed out"},
+	reflect.TypeOf(fail.ServiceUnavailable{}):        {"service-unavailable", "Service unavailable"},
+	reflect.TypeOf(fail.Private{}):                   {"internal-error", "Internal error"},
+}
+
+// NewProblem returns the problem details for an error response. The error
+// should be the one returned to the client, with private errors already
+// masked, along with the APIError and status code generated for it.
+func NewProblem(r *http.Request, err error, apiError APIError, code int) Problem {
+	problem := Problem{
+		Type:        "about:blank",
+		Title:       http.StatusText(code),
+		Status:      code,
+		Detail:      apiError.Error,
+		Code:        apiError.Code,
+		Description: apiError.Description,
+		Fields:      apiError.Fields,
+		DocsURL:     apiError.DocsURL,
+		Errors:      apiError.Errors,
+	}
+	if r != nil {
+		problem.Instance = r.URL.RequestURI()
+	}
+
+	// The type is that of the first error in the tree with a known type,
+	// without looking beyond a private error.
+	visitErrors(err, func(link error) bool {
+		typ := reflect.TypeOf(link)
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typeErr, ok := link.(ProblemTypeError); ok {
+			problem.Type, problem.Title = typeErr.ProblemType()
+			return true
+		}
+		if builtin, ok := problemTypes[typ]; ok {
+			problem.Type = ProblemTypeBaseURI + builtin.name
+			problem.Title = builtin.title
+			return true
+		}
+		return false
+	})
+
+	switch private := err.(type) {
+	case *fail.Private:
+		problem.Detail, problem.ID = private.PublicMessage, private.ID
+	case fail.Private:
+		problem.Detail, problem.ID = private.PublicMessage, private.ID
+	}
+	return problem
+}
+
+// RespondWithProblem will return an error response as problem details, with
+// the appropriate status codes set.
+func RespondWithProblem(w http.ResponseWriter, r *http.Request, err error) {
+	respondWithProblem(w, r, err, false)
+}
+
+// respondWithProblem writes the problem details for an error, reporting
+// whether the error was recovered from a panic.
+func respondWithProblem(w http.ResponseWriter, r *http.Request, err error, panicked bool) {
+	apiError, code, publicErr := logAPIError(r, err, panicked)
+	setErrorHeaders(w, err)
+	body, _ := json.Marshal(NewProblem(r, publicErr, apiError, code))
+	w.Header().Set("Content-Type", ProblemMediaType)
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// requestErrorFormat returns the error format of the ActionProcessor handling
+// the request, if any.
+func requestErrorFormat(r *http.Request) ErrorFormat {
+	if r == nil {
+		return ErrorFormatAPIError
+	}
+	if context, ok := r.Context().(*ctx.Context); ok {
+		if format, ok := context.Get(errorFormatContextKey).(ErrorFormat); ok {
+			return format
+		}
+	}
+	return ErrorFormatAPIError
+}
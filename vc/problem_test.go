@@ -0,0 +1,96 @@
+package vc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+type testProblemError struct{}
+
+func (testProblemError) Error() string   { return "Out of stock" }
+func (testProblemError) StatusCode() int { return http.StatusConflict }
+func (testProblemError) ProblemType() (string, string) {
+	return "https://example.com/out-of-stock", "Out of stock"
+}
+
+func TestProblemDetails(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.ErrorFormat = ErrorFormatProblem
+
+	validationErr := fail.NewValidationError(errors.New("Invalid thing"))
+	validationErr.WithField("name", "Required")
+	for name, test := range map[string]struct {
+		err      error
+		expected Problem
+	}{
+		"validation": {validationErr, Problem{
+			Type:   "/problems/validation-failed",
+			Title:  "Validation failed",
+			Status: http.StatusUnprocessableEntity,
+			Detail: "Invalid thing",
+			Fields: map[string]string{"name": "Required"},
+		}},
+		"private": {errors.New("secret"), Problem{
+			Type:   "/problems/internal-error",
+			Title:  "Internal error",
+			Status: http.StatusInternalServerError,
+			Detail: "An unexpected error occurred",
+		}},
+		"joined": {errors.Join(errors.New("closing rows"), validationErr), Problem{
+			Type:   "/problems/validation-failed",
+			Title:  "Validation failed",
+			Status: http.StatusUnprocessableEntity,
+			Detail: "Invalid thing",
+			Fields: map[string]string{"name": "Required"},
+		}},
+		"custom": {testProblemError{}, Problem{
+			Type:   "https://example.com/out-of-stock",
+			Title:  "Out of stock",
+			Status: http.StatusConflict,
+			Detail: "Out of stock",
+		}},
+	} {
+		err := test.err
+		r := httptest.NewRequest("GET", "/things?page=2", nil)
+		w := serveAction(p, r, func(*ctx.Context) (interface{}, int, error) {
+			return nil, 0, err
+		})
+		if w.Code != test.expected.Status || w.Header().Get("Content-Type") != ProblemMediaType {
+			t.Errorf("%s: unexpected response %d %s", name, w.Code, w.Header().Get("Content-Type"))
+			continue
+		}
+		problem := Problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem.Instance != "/things?page=2" {
+			t.Errorf("%s: unexpected instance %s", name, problem.Instance)
+		}
+		if name == "private" && problem.ID == "" {
+			t.Errorf("%s: expected a tracking id", name)
+		}
+		problem.Instance, problem.ID, problem.Description = "", "", ""
+		expected, _ := json.Marshal(test.expected)
+		actual, _ := json.Marshal(problem)
+		if string(expected) != string(actual) {
+			t.Errorf("%s: expected %s, got %s", name, expected, actual)
+		}
+	}
+
+	// Other processors are unaffected.
+	p = NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	w := serveAction(p, httptest.NewRequest("GET", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		return nil, 0, validationErr
+	})
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected an APIError, got %s %s", w.Header().Get("Content-Type"), w.Body)
+	}
+}
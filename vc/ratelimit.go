@@ -0,0 +1,364 @@
+package vc
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+// RateLimitAlgorithm determines how requests are counted against a limit.
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket allows bursts of up to Limit requests, refilling at a rate
+	// of Limit requests per Window.
+	TokenBucket RateLimitAlgorithm = iota
+	// SlidingWindow allows Limit requests in any Window, estimated from the
+	// counts of the current and previous fixed windows. This suits quotas over
+	// longer windows, such as a day.
+	SlidingWindow
+)
+
+// RateLimit is a number of requests permitted per window.
+type RateLimit struct {
+	Limit     int
+	Window    time.Duration
+	Algorithm RateLimitAlgorithm
+}
+
+// RateLimitResult is the outcome of counting a request against a limit.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the limit is fully available again.
+	Reset time.Duration
+	// RetryAfter is the time until a denied request would be allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore counts requests against limits. Implementations must be safe
+// for concurrent use.
+type RateLimitStore interface {
+	// Take counts a single request for the key against the limit.
+	Take(context *ctx.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	// Refund gives back a request Take allowed for the key, when a later
+	// limit denies it.
+	Refund(context *ctx.Context, key string, limit RateLimit, now time.Time) error
+}
+
+// RateLimiter limits the requests each actor can make. Actors are identified
+// by ActorID, or the client IP for requests without an actor.
+type RateLimiter struct {
+	Store RateLimitStore
+	// Limits apply to every request an actor makes, across all actions.
+	Limits []RateLimit
+	// ActionLimits apply to a single action, keyed by the same "type-action"
+	// name used for metrics, and are counted separately to Limits.
+	ActionLimits map[string][]RateLimit
+}
+
+// NewRateLimiter returns a RateLimiter using the supplied store, applying the
+// limits to every request.
+func NewRateLimiter(store RateLimitStore, limits ...RateLimit) *RateLimiter {
+	return &RateLimiter{
+		Store:        store,
+		Limits:       limits,
+		ActionLimits: map[string][]RateLimit{},
+	}
+}
+
+// SetActionLimits sets the limits for a single type and action. This should be
+// called during setup, before any requests are being served.
+func (limiter *RateLimiter) SetActionLimits(typ, action string, limits ...RateLimit) {
+	if limiter.ActionLimits == nil {
+		limiter.ActionLimits = map[string][]RateLimit{}
+	}
+	limiter.ActionLimits[typ+"-"+action] = limits
+}
+
+// identity returns the key requests from the context's actor are counted by.
+func (limiter *RateLimiter) identity(context *ctx.Context) string {
+	if actor, ok := ContextActor(context); ok {
+		return "actor:" + ActorID(actor)
+	}
+	return "ip:" + ContextClientIP(context)
+}
+
+// SetContextClientIP sets the IP of the client making the request on the
+// context.
+func SetContextClientIP(context *ctx.Context, ip string) {
+	context.Set(clientIPContextKey, ip)
+}
+
+// ContextClientIP returns the IP of the client making the request, as set by
+// the ActionProcessor using its ClientIP function, or otherwise the host of
+// the request's RemoteAddr.
+func ContextClientIP(context *ctx.Context) string {
+	if ip, ok := context.Get(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return clientIP(context.Request, nil)
+}
+
+// clientIP returns the IP of the client making a request, using the supplied
+// function if it isn't nil, or otherwise the host of the RemoteAddr.
+func clientIP(r *http.Request, fn func(*http.Request) string) string {
+	if fn != nil {
+		return fn(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// Take counts the request against every limit for the type and action,
+// stopping at the first limit that denies it. The request is refunded to the
+// limits that allowed it before then, so denied requests aren't counted. The
+// result returned is the denying limit, or otherwise the one with the fewest
+// requests remaining.
+func (limiter *RateLimiter) Take(context *ctx.Context, typ, action string) (RateLimitResult, error) {
+	identity := limiter.identity(context)
+	name := typ + "-" + action
+	result := RateLimitResult{Allowed: true, Remaining: -1}
+	now := time.Now()
+	type taken struct {
+		key   string
+		limit RateLimit
+	}
+	allowed := []taken{}
+	for _, group := range []struct {
+		scope  string
+		limits []RateLimit
+	}{
+		{"*", limiter.Limits},
+		{name, limiter.ActionLimits[name]},
+	} {
+		for _, limit := range group.limits {
+			// Every field of the limit is in the key, so limits only share a
+			// count when they're identical.
+			key := identity + "|" + group.scope + "|" + strconv.Itoa(int(limit.Algorithm)) + "|" + strconv.Itoa(limit.Limit) + "|" + limit.Window.String()
+			limitResult, err := limiter.Store.Take(context, key, limit, now)
+			if err != nil {
+				return result, err
+			}
+			if !limitResult.Allowed {
+				for _, previous := range allowed {
+					if err := limiter.Store.Refund(context, previous.key, previous.limit, now); err != nil {
+						return limitResult, err
+					}
+				}
+				return limitResult, nil
+			}
+			allowed = append(allowed, taken{key, limit})
+			if result.Remaining < 0 || limitResult.Remaining < result.Remaining {
+				result = limitResult
+			}
+		}
+	}
+	return result, nil
+}
+
+// setRateLimitHeaders sets the RateLimit headers for the result, and
+// Retry-After if the request was denied.
+func setRateLimitHeaders(header http.Header, result RateLimitResult) {
+	if result.Limit == 0 {
+		return
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+// ceilSeconds returns the duration in whole seconds, rounded up.
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
+
+// checkRateLimit counts the request against the processor's rate limits,
+// returning a TooManyRequestsError if it should be denied.
+func (p *ActionProcessor) checkRateLimit(context *ctx.Context, w http.ResponseWriter, typ, action string) error {
+	result, err := p.RateLimiter.Take(context, typ, action)
+	if err != nil {
+		return err
+	}
+	setRateLimitHeaders(w.Header(), result)
+	if !result.Allowed {
+		return fail.NewTooManyRequestsError(errors.New("Rate limit exceeded"))
+	}
+	return nil
+}
+
+// MemoryRateLimitStore is an in memory RateLimitStore, suitable for tests and
+// services running as a single instance.
+type MemoryRateLimitStore struct {
+	buckets   map[string]*tokenBucket
+	windows   map[string]*slidingWindow
+	nextSweep time.Time
+	sync.Mutex
+}
+
+// NewMemoryRateLimitStore returns an initialized MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]*tokenBucket{},
+		windows: map[string]*slidingWindow{},
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	window time.Duration
+}
+
+type slidingWindow struct {
+	start    time.Time
+	current  int
+	previous int
+	window   time.Duration
+}
+
+// Take implements the RateLimitStore interface.
+func (store *MemoryRateLimitStore) Take(context *ctx.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	if limit.Limit <= 0 || limit.Window <= 0 {
+		return RateLimitResult{Allowed: true}, nil
+	}
+	store.Lock()
+	defer store.Unlock()
+	if store.buckets == nil {
+		store.buckets = map[string]*tokenBucket{}
+		store.windows = map[string]*slidingWindow{}
+	}
+	store.sweep(now)
+	if limit.Algorithm == SlidingWindow {
+		return store.takeWindow(key, limit, now), nil
+	}
+	return store.takeToken(key, limit, now), nil
+}
+
+// Refund implements the RateLimitStore interface.
+func (store *MemoryRateLimitStore) Refund(context *ctx.Context, key string, limit RateLimit, now time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	if limit.Algorithm == SlidingWindow {
+		window, ok := store.windows[key]
+		if !ok {
+			return nil
+		}
+		switch start := now.Truncate(limit.Window); {
+		case start.Equal(window.start) && window.current > 0:
+			window.current--
+		case start.Sub(window.start) == limit.Window && window.current > 0:
+			// The request was counted in what has just become the previous
+			// window.
+			window.previous, window.current, window.start = window.current-1, 0, start
+		}
+		return nil
+	}
+	if bucket, ok := store.buckets[key]; ok {
+		bucket.tokens = math.Min(float64(limit.Limit), bucket.tokens+1)
+	}
+	return nil
+}
+
+// takeToken takes a token from the key's bucket.
+func (store *MemoryRateLimitStore) takeToken(key string, limit RateLimit, now time.Time) RateLimitResult {
+	capacity := float64(limit.Limit)
+	perSecond := capacity / limit.Window.Seconds()
+	bucket, ok := store.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now, window: limit.Window}
+		store.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+
+	result := RateLimitResult{Limit: limit.Limit}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - bucket.tokens) / perSecond)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsDuration((capacity - bucket.tokens) / perSecond)
+	return result
+}
+
+// takeWindow counts a request in the key's current window.
+func (store *MemoryRateLimitStore) takeWindow(key string, limit RateLimit, now time.Time) RateLimitResult {
+	start := now.Truncate(limit.Window)
+	window, ok := store.windows[key]
+	if !ok {
+		window = &slidingWindow{start: start, window: limit.Window}
+		store.windows[key] = window
+	}
+	switch {
+	case start.Equal(window.start):
+	case start.Sub(window.start) == limit.Window:
+		window.previous, window.current, window.start = window.current, 0, start
+	default:
+		window.previous, window.current, window.start = 0, 0, start
+	}
+
+	// The previous window's count is weighted by how much of it still
+	// overlaps the sliding window.
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(limit.Window)
+	estimate := float64(window.previous)*weight + float64(window.current)
+
+	result := RateLimitResult{
+		Limit: limit.Limit,
+		Reset: limit.Window - elapsed,
+	}
+	if estimate+1 <= float64(limit.Limit) {
+		window.current++
+		estimate++
+		result.Allowed = true
+	} else if window.previous > 0 && float64(window.current) < float64(limit.Limit) {
+		// Wait until enough of the previous window has slid out of view.
+		excess := estimate + 1 - float64(limit.Limit)
+		result.RetryAfter = time.Duration(excess / float64(window.previous) * float64(limit.Window))
+	} else {
+		result.RetryAfter = limit.Window - elapsed
+	}
+	result.Remaining = int(math.Max(0, float64(limit.Limit)-estimate))
+	return result
+}
+
+// sweep removes state that has been idle for longer than its window, at most
+// once a minute.
+func (store *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Before(store.nextSweep) {
+		return
+	}
+	store.nextSweep = now.Add(time.Minute)
+	for key, bucket := range store.buckets {
+		if now.Sub(bucket.last) > bucket.window {
+			delete(store.buckets, key)
+		}
+	}
+	for key, window := range store.windows {
+		if now.Sub(window.start) > 2*window.window {
+			delete(store.windows, key)
+		}
+	}
+}
+
+// secondsDuration converts a number of seconds to a duration.
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,128 @@
+package vc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+func TestTokenBucket(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Limit: 2, Window: time.Second}
+	now := time.Now()
+	for i, expected := range []bool{true, true, false} {
+		result, _ := store.Take(nil, "k", limit, now)
+		if result.Allowed != expected {
+			t.Errorf("Request %d: expected allowed %v, got %+v", i, expected, result)
+		}
+	}
+	// Half the window refills one token.
+	result, _ := store.Take(nil, "k", limit, now.Add(500*time.Millisecond))
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected a refilled token, got %+v", result)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Limit: 2, Window: time.Minute, Algorithm: SlidingWindow}
+	start := time.Now().Truncate(time.Minute)
+	for i, expected := range []bool{true, true, false} {
+		result, _ := store.Take(nil, "k", limit, start.Add(time.Second))
+		if result.Allowed != expected {
+			t.Errorf("Request %d: expected allowed %v, got %+v", i, expected, result)
+		}
+	}
+	// A quarter into the next window, the previous window still counts 1.5.
+	result, _ := store.Take(nil, "k", limit, start.Add(75*time.Second))
+	if result.Allowed || result.RetryAfter != 15*time.Second {
+		t.Errorf("Expected a denial for 15s, got %+v", result)
+	}
+	result, _ = store.Take(nil, "k", limit, start.Add(90*time.Second))
+	if !result.Allowed {
+		t.Errorf("Expected the request to be allowed, got %+v", result)
+	}
+}
+
+func TestRateLimitedAction(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore())
+	p.RateLimiter.SetActionLimits("things", "GET", RateLimit{Limit: 1, Window: time.Hour})
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		return map[string]string{}, 0, nil
+	}
+
+	w := serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected response %d %v", w.Code, w.Header())
+	}
+	w = serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected a 429, got %d %v", w.Code, w.Header())
+	}
+
+	// Other clients have their own limits.
+	r := httptest.NewRequest("GET", "/things", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if w = serveAction(p, r, fn); w.Code != http.StatusOK {
+		t.Errorf("Expected a different client to be allowed, got %d", w.Code)
+	}
+
+	// Limits that only differ by their limit are counted separately.
+	p.RateLimiter.SetActionLimits("things", "GET", RateLimit{Limit: 3, Window: time.Hour, Algorithm: SlidingWindow}, RateLimit{Limit: 2, Window: time.Hour, Algorithm: SlidingWindow})
+	r = httptest.NewRequest("GET", "/things", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	if w = serveAction(p, r, fn); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("Expected each limit to count the request once, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimiterRefunds(t *testing.T) {
+	for _, algorithm := range []RateLimitAlgorithm{TokenBucket, SlidingWindow} {
+		limiter := NewRateLimiter(NewMemoryRateLimitStore(), RateLimit{Limit: 5, Window: time.Hour, Algorithm: algorithm})
+		limiter.SetActionLimits("things", "GET", RateLimit{Limit: 1, Window: time.Hour, Algorithm: algorithm})
+		context := ctx.NewContext()
+		context.Request = httptest.NewRequest("GET", "/things", nil)
+
+		if result, _ := limiter.Take(context, "things", "GET"); !result.Allowed {
+			t.Fatalf("Expected the first request to be allowed, got %+v", result)
+		}
+		if result, _ := limiter.Take(context, "things", "GET"); result.Allowed {
+			t.Fatalf("Expected the action limit to deny the request, got %+v", result)
+		}
+		// The denied request was refunded to the global limit.
+		if result, _ := limiter.Take(context, "things", "LIST"); !result.Allowed || result.Remaining != 3 {
+			t.Errorf("Expected a denied request not to count against earlier limits with %d, got %+v", algorithm, result)
+		}
+	}
+}
+
+type failingAuthenticator struct{}
+
+func (failingAuthenticator) Authenticate(*ctx.Context) (Actor, error) {
+	return nil, fail.NewAuthError(ErrorCodeAccessDenied, "Invalid token")
+}
+
+func TestRateLimitedAuthenticationFailures(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.Authenticator = failingAuthenticator{}
+	p.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), RateLimit{Limit: 1, Window: time.Hour})
+	fn := func(*ctx.Context) (interface{}, int, error) {
+		return map[string]string{}, 0, nil
+	}
+
+	w := serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected a counted 401, got %d %v", w.Code, w.Header())
+	}
+	w = serveAction(p, httptest.NewRequest("GET", "/things", nil), fn)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected repeated authentication failures to be limited, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,64 @@
+package vc
+
+import (
+	"net/http"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/log"
+)
+
+// responseTracker wraps a http.ResponseWriter, recording whether a response
+// has been started so a recovered panic never writes a second one.
+type responseTracker struct {
+	http.ResponseWriter
+	started bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *responseTracker) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *responseTracker) Write(body []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(body)
+}
+
+// Flush implements the http.Flusher interface if the underlying writer does.
+func (w *responseTracker) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// recoverPanic is deferred by HTTPHandler to recover from panics in handlers,
+// sideloading or unlocking. Panics are counted against the action, and are
+// responded to with a private error. If the response has already started,
+// such as a stream, it can't be replaced, so the panic is reported and the
+// handler aborted with http.ErrAbortHandler, so the client sees the response
+// fail rather than a truncated body under a successful status.
+// http.ErrAbortHandler is repanicked, as it is used to deliberately abort a
+// response.
+func recoverPanic(renderer *Renderer, w *responseTracker, r *http.Request, counter metrics.Counter) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+	counter.Inc(1)
+	err := fail.NewPanicError(recovered)
+	if w.started {
+		log.WithError(err).WithFields(map[string]interface{}{
+			"id":             err.ID,
+			"original_error": err.OriginalErr.Error(),
+		}).Error("Recovered from panic after the response started")
+		reportError(r, err, http.StatusInternalServerError, true)
+		panic(http.ErrAbortHandler)
+	}
+	respondWithRenderedError(*renderer, w, r, err, true)
+}
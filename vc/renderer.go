@@ -11,3 +11,16 @@ type Renderer interface {
 	Render(interface{}) ([]byte, error)
 	RenderError(APIError) []byte
 }
+
+// ContentTyper can be implemented by a Renderer to declare the media type of
+// the bodies it renders, which is then used as the response Content-Type.
+type ContentTyper interface {
+	ContentType() string
+}
+
+// setContentType sets the Content-Type header if the renderer declares one.
+func setContentType(renderer Renderer, header map[string][]string) {
+	if typer, ok := renderer.(ContentTyper); ok && typer.ContentType() != "" {
+		header["Content-Type"] = []string{typer.ContentType()}
+	}
+}
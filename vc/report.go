@@ -0,0 +1,49 @@
+package vc
+
+import (
+	"net/http"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/report"
+)
+
+// ErrorReporter receives every error responded with, and every panic
+// recovered by an ActionProcessor, such as a *report.Reporter.
+type ErrorReporter interface {
+	Report(report.Occurrence)
+}
+
+var (
+	// DefaultErrorReporter is the reporter errors are reported to. Errors are
+	// only logged if nil.
+	DefaultErrorReporter ErrorReporter
+	// RequestIDHeader is the request header that identifies a request in
+	// error reports, usually set by a load balancer or proxy.
+	RequestIDHeader = "X-Request-ID"
+)
+
+// reportError reports the error to the DefaultErrorReporter, along with the
+// request and the actor that made it. Requests handled by an ActionProcessor
+// carry its context, which the actor is found on.
+func reportError(r *http.Request, err error, status int, panicked bool) {
+	if DefaultErrorReporter == nil {
+		return
+	}
+	occurrence := report.Occurrence{
+		Error:     err,
+		Status:    status,
+		PrivateID: report.PrivateID(err),
+		Panic:     panicked,
+	}
+	if r != nil {
+		occurrence.RequestID = r.Header.Get(RequestIDHeader)
+		occurrence.Method = r.Method
+		occurrence.Path = r.URL.Path
+		if context, ok := r.Context().(*ctx.Context); ok {
+			if actor, ok := ContextActor(context); ok {
+				occurrence.ActorID, occurrence.ActorType = actor.ActorInfo()
+			}
+		}
+	}
+	DefaultErrorReporter.Report(occurrence)
+}
@@ -0,0 +1,42 @@
+package vc
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/report"
+	"github.com/snikch/api/report/reporttest"
+)
+
+func TestErrorReporting(t *testing.T) {
+	sink := &reporttest.Sink{}
+	defer func(reporter ErrorReporter) { DefaultErrorReporter = reporter }(DefaultErrorReporter)
+	reporter := report.NewReporter(sink)
+	DefaultErrorReporter = reporter
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+
+	r := httptest.NewRequest("GET", "/things", nil)
+	r.Header.Set(RequestIDHeader, "req")
+	serveAction(p, r, func(context *ctx.Context) (interface{}, int, error) {
+		SetContextActor(context, testActor{})
+		return nil, 0, errors.New("broken")
+	})
+	serveAction(p, httptest.NewRequest("GET", "/things", nil), func(*ctx.Context) (interface{}, int, error) {
+		panic("boom")
+	})
+	reporter.Flush()
+
+	events := sink.Events()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if event := events[0]; event.PrivateID == "" || event.RequestID != "req" || event.ActorID != "a1" || event.Path != "/things" || event.Panic {
+		t.Errorf("Unexpected error event %+v", event.Occurrence)
+	}
+	if event := events[1]; !event.Panic || event.Status != 500 || event.Stack == "" {
+		t.Errorf("Unexpected panic event %+v", event.Occurrence)
+	}
+}
@@ -0,0 +1,141 @@
+package vc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Route describes a single action registered on a router.
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	// Handler is the ActionHandler the route dispatches to.
+	Handler ActionHandler `json:"-"`
+}
+
+// Handle registers an ActionHandler on the router for the method and path,
+// and records the route so it can be listed via Routes.
+func (p *ActionProcessor) Handle(router *httprouter.Router, method, path, typ, action string, handler ActionHandler) {
+	router.Handle(method, path, p.HTTPHandler(typ, action, handler))
+	p.routes = append(p.routes, Route{
+		Method:  method,
+		Path:    path,
+		Type:    typ,
+		Action:  action,
+		Handler: handler,
+	})
+}
+
+// Routes returns every route registered via Handle or RegisterResource, in
+// the order they were registered.
+func (p *ActionProcessor) Routes() []Route {
+	routes := make([]Route, len(p.routes))
+	copy(routes, p.routes)
+	return routes
+}
+
+// The action names used for resource routes, in metrics, transformers, and
+// anywhere else a type and action are used.
+const (
+	ListAction   = "list"
+	ShowAction   = "show"
+	CreateAction = "create"
+	UpdateAction = "update"
+	DeleteAction = "delete"
+)
+
+// Resource declares the CRUD actions for an entity type. Only the actions with
+// a handler are registered. Given a resource named "users", the routes are:
+//
+//	GET    /users       list
+//	POST   /users       create
+//	GET    /users/:id   show
+//	PUT    /users/:id   update
+//	PATCH  /users/:id   update
+//	DELETE /users/:id   delete
+type Resource struct {
+	// Name is the entity type, and is used as the type for metrics, criteria
+	// and sideloading, as well as the default path segment.
+	Name string
+	// Path overrides the path segment for the resource, e.g. "/v1/users".
+	Path string
+	// IDParam is the name of the path parameter holding the entity id, which
+	// defaults to "id". Resources with children must each use a distinct name,
+	// e.g. "user_id", as the parameter is part of their children's paths.
+	IDParam string
+
+	List   ActionHandler
+	Show   ActionHandler
+	Create ActionHandler
+	Update ActionHandler
+	Delete ActionHandler
+
+	// Children are resources nested beneath a single entity of this resource,
+	// e.g. /users/:user_id/posts.
+	Children []Resource
+}
+
+// idParam returns the path parameter name for the resource's entity id.
+func (resource Resource) idParam() string {
+	if resource.IDParam == "" {
+		return "id"
+	}
+	return resource.IDParam
+}
+
+// segment returns the path segment for the resource.
+func (resource Resource) segment() string {
+	if resource.Path != "" {
+		return "/" + strings.Trim(resource.Path, "/")
+	}
+	return "/" + resource.Name
+}
+
+// RegisterResource registers the resource's actions, and those of its
+// children, on the router. It panics if nested resources share an id
+// parameter name, as the router couldn't tell them apart.
+func (p *ActionProcessor) RegisterResource(router *httprouter.Router, resource Resource) {
+	p.registerResource(router, "", map[string]bool{}, resource)
+}
+
+// registerResource registers a resource beneath the supplied prefix.
+func (p *ActionProcessor) registerResource(router *httprouter.Router, prefix string, params map[string]bool, resource Resource) {
+	idParam := resource.idParam()
+	if params[idParam] {
+		panic(fmt.Sprintf("vc: resource %s uses the id parameter %s, which is already used by a parent resource", resource.Name, idParam))
+	}
+
+	collectionPath := prefix + resource.segment()
+	entityPath := collectionPath + "/:" + idParam
+	for _, route := range []struct {
+		method, path, action string
+		handler              ActionHandler
+	}{
+		{"GET", collectionPath, ListAction, resource.List},
+		{"POST", collectionPath, CreateAction, resource.Create},
+		{"GET", entityPath, ShowAction, resource.Show},
+		{"PUT", entityPath, UpdateAction, resource.Update},
+		{"PATCH", entityPath, UpdateAction, resource.Update},
+		{"DELETE", entityPath, DeleteAction, resource.Delete},
+	} {
+		if route.handler == nil {
+			continue
+		}
+		p.Handle(router, route.method, route.path, resource.Name, route.action, route.handler)
+	}
+
+	if len(resource.Children) == 0 {
+		return
+	}
+	childParams := map[string]bool{idParam: true}
+	for param := range params {
+		childParams[param] = true
+	}
+	for _, child := range resource.Children {
+		p.registerResource(router, entityPath, childParams, child)
+	}
+}
@@ -0,0 +1,78 @@
+package vc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/snikch/api/ctx"
+)
+
+func TestRegisterResource(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	router := httprouter.New()
+	echo := func(context *ctx.Context) (interface{}, int, error) {
+		params := map[string]string{"type": context.EntityType}
+		for _, param := range ContextParams(context) {
+			params[param.Key] = param.Value
+		}
+		return params, 0, nil
+	}
+	handler := ActionHandlerFunc{Handler: echo}
+
+	p.RegisterResource(router, Resource{
+		Name:    "users",
+		IDParam: "user_id",
+		List:    handler,
+		Show:    handler,
+		Update:  handler,
+		Children: []Resource{{
+			Name:   "posts",
+			List:   handler,
+			Create: handler,
+			Delete: handler,
+		}},
+	})
+
+	routes := []string{}
+	for _, route := range p.Routes() {
+		routes = append(routes, route.Method+" "+route.Path+" "+route.Type+"-"+route.Action)
+	}
+	expected := []string{
+		"GET /users users-list",
+		"GET /users/:user_id users-show",
+		"PUT /users/:user_id users-update",
+		"PATCH /users/:user_id users-update",
+		"GET /users/:user_id/posts posts-list",
+		"POST /users/:user_id/posts posts-create",
+		"DELETE /users/:user_id/posts/:id posts-delete",
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("Unexpected routes:\n%v\nexpected:\n%v", routes, expected)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/users/u1/posts/p1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+	expectedBody := `{"payload":{"id":"p1","type":"posts","user_id":"u1"}}`
+	if body := w.Body.String(); body != expectedBody {
+		t.Errorf("Unexpected body %s", body)
+	}
+}
+
+func TestRegisterResourceDuplicateParam(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for a duplicate id parameter")
+		}
+	}()
+	NewActionProcessor().RegisterResource(httprouter.New(), Resource{
+		Name:     "users",
+		Children: []Resource{{Name: "posts"}},
+	})
+}
@@ -7,6 +7,8 @@ type Response struct {
 	Payload interface{} `json:"payload"`
 	// A pointer is used here to allow empty maps to be returned.
 	Sideload *map[string]map[string]interface{} `json:"related,omitempty"`
+	// Pagination is included when a handler returns a page of a collection.
+	Pagination *Pagination `json:"pagination,omitempty"`
 }
 
 // RespondWithStatusCode returns an empty response.
@@ -23,14 +25,19 @@ func RespondWithData(w http.ResponseWriter, r *http.Request, data interface{}, c
 func RespondWithRenderedData(renderer Renderer, w http.ResponseWriter, r *http.Request, data interface{}, code int) {
 	body, err := renderer.Render(data)
 	if err != nil {
-		RespondWithError(w, r, err)
+		RespondWithRenderedError(renderer, w, r, err)
 		return
 	}
+	respondWithBody(renderer, w, body, code)
+}
 
+// respondWithBody writes an already rendered body as a response.
+func respondWithBody(renderer Renderer, w http.ResponseWriter, body []byte, code int) {
 	// If the code is empty we assume it's an ok response.
 	if code == 0 {
 		code = http.StatusOK
 	}
+	setContentType(renderer, w.Header())
 	w.WriteHeader(code)
 	w.Write(body)
 }
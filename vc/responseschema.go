@@ -0,0 +1,104 @@
+package vc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/log"
+	schema "github.com/xeipuuv/gojsonschema"
+)
+
+// ResponseValidationMode determines what happens when a response payload
+// doesn't match the response schema for its action.
+type ResponseValidationMode int
+
+const (
+	// ResponseValidationNone skips validating responses. This is the default,
+	// as validation renders every payload an extra time.
+	ResponseValidationNone ResponseValidationMode = iota
+	// ResponseValidationLog logs a warning for responses that don't match,
+	// but still returns them.
+	ResponseValidationLog
+	// ResponseValidationFail returns an internal server error instead of a
+	// response that doesn't match, which is useful in development and tests.
+	ResponseValidationFail
+)
+
+// ResponseSchemaError is returned when a response payload doesn't match the
+// schema for its action. It doesn't implement StatusError, so clients only
+// receive a private error, while the invalid fields are logged.
+type ResponseSchemaError struct {
+	Type   string
+	Action string
+	Fields map[string]string
+}
+
+// Error implements the error interface.
+func (err ResponseSchemaError) Error() string {
+	return fmt.Sprintf("Response for %s-%s does not match schema", err.Type, err.Action)
+}
+
+// LogFields implements StructuredLogsError, logging each invalid field.
+func (err ResponseSchemaError) LogFields() map[string]string {
+	fields := map[string]string{
+		"type":   err.Type,
+		"action": err.Action,
+	}
+	for field, description := range err.Fields {
+		fields["schema."+field] = description
+	}
+	return fields
+}
+
+// SetResponseSchema sets the schema response payloads for a single type and
+// action are validated against, when ResponseValidation is enabled. This
+// should be called during setup, before any requests are being served.
+func (p *ActionProcessor) SetResponseSchema(typ, action string, s *schema.Schema) {
+	if p.ResponseSchemas == nil {
+		p.ResponseSchemas = map[string]*schema.Schema{}
+	}
+	p.ResponseSchemas[typ+"-"+action] = s
+}
+
+// validateResponse validates the payload against the response schema for the
+// type and action, if there is one. Mismatches are logged, or returned as a
+// ResponseSchemaError, depending on the ResponseValidation mode.
+func (p *ActionProcessor) validateResponse(typ, action string, payload interface{}) error {
+	if p.ResponseValidation == ResponseValidationNone {
+		return nil
+	}
+	s, ok := p.ResponseSchemas[typ+"-"+action]
+	if !ok {
+		return nil
+	}
+
+	// Payloads are validated as json, the same way request bodies are.
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	result, err := s.Validate(schema.NewBytesLoader(body))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	schemaErr := ResponseSchemaError{
+		Type:   typ,
+		Action: action,
+		Fields: fail.NewSchemaValidationError(result.Errors()).AdditionalFields,
+	}
+	if p.ResponseValidation == ResponseValidationFail {
+		return schemaErr
+	}
+	logData := logrus.Fields{}
+	for key, value := range schemaErr.LogFields() {
+		logData[key] = value
+	}
+	log.WithFields(logData).Warn(schemaErr.Error())
+	return nil
+}
@@ -5,20 +5,40 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync"
 
 	"github.com/snikch/api/ctx"
 	"github.com/snikch/api/fail"
 	schema "github.com/xeipuuv/gojsonschema"
 )
 
+var (
+	schemaSources     = map[*schema.Schema]json.RawMessage{}
+	schemaSourcesLock sync.RWMutex
+)
+
+// MustSchema compiles the schema, panicking if it is invalid. The source is
+// kept so the schema can be included in generated API documentation.
 func MustSchema(schemaString string) *schema.Schema {
 	s, err := schema.NewSchema(schema.NewStringLoader(schemaString))
 	if err != nil {
 		panic(err)
 	}
+	schemaSourcesLock.Lock()
+	schemaSources[s] = json.RawMessage(schemaString)
+	schemaSourcesLock.Unlock()
 	return s
 }
 
+// SchemaSource returns the JSON source of a schema created by MustSchema or
+// MustSchemaFromFile.
+func SchemaSource(s *schema.Schema) (json.RawMessage, bool) {
+	schemaSourcesLock.RLock()
+	source, ok := schemaSources[s]
+	schemaSourcesLock.RUnlock()
+	return source, ok
+}
+
 func MustSchemaFromFile(file string) *schema.Schema {
 	contents, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -30,6 +50,9 @@ func MustSchemaFromFile(file string) *schema.Schema {
 
 // UnmarshalAndValidateRequestSchema attempts to validate the body on the suppled
 // context against the supplied schema, then unmarshal it into the supplied obj.
+// The schema isn't added to the OpenAPI document, as it's only known once a
+// request is handled; document it with SetRequestSchema or by implementing
+// RequestSchemaHandler.
 func UnmarshalAndValidateRequestSchema(context *ctx.Context, s *schema.Schema, obj interface{}) error {
 	// Check we can get a body.
 	if context.Request == nil || context.Request.Body == nil {
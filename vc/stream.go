@@ -0,0 +1,383 @@
+package vc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+	"github.com/snikch/api/lynx"
+	"github.com/snikch/api/sideload"
+)
+
+// NDJSONMediaType is the media type of newline delimited json. Streams are
+// written as ndjson when it is the negotiated media type, and as a json
+// array otherwise.
+const NDJSONMediaType = "application/x-ndjson"
+
+// StreamChunkSize is the number of items unlocked, sideloaded and written to
+// the client at a time when streaming.
+var StreamChunkSize = 100
+
+// MaxStreamRelated is the number of related entities held in memory while
+// streaming. A json array's related entities are written at the end, so a
+// stream fails with a fail.NotAcceptableError once it has more than this many,
+// suggesting ndjson instead. As ndjson, it only limits how many entities are
+// remembered to avoid writing them twice.
+var MaxStreamRelated = 10000
+
+// Stream can be returned as the payload from an ActionHandler to stream a
+// collection to the client, rather than rendering it all in memory. Items are
+// processed in chunks, with any lynx.Lockable items unlocked, and related
+// entities sideloaded, before each chunk is written and flushed. Items are
+// always written with encoding/json, so the negotiated media type must be
+// ndjson, application/json or a +json type, otherwise a
+// fail.NotAcceptableError is returned.
+//
+// As ndjson, each item is written as a line containing {"payload": item}, and
+// the related entities of each chunk are written as {"related": {...}} before
+// the items that reference them. As a json array, the body is a Response
+// whose payload is every item, and related entities are written at the end.
+// Errors after the response has started are written as a final "error"
+// member in either format, as the status code has already been sent.
+type Stream interface {
+	// Next returns the next item, or false once there are no more items.
+	Next(*ctx.Context) (interface{}, bool, error)
+}
+
+// StreamFunc wraps a function with the Next signature to a Stream.
+type StreamFunc func(*ctx.Context) (interface{}, bool, error)
+
+// Next implements the Stream interface and simply calls the function.
+func (fn StreamFunc) Next(context *ctx.Context) (interface{}, bool, error) {
+	return fn(context)
+}
+
+// ChannelStream streams the items sent on a channel until it is closed.
+type ChannelStream struct {
+	Items <-chan interface{}
+	// Err is called once Items has been closed, and returns any error that
+	// stopped items being produced.
+	Err func() error
+}
+
+// Next implements the Stream interface, waiting for the next item or the
+// context to finish.
+func (stream ChannelStream) Next(context *ctx.Context) (interface{}, bool, error) {
+	select {
+	case item, ok := <-stream.Items:
+		if ok {
+			return item, true, nil
+		}
+		if stream.Err != nil {
+			return nil, false, stream.Err()
+		}
+		return nil, false, nil
+	case <-context.Done():
+		return nil, false, fail.NewTimeoutError(context.Err())
+	}
+}
+
+// respondWithStream writes every item in the stream to the client. The first
+// chunk is processed before the response is started, so errors in it can still
+// be returned with the correct status code.
+func (p *ActionProcessor) respondWithStream(context *ctx.Context, renderer Renderer, w http.ResponseWriter, r *http.Request, typ string, criteria *Criteria, stream Stream, code int, sideloadTimer, unlockTimer metrics.Timer) {
+	// Unlock anything the handler registered before streaming started.
+	if err := p.unlock(context, unlockTimer); err != nil {
+		RespondWithRenderedError(renderer, w, r, err)
+		return
+	}
+
+	writer, err := newStreamWriter(w, r, renderer)
+	if err != nil {
+		RespondWithRenderedError(renderer, w, r, err)
+		return
+	}
+	for first := true; ; first = false {
+		chunk, more, streamErr := nextChunk(context, stream)
+		if streamErr != nil && !writer.started {
+			RespondWithRenderedError(renderer, w, r, streamErr)
+			return
+		}
+		response, err := p.processChunk(context, typ, criteria, chunk, first, sideloadTimer, unlockTimer)
+		if err != nil {
+			if !writer.started {
+				RespondWithRenderedError(renderer, w, r, err)
+				return
+			}
+			writer.writeError(err)
+			return
+		}
+		related, err := writer.relate(response)
+		if err != nil {
+			if !writer.started {
+				RespondWithRenderedError(renderer, w, r, err)
+				return
+			}
+			writer.writeError(err)
+			return
+		}
+		writer.start(code)
+		writer.writeChunk(response, related)
+		// Items read before the stream failed are written before the error.
+		if streamErr != nil {
+			writer.writeError(streamErr)
+			return
+		}
+		if !more {
+			break
+		}
+	}
+	writer.finish()
+}
+
+// nextChunk reads up to StreamChunkSize items from the stream, returning true
+// if there may be more items. Any items read before an error are returned
+// along with it.
+func nextChunk(context *ctx.Context, stream Stream) ([]interface{}, bool, error) {
+	size := StreamChunkSize
+	if size < 1 {
+		size = 1
+	}
+	chunk := make([]interface{}, 0, size)
+	for len(chunk) < size {
+		if err := context.Err(); err != nil {
+			return chunk, false, fail.NewTimeoutError(err)
+		}
+		item, ok, err := stream.Next(context)
+		if err != nil {
+			return chunk, false, err
+		}
+		if !ok {
+			return chunk, false, nil
+		}
+		chunk = append(chunk, item)
+	}
+	return chunk, true, nil
+}
+
+// processChunk unlocks, sideloads and restricts the fields of a chunk of
+// items, returning them as a response. Preloaded entities are only included
+// with the first chunk, as they are the same for every chunk.
+func (p *ActionProcessor) processChunk(context *ctx.Context, typ string, criteria *Criteria, chunk []interface{}, first bool, sideloadTimer, unlockTimer metrics.Timer) (Response, error) {
+	response := Response{Payload: chunk}
+
+	store := lynx.NewStore(context)
+	for _, item := range chunk {
+		if lockable, ok := item.(lynx.Lockable); ok {
+			store.Save(lockable)
+		}
+	}
+	start := time.Now()
+	err := store.Unlock()
+	unlockTimer.UpdateSince(start)
+	if err != nil {
+		return response, err
+	}
+
+	if p.SideloadEnabled && len(chunk) > 0 && (first || criteria.Sideload != nil) {
+		start := time.Now()
+		sideloaded, err := sideload.Load(context, typedSlice(chunk), criteria.Sideload)
+		sideloadTimer.UpdateSince(start)
+		if err != nil {
+			return response, err
+		}
+		response.Sideload = &sideloaded
+	}
+
+	if err := applySparseFields(typ, criteria, &response); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// typedSlice converts the items to a slice of their concrete type, so their
+// registered sideload types can be found. Items are expected to be of the same
+// type, as with any sideloaded collection.
+func typedSlice(items []interface{}) interface{} {
+	if len(items) == 0 || items[0] == nil {
+		return items
+	}
+	typ := reflect.TypeOf(items[0])
+	slice := reflect.MakeSlice(reflect.SliceOf(typ), 0, len(items))
+	for _, item := range items {
+		value := reflect.ValueOf(item)
+		if !value.IsValid() || value.Type() != typ {
+			return items
+		}
+		slice = reflect.Append(slice, value)
+	}
+	return slice.Interface()
+}
+
+// streamWriter writes chunks of a stream in either ndjson or as a json array.
+type streamWriter struct {
+	w http.ResponseWriter
+	// r is the request being responded to, which errors are reported with.
+	r           *http.Request
+	contentType string
+	ndjson      bool
+	started     bool
+	items       int
+	// related holds related entities keyed by type and id, which are written
+	// at the end of a json array, or used to avoid writing the same entity
+	// twice as ndjson. It holds at most MaxStreamRelated entities.
+	related      map[string]map[string]interface{}
+	relatedCount int
+}
+
+// newStreamWriter returns a streamWriter for the negotiated renderer, or a
+// fail.NotAcceptableError if its media type can't be streamed.
+func newStreamWriter(w http.ResponseWriter, r *http.Request, renderer Renderer) (*streamWriter, error) {
+	contentType := rendererContentType(renderer)
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	ndjson := mediaType == NDJSONMediaType
+	if !ndjson && mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		err := fail.NewNotAcceptableError(fmt.Errorf("This response can't be streamed as %s", contentType))
+		err.Description = "This response is streamed, which is only supported as json or " + NDJSONMediaType + "."
+		return nil, err
+	}
+	return &streamWriter{
+		w:           w,
+		r:           r,
+		contentType: contentType,
+		ndjson:      ndjson,
+		related:     map[string]map[string]interface{}{},
+	}, nil
+}
+
+// start writes the headers, and the opening of a json array, if the response
+// hasn't been started yet.
+func (writer *streamWriter) start(code int) {
+	if writer.started {
+		return
+	}
+	writer.started = true
+	if code == 0 {
+		code = http.StatusOK
+	}
+	writer.w.Header().Set("Content-Type", writer.contentType)
+	// Streams are never a known length, and intermediaries shouldn't buffer.
+	writer.w.Header().Del("Content-Length")
+	writer.w.Header().Set("X-Accel-Buffering", "no")
+	writer.w.WriteHeader(code)
+	if !writer.ndjson {
+		writer.w.Write([]byte(`{"payload":[`))
+	}
+}
+
+// relate records the related entities in a response, returning those that
+// haven't been seen before. Once more than MaxStreamRelated are held, a json
+// array fails, while ndjson forgets the entities it has already written.
+func (writer *streamWriter) relate(response Response) (map[string]map[string]interface{}, error) {
+	newRelated := map[string]map[string]interface{}{}
+	if response.Sideload == nil {
+		return newRelated, nil
+	}
+	for name, entities := range *response.Sideload {
+		for id, entity := range entities {
+			if _, ok := writer.related[name][id]; ok {
+				continue
+			}
+			if newRelated[name] == nil {
+				newRelated[name] = map[string]interface{}{}
+			}
+			newRelated[name][id] = entity
+		}
+	}
+	for name, entities := range newRelated {
+		if writer.relatedCount+len(entities) > MaxStreamRelated {
+			if !writer.ndjson {
+				err := fail.NewNotAcceptableError(fmt.Errorf("Too many related entities to stream as json"))
+				err.Description = "This response has too many related entities to be written as json. Request it as " + NDJSONMediaType + " instead."
+				return nil, err
+			}
+			writer.related = map[string]map[string]interface{}{}
+			writer.relatedCount = 0
+		}
+		if writer.related[name] == nil {
+			writer.related[name] = map[string]interface{}{}
+		}
+		for id, entity := range entities {
+			writer.related[name][id] = entity
+		}
+		writer.relatedCount += len(entities)
+	}
+	return newRelated, nil
+}
+
+// writeChunk writes the items in a response, and their related entities that
+// haven't been written yet as ndjson, then flushes them to the client.
+func (writer *streamWriter) writeChunk(response Response, newRelated map[string]map[string]interface{}) {
+	if writer.ndjson && len(newRelated) > 0 {
+		writer.writeLine(map[string]interface{}{"related": newRelated})
+	}
+
+	items, _ := response.Payload.([]interface{})
+	for _, item := range items {
+		if writer.ndjson {
+			writer.writeLine(map[string]interface{}{"payload": item})
+			continue
+		}
+		body, err := json.Marshal(item)
+		if err != nil {
+			body, _ = json.Marshal(err.Error())
+		}
+		if writer.items > 0 {
+			writer.w.Write([]byte(","))
+		}
+		writer.w.Write(body)
+		writer.items++
+	}
+	writer.flush()
+}
+
+// writeError writes an error that occurred after the response started, and
+// ends the response.
+func (writer *streamWriter) writeError(err error) {
+	apiError, _, _ := logAPIError(writer.r, err, false)
+	if writer.ndjson {
+		writer.writeLine(map[string]interface{}{"error": apiError})
+	} else {
+		body, _ := json.Marshal(apiError)
+		writer.w.Write([]byte(`],"error":`))
+		writer.w.Write(body)
+		writer.w.Write([]byte("}"))
+	}
+	writer.flush()
+}
+
+// finish ends the response, writing the related entities of a json array.
+func (writer *streamWriter) finish() {
+	if !writer.ndjson {
+		writer.w.Write([]byte("]"))
+		if len(writer.related) > 0 {
+			body, _ := json.Marshal(writer.related)
+			writer.w.Write([]byte(`,"related":`))
+			writer.w.Write(body)
+		}
+		writer.w.Write([]byte("}"))
+	}
+	writer.flush()
+}
+
+// writeLine writes a single ndjson line.
+func (writer *streamWriter) writeLine(value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		body, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	writer.w.Write(append(body, '\n'))
+}
+
+// flush sends anything written so far to the client.
+func (writer *streamWriter) flush() {
+	if flusher, ok := writer.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
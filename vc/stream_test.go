@@ -0,0 +1,120 @@
+package vc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/snikch/api/ctx"
+	"github.com/snikch/api/fail"
+)
+
+type ndjsonTestRenderer struct{ jsonTestRenderer }
+
+func (ndjsonTestRenderer) ContentType() string { return NDJSONMediaType }
+
+// testStream streams the supplied items, then returns the error if set.
+func testStream(err error, items ...interface{}) func(*ctx.Context) (interface{}, int, error) {
+	return func(*ctx.Context) (interface{}, int, error) {
+		ch := make(chan interface{}, len(items))
+		for _, item := range items {
+			ch <- item
+		}
+		close(ch)
+		return ChannelStream{Items: ch, Err: func() error { return err }}, 0, nil
+	}
+}
+
+func TestStream(t *testing.T) {
+	defer func(size int) { StreamChunkSize = size }(StreamChunkSize)
+	StreamChunkSize = 2
+	p := NewActionProcessor()
+	p.Renderers.Register("application/json", jsonTestRenderer{})
+	p.Renderers.Register(NDJSONMediaType, ndjsonTestRenderer{})
+	things := []interface{}{testThing{ID: "1"}, testThing{ID: "2"}, testThing{ID: "3"}}
+
+	r := httptest.NewRequest("GET", "/things?fields=id", nil)
+	w := serveAction(p, r, testStream(nil, things...))
+	expected := `{"payload":[{"id":"1"},{"id":"2"},{"id":"3"}]}`
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("Unexpected json stream %d %s", w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest("GET", "/things?fields=id", nil)
+	r.Header.Set("Accept", NDJSONMediaType)
+	w = serveAction(p, r, testStream(errors.New("Broken"), things...))
+	// Private errors have a random id, so only the start of the error is known.
+	expected = `{"payload":{"id":"1"}}` + "\n" +
+		`{"payload":{"id":"2"}}` + "\n" +
+		`{"payload":{"id":"3"}}` + "\n" +
+		`{"error":{"error":"[`
+	if w.Header().Get("Content-Type") != NDJSONMediaType {
+		t.Errorf("Unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), expected) {
+		t.Errorf("Unexpected ndjson stream %d %s", w.Code, w.Body)
+	}
+
+	// Errors in the first chunk can still be returned with a status code.
+	r = httptest.NewRequest("GET", "/things?fields=missing", nil)
+	w = serveAction(p, r, testStream(nil, things...))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a validation error, got %d %s", w.Code, w.Body)
+	}
+}
+
+type csvTestRenderer struct{ jsonTestRenderer }
+
+func (csvTestRenderer) ContentType() string { return "text/csv" }
+
+func TestStreamNotAcceptable(t *testing.T) {
+	p := NewActionProcessor()
+	p.Renderers.Register("text/csv", csvTestRenderer{})
+	p.Renderers.Register("application/vnd.things+json", jsonTestRenderer{})
+
+	r := httptest.NewRequest("GET", "/things", nil)
+	w := serveAction(p, r, testStream(nil, testThing{ID: "1"}))
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected a csv stream to be not acceptable, got %d %s", w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest("GET", "/things?fields=id", nil)
+	r.Header.Set("Accept", "application/vnd.things+json")
+	w = serveAction(p, r, testStream(nil, testThing{ID: "1"}))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/vnd.things+json" {
+		t.Errorf("Unexpected json stream %d %s %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+}
+
+func TestStreamRelatedLimit(t *testing.T) {
+	defer func(max int) { MaxStreamRelated = max }(MaxStreamRelated)
+	MaxStreamRelated = 2
+	chunk := func(ids ...string) Response {
+		entities := map[string]interface{}{}
+		for _, id := range ids {
+			entities[id] = testThing{ID: id}
+		}
+		return Response{Sideload: &map[string]map[string]interface{}{"things": entities}}
+	}
+
+	writer := &streamWriter{related: map[string]map[string]interface{}{}}
+	if _, err := writer.relate(chunk("1", "2")); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	related, err := writer.relate(chunk("2"))
+	if err != nil || len(related) != 0 {
+		t.Errorf("Expected an entity already held to be skipped, got %v %v", related, err)
+	}
+	if _, err := writer.relate(chunk("3")); !errors.Is(err, fail.ErrNotAcceptable) {
+		t.Errorf("Expected a json array to fail past the limit, got %v", err)
+	}
+
+	writer = &streamWriter{ndjson: true, related: map[string]map[string]interface{}{}}
+	writer.relate(chunk("1", "2"))
+	related, err = writer.relate(chunk("3"))
+	if err != nil || len(related["things"]) != 1 || writer.relatedCount != 1 {
+		t.Errorf("Expected ndjson to forget written entities, got %v %v %d", related, err, writer.relatedCount)
+	}
+}